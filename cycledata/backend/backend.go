@@ -0,0 +1,98 @@
+/*
+ * 周期数据持久化后端
+ *
+ * 模块用途：
+ *   各业务重复实现的加载器/存储器大多相同：把 MiscData 序列化后按 (cycle, typeKey, userID) 写一行。
+ *   Backend 统一了这组操作，UseBackend 一次调用即可把后端注册为加载器和批量存储器：
+ *   - FileBackend: 本地文件存储，每个玩家一个文件，适合单机部署和测试
+ *   - SQLBackend:  基于 database/sql 的通用实现，驱动由调用方提供（MySQL、PostgreSQL、SQLite 等）
+ *
+ *   MiscData 通过 cycledata.MarshalMiscData 编码，[]int32、map[int32]int32 等类型读回后保持不变；
+ *   UpdateTime、ExpireTime、Loop、Version 一并持久化。
+ *
+ *   写入按 PlayerData.Version 做条件写入：存储中的版本号与 data.Version 不一致（或 data.Version 不为 0 而记录不存在）时
+ *   不写入，单条返回 cycledata.ErrVersionConflict，批量返回列出冲突玩家的 *cycledata.VersionConflictError，
+ *   其余记录正常写入。
+ *
+ * 示例：
+ *   db, _ := sql.Open("mysql", dsn)
+ *   b := backend.NewSQLBackend(db, "cycle_data")
+ *   _ = b.CreateTable(ctx)
+ *   backend.UseBackend(cycledata.DailyCycle, cycledata.TypeKey(1), b)
+ */
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/cnbbin/go-cachedb/cycledata"
+)
+
+/*
+ * Backend 周期数据持久化后端
+ * Load 在数据不存在时返回 (nil, nil)，由创建器构造新数据；Store / BatchStore 为按版本号的条件插入或覆盖
+ */
+type Backend interface {
+	Load(ctx context.Context, cycle cycledata.CycleType, typeKey cycledata.TypeKey, userID cycledata.UserID) (*cycledata.PlayerData, error)
+	Store(ctx context.Context, cycle cycledata.CycleType, typeKey cycledata.TypeKey, data *cycledata.PlayerData) error
+	BatchStore(ctx context.Context, cycle cycledata.CycleType, typeKey cycledata.TypeKey, batch []*cycledata.PlayerData) error
+	Delete(ctx context.Context, cycle cycledata.CycleType, typeKey cycledata.TypeKey, userID cycledata.UserID) error
+}
+
+/*
+ * UseBackend 将后端注册为指定周期和类型的加载器和批量存储器（每批 cycledata.DefaultBatchSize 条）
+ * 创建器仍需单独注册
+ */
+func UseBackend(cycle cycledata.CycleType, typeKey cycledata.TypeKey, b Backend) {
+	cycledata.RegisterLoaderCtx(cycle, typeKey, b.Load)
+	cycledata.RegisterBatchStorerCtx(cycle, typeKey, cycledata.DefaultBatchSize, b.BatchStore)
+}
+
+/*
+ * record 持久化的记录内容
+ */
+type record struct {
+	UpdateTime int64           `json:"update"` // UnixNano
+	ExpireTime int64           `json:"expire"`
+	Loop       int64           `json:"loop"`
+	Version    int64           `json:"version"`
+	MiscData   json.RawMessage `json:"misc"`
+}
+
+/*
+ * newRecord 编码记录，版本号为写入后的版本 data.Version+1（调用方需保证 data 不被并发修改，cycledata 交给存储器的是记录副本）
+ */
+func newRecord(data *cycledata.PlayerData) (*record, error) {
+	misc, err := cycledata.MarshalMiscData(data.MiscData)
+	if err != nil {
+		return nil, err
+	}
+	rec := &record{ExpireTime: data.ExpireTime, Loop: data.Loop, Version: data.Version + 1, MiscData: misc}
+	if !data.UpdateTime.IsZero() {
+		rec.UpdateTime = data.UpdateTime.UnixNano()
+	}
+	return rec, nil
+}
+
+/*
+ * playerData 还原为 PlayerData
+ */
+func (rec *record) playerData(userID cycledata.UserID) (*cycledata.PlayerData, error) {
+	misc, err := cycledata.UnmarshalMiscData(rec.MiscData)
+	if err != nil {
+		return nil, err
+	}
+	data := &cycledata.PlayerData{
+		UserID:     userID,
+		ExpireTime: rec.ExpireTime,
+		Loop:       rec.Loop,
+		Version:    rec.Version,
+		MiscData:   misc,
+	}
+	if rec.UpdateTime != 0 {
+		data.UpdateTime = time.Unix(0, rec.UpdateTime)
+	}
+	return data, nil
+}
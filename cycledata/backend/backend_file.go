@@ -0,0 +1,170 @@
+/*
+ * 本地文件后端
+ *
+ * 每个玩家一个 JSON 文件：<dir>/<cycle>/<typeKey>/<userID>.json
+ * 写入时先写临时文件、fsync 后再重命名，进程崩溃不会留下半个文件；
+ * 版本号检查和写入在进程内互斥，多个进程共用同一目录时不保证条件写入的原子性
+ */
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/cnbbin/go-cachedb/cycledata"
+)
+
+/*
+ * FileBackend 本地文件后端
+ */
+type FileBackend struct {
+	dir string
+	mu  sync.Mutex // 串行化版本号检查和写入
+}
+
+/*
+ * NewFileBackend 创建以 dir 为根目录的文件后端，目录不存在时在首次写入时创建
+ */
+func NewFileBackend(dir string) *FileBackend {
+	return &FileBackend{dir: dir}
+}
+
+/*
+ * path 记录对应的文件路径
+ */
+func (b *FileBackend) path(cycle cycledata.CycleType, typeKey cycledata.TypeKey, userID cycledata.UserID) string {
+	return filepath.Join(b.dir, string(cycle), strconv.Itoa(int(typeKey)), strconv.FormatInt(int64(userID), 10)+".json")
+}
+
+/*
+ * Load 读取玩家数据，文件不存在时返回 (nil, nil)
+ */
+func (b *FileBackend) Load(ctx context.Context, cycle cycledata.CycleType, typeKey cycledata.TypeKey, userID cycledata.UserID) (*cycledata.PlayerData, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	rec, err := b.read(cycle, typeKey, userID)
+	if rec == nil || err != nil {
+		return nil, err
+	}
+	return rec.playerData(userID)
+}
+
+/*
+ * read 读取并解码文件，文件不存在时返回 (nil, nil)
+ */
+func (b *FileBackend) read(cycle cycledata.CycleType, typeKey cycledata.TypeKey, userID cycledata.UserID) (*record, error) {
+	raw, err := os.ReadFile(b.path(cycle, typeKey, userID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rec record
+	if err := json.Unmarshal(raw, &rec); err != nil {
+		return nil, fmt.Errorf("decode uid %d, cycle %v, type %v: %w", userID, cycle, typeKey, err)
+	}
+	return &rec, nil
+}
+
+/*
+ * Store 写入单条玩家数据，文件中的版本号与 data.Version 不一致时返回 cycledata.ErrVersionConflict
+ */
+func (b *FileBackend) Store(ctx context.Context, cycle cycledata.CycleType, typeKey cycledata.TypeKey, data *cycledata.PlayerData) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stored, err := b.read(cycle, typeKey, data.UserID)
+	if err != nil {
+		return err
+	}
+	if (stored == nil && data.Version != 0) || (stored != nil && stored.Version != data.Version) {
+		return fmt.Errorf("%w: uid %d, cycle %v, type %v", cycledata.ErrVersionConflict, data.UserID, cycle, typeKey)
+	}
+
+	rec, err := newRecord(data)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.path(cycle, typeKey, data.UserID), raw)
+}
+
+/*
+ * BatchStore 逐条写入，遇到版本冲突以外的错误立即返回（已写入的文件保留）；
+ * 版本冲突的记录跳过，全部写完后返回列出冲突玩家的 *cycledata.VersionConflictError
+ */
+func (b *FileBackend) BatchStore(ctx context.Context, cycle cycledata.CycleType, typeKey cycledata.TypeKey, batch []*cycledata.PlayerData) error {
+	var conflicts []cycledata.UserID
+	for _, data := range batch {
+		err := b.Store(ctx, cycle, typeKey, data)
+		switch {
+		case errors.Is(err, cycledata.ErrVersionConflict):
+			conflicts = append(conflicts, data.UserID)
+		case err != nil:
+			return err
+		}
+	}
+	if len(conflicts) > 0 {
+		return &cycledata.VersionConflictError{UserIDs: conflicts}
+	}
+	return nil
+}
+
+/*
+ * Delete 删除玩家数据，文件不存在时视为成功
+ */
+func (b *FileBackend) Delete(ctx context.Context, cycle cycledata.CycleType, typeKey cycledata.TypeKey, userID cycledata.UserID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := os.Remove(b.path(cycle, typeKey, userID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/*
+ * writeFileAtomic 写临时文件并 fsync 后重命名为目标文件
+ */
+func writeFileAtomic(path string, raw []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,233 @@
+/*
+ * database/sql 后端
+ *
+ * 表结构（CreateTable 创建）：
+ *   cycle VARCHAR(32), type_key INTEGER, user_id BIGINT   -- 联合主键
+ *   update_time BIGINT (UnixNano), expire_time BIGINT, loop_index BIGINT, version BIGINT, misc_data TEXT
+ *
+ * 写入为先按版本号 UPDATE（WHERE version = data.Version），未命中时查询现有版本：
+ * 记录不存在且 data.Version 为 0 时 INSERT，否则视为版本冲突；同一批在一个事务内完成，不依赖各数据库的 UPSERT 语法。
+ * INSERT 在保存点内执行，其他实例抢先插入同一主键时只回滚到保存点，该玩家按版本冲突处理，不影响同批其余记录。
+ * 占位符默认为 ?，PostgreSQL 等使用 NewSQLBackendWithPlaceholder(db, table, DollarPlaceholder)
+ */
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cnbbin/go-cachedb/cycledata"
+)
+
+// insertSavepoint 包裹单条 INSERT 的保存点名
+const insertSavepoint = "cycledata_insert"
+
+/*
+ * SQLBackend 基于 database/sql 的后端
+ */
+type SQLBackend struct {
+	db *sql.DB
+
+	loadSQL    string
+	versionSQL string
+	updateSQL  string
+	insertSQL  string
+	deleteSQL  string
+	createSQL  string
+}
+
+/*
+ * QuestionPlaceholder MySQL / SQLite 风格的占位符 ?
+ */
+func QuestionPlaceholder(int) string { return "?" }
+
+/*
+ * DollarPlaceholder PostgreSQL 风格的占位符 $1, $2...
+ */
+func DollarPlaceholder(n int) string { return fmt.Sprintf("$%d", n) }
+
+/*
+ * NewSQLBackend 创建使用 table 表的后端，占位符为 ?
+ */
+func NewSQLBackend(db *sql.DB, table string) *SQLBackend {
+	return NewSQLBackendWithPlaceholder(db, table, QuestionPlaceholder)
+}
+
+/*
+ * NewSQLBackendWithPlaceholder 创建使用 table 表的后端，placeholder(n) 返回第 n 个（从 1 开始）参数的占位符
+ */
+func NewSQLBackendWithPlaceholder(db *sql.DB, table string, placeholder func(n int) string) *SQLBackend {
+	ph := func(from, count int) []string {
+		out := make([]string, count)
+		for i := range out {
+			out[i] = placeholder(from + i)
+		}
+		return out
+	}
+	where := func(from int) string {
+		p := ph(from, 3)
+		return fmt.Sprintf("cycle = %s AND type_key = %s AND user_id = %s", p[0], p[1], p[2])
+	}
+	set := ph(1, 5)
+
+	return &SQLBackend{
+		db: db,
+		loadSQL: fmt.Sprintf("SELECT update_time, expire_time, loop_index, version, misc_data FROM %s WHERE %s",
+			table, where(1)),
+		versionSQL: fmt.Sprintf("SELECT version FROM %s WHERE %s", table, where(1)),
+		updateSQL: fmt.Sprintf("UPDATE %s SET update_time = %s, expire_time = %s, loop_index = %s, version = %s, misc_data = %s WHERE %s AND version = %s",
+			table, set[0], set[1], set[2], set[3], set[4], where(6), placeholder(9)),
+		insertSQL: fmt.Sprintf("INSERT INTO %s (cycle, type_key, user_id, update_time, expire_time, loop_index, version, misc_data) VALUES (%s)",
+			table, strings.Join(ph(1, 8), ", ")),
+		deleteSQL: fmt.Sprintf("DELETE FROM %s WHERE %s", table, where(1)),
+		createSQL: fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s ("+
+			"cycle VARCHAR(32) NOT NULL, type_key INTEGER NOT NULL, user_id BIGINT NOT NULL, "+
+			"update_time BIGINT NOT NULL, expire_time BIGINT NOT NULL, loop_index BIGINT NOT NULL, "+
+			"version BIGINT NOT NULL DEFAULT 0, misc_data TEXT NOT NULL, "+
+			"PRIMARY KEY (cycle, type_key, user_id))", table),
+	}
+}
+
+/*
+ * CreateTable 创建数据表（已存在时不做任何事）
+ */
+func (b *SQLBackend) CreateTable(ctx context.Context) error {
+	_, err := b.db.ExecContext(ctx, b.createSQL)
+	return err
+}
+
+/*
+ * Load 读取玩家数据，不存在时返回 (nil, nil)
+ */
+func (b *SQLBackend) Load(ctx context.Context, cycle cycledata.CycleType, typeKey cycledata.TypeKey, userID cycledata.UserID) (*cycledata.PlayerData, error) {
+	var (
+		rec  record
+		misc string
+	)
+	err := b.db.QueryRowContext(ctx, b.loadSQL, string(cycle), int64(typeKey), int64(userID)).
+		Scan(&rec.UpdateTime, &rec.ExpireTime, &rec.Loop, &rec.Version, &misc)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec.MiscData = []byte(misc)
+	return rec.playerData(userID)
+}
+
+/*
+ * Store 写入单条玩家数据，版本冲突时返回 cycledata.ErrVersionConflict
+ */
+func (b *SQLBackend) Store(ctx context.Context, cycle cycledata.CycleType, typeKey cycledata.TypeKey, data *cycledata.PlayerData) error {
+	err := b.BatchStore(ctx, cycle, typeKey, []*cycledata.PlayerData{data})
+	if errors.Is(err, cycledata.ErrVersionConflict) {
+		return fmt.Errorf("%w: uid %d, cycle %v, type %v", cycledata.ErrVersionConflict, data.UserID, cycle, typeKey)
+	}
+	return err
+}
+
+/*
+ * BatchStore 在一个事务中写入整批数据，版本冲突以外的错误使整批回滚；
+ * 版本冲突的记录跳过，其余记录提交后返回列出冲突玩家的 *cycledata.VersionConflictError
+ */
+func (b *SQLBackend) BatchStore(ctx context.Context, cycle cycledata.CycleType, typeKey cycledata.TypeKey, batch []*cycledata.PlayerData) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	update, err := tx.PrepareContext(ctx, b.updateSQL)
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+	insert, err := tx.PrepareContext(ctx, b.insertSQL)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	var conflicts []cycledata.UserID
+	for _, data := range batch {
+		rec, err := newRecord(data)
+		if err != nil {
+			return fmt.Errorf("encode uid %d: %w", data.UserID, err)
+		}
+		key := []interface{}{string(cycle), int64(typeKey), int64(data.UserID)}
+
+		res, err := update.ExecContext(ctx, append(append([]interface{}{rec.UpdateTime, rec.ExpireTime, rec.Loop, rec.Version, string(rec.MiscData)}, key...), data.Version)...)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n > 0 {
+			continue
+		}
+
+		// 未命中：记录不存在时插入，存在则说明版本号已被其他实例推进
+		var version int64
+		err = tx.QueryRowContext(ctx, b.versionSQL, key...).Scan(&version)
+		switch {
+		case err == sql.ErrNoRows && data.Version == 0:
+			inserted, err := b.insertIfAbsent(ctx, tx, insert, key, rec)
+			if err != nil {
+				return err
+			}
+			if !inserted {
+				conflicts = append(conflicts, data.UserID)
+			}
+		case err == nil || err == sql.ErrNoRows:
+			conflicts = append(conflicts, data.UserID)
+		default:
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return &cycledata.VersionConflictError{UserIDs: conflicts}
+	}
+	return nil
+}
+
+/*
+ * insertIfAbsent 在保存点内插入新记录，返回 false 表示记录已被其他实例插入（版本冲突）
+ * 插入失败时回滚到保存点并重新查询：记录已存在说明是主键冲突，否则原样返回插入错误
+ */
+func (b *SQLBackend) insertIfAbsent(ctx context.Context, tx *sql.Tx, insert *sql.Stmt, key []interface{}, rec *record) (bool, error) {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT "+insertSavepoint); err != nil {
+		return false, err
+	}
+	_, insertErr := insert.ExecContext(ctx, append(key, rec.UpdateTime, rec.ExpireTime, rec.Loop, rec.Version, string(rec.MiscData))...)
+	if insertErr == nil {
+		_, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT "+insertSavepoint)
+		return err == nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+insertSavepoint); err != nil {
+		return false, err
+	}
+	var version int64
+	switch err := tx.QueryRowContext(ctx, b.versionSQL, key...).Scan(&version); err {
+	case nil:
+		return false, nil
+	case sql.ErrNoRows:
+		return false, insertErr
+	default:
+		return false, err
+	}
+}
+
+/*
+ * Delete 删除玩家数据，不存在时视为成功
+ */
+func (b *SQLBackend) Delete(ctx context.Context, cycle cycledata.CycleType, typeKey cycledata.TypeKey, userID cycledata.UserID) error {
+	_, err := b.db.ExecContext(ctx, b.deleteSQL, string(cycle), int64(typeKey), int64(userID))
+	return err
+}
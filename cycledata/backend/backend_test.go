@@ -0,0 +1,287 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cnbbin/go-cachedb/cycledata"
+)
+
+/*
+ * memDriver 只支持 SQLBackend 所用语句的内存驱动，主键为前三个参数
+ */
+type memDriver struct {
+	mu   sync.Mutex
+	rows map[string][]driver.Value
+
+	// beforeInsert 在 INSERT 检查主键前调用（持有 mu），用于模拟其他实例并发插入
+	beforeInsert func(key string)
+}
+
+type memConn struct{ d *memDriver }
+
+type memStmt struct {
+	d     *memDriver
+	query string
+}
+
+type memResult int64
+
+type memRows struct {
+	cols []string
+	row  []driver.Value
+	done bool
+}
+
+func (d *memDriver) Open(string) (driver.Conn, error) { return &memConn{d: d}, nil }
+
+func (c *memConn) Prepare(query string) (driver.Stmt, error) {
+	return &memStmt{d: c.d, query: query}, nil
+}
+func (c *memConn) Close() error              { return nil }
+func (c *memConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *memConn) Commit() error             { return nil }
+func (c *memConn) Rollback() error           { return nil }
+
+func (s *memStmt) Close() error  { return nil }
+func (s *memStmt) NumInput() int { return -1 }
+
+func memKey(args []driver.Value) string { return fmt.Sprint(args[0], "/", args[1], "/", args[2]) }
+
+func (s *memStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(s.query, "CREATE"), strings.Contains(s.query, "SAVEPOINT"):
+		return memResult(0), nil
+	case strings.HasPrefix(s.query, "UPDATE"):
+		key := memKey(args[5:])
+		if row, ok := s.d.rows[key]; !ok || row[3] != args[8] {
+			return memResult(0), nil
+		}
+		s.d.rows[key] = args[:5]
+		return memResult(1), nil
+	case strings.HasPrefix(s.query, "INSERT"):
+		key := memKey(args)
+		if s.d.beforeInsert != nil {
+			s.d.beforeInsert(key)
+		}
+		if _, ok := s.d.rows[key]; ok {
+			return nil, fmt.Errorf("duplicate primary key %s", key)
+		}
+		s.d.rows[key] = args[3:]
+		return memResult(1), nil
+	case strings.HasPrefix(s.query, "DELETE"):
+		delete(s.d.rows, memKey(args))
+		return memResult(1), nil
+	}
+	return nil, fmt.Errorf("unsupported query %q", s.query)
+}
+
+func (s *memStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	row, ok := s.d.rows[memKey(args)]
+	if strings.HasPrefix(s.query, "SELECT version") {
+		if ok {
+			row = row[3:4]
+		}
+		return &memRows{cols: []string{"version"}, row: row, done: !ok}, nil
+	}
+	return &memRows{cols: []string{"update_time", "expire_time", "loop_index", "version", "misc_data"}, row: row, done: !ok}, nil
+}
+
+func (r memResult) LastInsertId() (int64, error) { return 0, nil }
+func (r memResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+func (r *memRows) Columns() []string { return r.cols }
+func (r *memRows) Close() error      { return nil }
+func (r *memRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	copy(dest, r.row)
+	r.done = true
+	return nil
+}
+
+var (
+	registerMem sync.Once
+	memDB       = &memDriver{rows: make(map[string][]driver.Value)}
+)
+
+func newMemDB(t *testing.T) *sql.DB {
+	registerMem.Do(func() {
+		sql.Register("cycledata-mem", memDB)
+	})
+	db, err := sql.Open("cycledata-mem", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func sampleData(userID cycledata.UserID) *cycledata.PlayerData {
+	return &cycledata.PlayerData{
+		UserID:     userID,
+		UpdateTime: time.Unix(1700000000, 123),
+		ExpireTime: 4102444800, // 2100-01-01
+		Loop:       3,
+		MiscData: map[string]interface{}{
+			"coins": int32(10),
+			"items": []int32{1, 2},
+			"bag":   map[int32]int32{5: 6},
+			"name":  "hero",
+		},
+	}
+}
+
+func testBackend(t *testing.T, b Backend) {
+	ctx := context.Background()
+	cycle, typeKey := cycledata.DailyCycle, cycledata.TypeKey(1)
+
+	if data, err := b.Load(ctx, cycle, typeKey, 1); err != nil || data != nil {
+		t.Fatalf("expected (nil, nil) for missing record, got %v, %v", data, err)
+	}
+
+	want := sampleData(1)
+	if err := b.BatchStore(ctx, cycle, typeKey, []*cycledata.PlayerData{want, sampleData(2)}); err != nil {
+		t.Fatalf("batch store: %v", err)
+	}
+	got, err := b.Load(ctx, cycle, typeKey, 1)
+	if err != nil || got == nil {
+		t.Fatalf("load: %v, %v", got, err)
+	}
+	if !got.UpdateTime.Equal(want.UpdateTime) || got.ExpireTime != want.ExpireTime || got.Loop != want.Loop {
+		t.Fatalf("unexpected header fields %+v", got)
+	}
+	if !reflect.DeepEqual(got.MiscData, want.MiscData) {
+		t.Fatalf("MiscData types not preserved: %#v", got.MiscData)
+	}
+
+	if got.Version != 1 {
+		t.Fatalf("expected version 1 after first write, got %d", got.Version)
+	}
+
+	// 旧版本号写入冲突，不覆盖
+	want.MiscData["coins"] = int32(20)
+	if err := b.Store(ctx, cycle, typeKey, want); !errors.Is(err, cycledata.ErrVersionConflict) {
+		t.Fatalf("expected ErrVersionConflict for stale version, got %v", err)
+	}
+
+	// 按当前版本号覆盖写入
+	want.Version = 1
+	if err := b.Store(ctx, cycle, typeKey, want); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	if got, _ := b.Load(ctx, cycle, typeKey, 1); got.MiscData["coins"] != int32(20) || got.Version != 2 {
+		t.Fatalf("expected overwritten coins at version 2, got %v", got)
+	}
+
+	// 批量写入中只有冲突的记录被跳过
+	fresh := sampleData(3)
+	err = b.BatchStore(ctx, cycle, typeKey, []*cycledata.PlayerData{sampleData(2), fresh})
+	var vce *cycledata.VersionConflictError
+	if !errors.As(err, &vce) || len(vce.UserIDs) != 1 || vce.UserIDs[0] != 2 {
+		t.Fatalf("expected conflict for uid 2 only, got %v", err)
+	}
+	if got, _ := b.Load(ctx, cycle, typeKey, 3); got == nil {
+		t.Fatal("non-conflicting record should be stored")
+	}
+
+	if err := b.Delete(ctx, cycle, typeKey, 2); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if got, _ := b.Load(ctx, cycle, typeKey, 2); got != nil {
+		t.Fatal("expected record deleted")
+	}
+	if err := b.Delete(ctx, cycle, typeKey, 2); err != nil {
+		t.Fatalf("deleting a missing record should succeed: %v", err)
+	}
+}
+
+func TestFileBackend(t *testing.T) {
+	testBackend(t, NewFileBackend(t.TempDir()))
+}
+
+func TestSQLBackend(t *testing.T) {
+	b := NewSQLBackend(newMemDB(t), "cycle_data")
+	if err := b.CreateTable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, b)
+
+	pg := NewSQLBackendWithPlaceholder(nil, "cycle_data", DollarPlaceholder)
+	if !strings.Contains(pg.updateSQL, "user_id = $8 AND version = $9") || !strings.Contains(pg.insertSQL, "$8)") {
+		t.Fatalf("unexpected placeholders: %s / %s", pg.updateSQL, pg.insertSQL)
+	}
+}
+
+func TestSQLConcurrentInsertConflict(t *testing.T) {
+	ctx := context.Background()
+	cycle, typeKey := cycledata.WeeklyCycle, cycledata.TypeKey(102)
+	b := NewSQLBackend(newMemDB(t), "cycle_data")
+
+	// 另一实例在查询版本号之后、INSERT 之前插入了 uid 1
+	memDB.mu.Lock()
+	memDB.beforeInsert = func(key string) {
+		if key == fmt.Sprint(string(cycle), "/", int64(typeKey), "/", int64(1)) {
+			memDB.rows[key] = []driver.Value{int64(0), int64(0), int64(0), int64(1), "{}"}
+		}
+	}
+	memDB.mu.Unlock()
+	defer func() {
+		memDB.mu.Lock()
+		memDB.beforeInsert = nil
+		memDB.mu.Unlock()
+	}()
+
+	err := b.BatchStore(ctx, cycle, typeKey, []*cycledata.PlayerData{sampleData(1), sampleData(2)})
+	var vce *cycledata.VersionConflictError
+	if !errors.As(err, &vce) || len(vce.UserIDs) != 1 || vce.UserIDs[0] != 1 {
+		t.Fatalf("expected conflict for uid 1 only, got %v", err)
+	}
+	if got, _ := b.Load(ctx, cycle, typeKey, 2); got == nil || got.Version != 1 {
+		t.Fatalf("the rest of the batch should be stored, got %v", got)
+	}
+}
+
+func TestUseBackend(t *testing.T) {
+	cycle, typeKey := cycledata.MonthlyCycle, cycledata.TypeKey(101)
+	b := NewFileBackend(t.TempDir())
+	UseBackend(cycle, typeKey, b)
+	cycledata.RegisterCreator(cycle, typeKey, func(uid cycledata.UserID) *cycledata.PlayerData {
+		return &cycledata.PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+
+	store := cycledata.New()
+	if _, err := store.GetDataErr(cycle, typeKey, 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetDataErr(cycle, typeKey, 7, map[string]interface{}{"items": []int32{9}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.FlushCtx(context.Background(), cycle, typeKey); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	// 新实例通过后端加载
+	data, err := cycledata.New().GetDataErr(cycle, typeKey, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items, ok := data.MiscData["items"].([]int32); !ok || len(items) != 1 || items[0] != 9 {
+		t.Fatalf("expected items loaded through backend, got %#v", data.MiscData)
+	}
+}
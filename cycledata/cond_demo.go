@@ -26,7 +26,7 @@ ok := AppendToInt32SliceIf(DailyCycle, 1, 12345, "someInt32Slice", 42, func(s []
 func GameInfo() {
 	// 注册加载器
 	now := time.Now()
-	timestamp := int32(now.Unix())
+	timestamp := now.Unix()
 	RegisterLoader(DailyCycle, TypeKey(1), func(cycle CycleType, typeKey TypeKey, userID UserID) *PlayerData {
 		// 模拟加载数据
 		return &PlayerData{
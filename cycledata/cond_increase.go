@@ -1,9 +1,5 @@
 package cycledata
 
-import (
-	"time"
-)
-
 /*
  * IncreaseIfCondInt 尝试增加 int 类型数值
  * 仅当 cond(current) 返回 true 时才执行增加操作
@@ -18,32 +14,19 @@ import (
  *
  * 返回值：
  *   - bool: 是否成功增加
+ *
+ * 已存储为其他数值类型（int32/int64/float64）的值会被无损转换后再累加并按原有类型写回，
+ * 需要区分失败原因时请使用 IncreaseIf（返回 error）
  */
 func IncreaseIfCondInt(cycle CycleType, typeKey TypeKey, userID UserID, key string, amount int, cond func(current int) bool) bool {
-	pd := GetData(cycle, typeKey, userID)
-	if pd == nil {
-		return false
-	}
-
-	pd.mu.Lock()
-	defer pd.mu.Unlock()
-
-	rawVal, ok := pd.MiscData[key]
-	oldVal := 0
-	if ok {
-		oldVal, ok = rawVal.(int)
-		if !ok {
-			return false
-		}
-	}
-
-	if !cond(oldVal) {
-		return false
-	}
+	return defaultStore.IncreaseIfCondInt(cycle, typeKey, userID, key, amount, cond)
+}
 
-	pd.MiscData[key] = oldVal + amount
-	pd.UpdateTime = time.Now()
-	return true
+/*
+ * IncreaseIfCondInt 在实例中尝试增加 int 类型数值
+ */
+func (s *Store) IncreaseIfCondInt(cycle CycleType, typeKey TypeKey, userID UserID, key string, amount int, cond func(current int) bool) bool {
+	return IncreaseIf(NewField[int](cycle, typeKey, key).In(s).keepStoredType(), userID, amount, cond) == nil
 }
 
 /*
@@ -53,30 +36,14 @@ func IncreaseIfCondInt(cycle CycleType, typeKey TypeKey, userID UserID, key stri
  * 参数和逻辑同 IncreaseIfCondInt
  */
 func IncreaseIfCondInt32(cycle CycleType, typeKey TypeKey, userID UserID, key string, amount int32, cond func(current int32) bool) bool {
-	pd := GetData(cycle, typeKey, userID)
-	if pd == nil {
-		return false
-	}
-
-	pd.mu.Lock()
-	defer pd.mu.Unlock()
-
-	rawVal, ok := pd.MiscData[key]
-	oldVal := int32(0)
-	if ok {
-		oldVal, ok = rawVal.(int32)
-		if !ok {
-			return false
-		}
-	}
-
-	if !cond(oldVal) {
-		return false
-	}
+	return defaultStore.IncreaseIfCondInt32(cycle, typeKey, userID, key, amount, cond)
+}
 
-	pd.MiscData[key] = oldVal + amount
-	pd.UpdateTime = time.Now()
-	return true
+/*
+ * IncreaseIfCondInt32 在实例中尝试增加 int32 类型数值
+ */
+func (s *Store) IncreaseIfCondInt32(cycle CycleType, typeKey TypeKey, userID UserID, key string, amount int32, cond func(current int32) bool) bool {
+	return IncreaseIf(NewField[int32](cycle, typeKey, key).In(s).keepStoredType(), userID, amount, cond) == nil
 }
 
 /*
@@ -86,30 +53,14 @@ func IncreaseIfCondInt32(cycle CycleType, typeKey TypeKey, userID UserID, key st
  * 参数和逻辑同 IncreaseIfCondInt
  */
 func IncreaseIfCondInt64(cycle CycleType, typeKey TypeKey, userID UserID, key string, amount int64, cond func(current int64) bool) bool {
-	pd := GetData(cycle, typeKey, userID)
-	if pd == nil {
-		return false
-	}
-
-	pd.mu.Lock()
-	defer pd.mu.Unlock()
-
-	rawVal, ok := pd.MiscData[key]
-	oldVal := int64(0)
-	if ok {
-		oldVal, ok = rawVal.(int64)
-		if !ok {
-			return false
-		}
-	}
-
-	if !cond(oldVal) {
-		return false
-	}
+	return defaultStore.IncreaseIfCondInt64(cycle, typeKey, userID, key, amount, cond)
+}
 
-	pd.MiscData[key] = oldVal + amount
-	pd.UpdateTime = time.Now()
-	return true
+/*
+ * IncreaseIfCondInt64 在实例中尝试增加 int64 类型数值
+ */
+func (s *Store) IncreaseIfCondInt64(cycle CycleType, typeKey TypeKey, userID UserID, key string, amount int64, cond func(current int64) bool) bool {
+	return IncreaseIf(NewField[int64](cycle, typeKey, key).In(s).keepStoredType(), userID, amount, cond) == nil
 }
 
 /*
@@ -119,28 +70,12 @@ func IncreaseIfCondInt64(cycle CycleType, typeKey TypeKey, userID UserID, key st
  * 参数和逻辑同 IncreaseIfCondInt
  */
 func IncreaseIfCondFloat64(cycle CycleType, typeKey TypeKey, userID UserID, key string, amount float64, cond func(current float64) bool) bool {
-	pd := GetData(cycle, typeKey, userID)
-	if pd == nil {
-		return false
-	}
-
-	pd.mu.Lock()
-	defer pd.mu.Unlock()
-
-	rawVal, ok := pd.MiscData[key]
-	oldVal := float64(0)
-	if ok {
-		oldVal, ok = rawVal.(float64)
-		if !ok {
-			return false
-		}
-	}
-
-	if !cond(oldVal) {
-		return false
-	}
+	return defaultStore.IncreaseIfCondFloat64(cycle, typeKey, userID, key, amount, cond)
+}
 
-	pd.MiscData[key] = oldVal + amount
-	pd.UpdateTime = time.Now()
-	return true
+/*
+ * IncreaseIfCondFloat64 在实例中尝试增加 float64 类型数值
+ */
+func (s *Store) IncreaseIfCondFloat64(cycle CycleType, typeKey TypeKey, userID UserID, key string, amount float64, cond func(current float64) bool) bool {
+	return IncreaseIf(NewField[float64](cycle, typeKey, key).In(s).keepStoredType(), userID, amount, cond) == nil
 }
@@ -1,9 +1,5 @@
 package cycledata
 
-import (
-	"time"
-)
-
 /*
  * SetInInt32MapIf 尝试向指定 map[int32]int32 类型的键值设置元素 key:val
  * 条件：
@@ -13,42 +9,28 @@ import (
  * 返回是否设置成功
  */
 func SetInInt32MapIf(cycle CycleType, typeKey TypeKey, userID UserID, mapKey string, key, val int32, cond func(map[int32]int32) bool) bool {
-	pd := GetData(cycle, typeKey, userID)
-	if pd == nil {
-		return false
-	}
-
-	pd.mu.Lock()
-	defer pd.mu.Unlock()
-
-	raw, ok := pd.MiscData[mapKey]
-	var m map[int32]int32
-
-	if ok {
-		m, ok = raw.(map[int32]int32)
-		if !ok {
-			// 字段存在，但不是map[int32]int32类型，直接返回false
-			return false
-		}
-	} else {
-		// 字段不存在，初始化一个空map
-		m = make(map[int32]int32)
-	}
+	return defaultStore.SetInInt32MapIf(cycle, typeKey, userID, mapKey, key, val, cond)
+}
 
-	if !cond(m) {
-		return false
-	}
+/*
+ * SetInInt32MapIf 在实例中尝试向指定 map[int32]int32 类型的键值设置元素 key:val
+ */
+func (s *Store) SetInInt32MapIf(cycle CycleType, typeKey TypeKey, userID UserID, mapKey string, key, val int32, cond func(map[int32]int32) bool) bool {
+	return s.SetInInt32MapIfErr(cycle, typeKey, userID, mapKey, key, val, cond) == nil
+}
 
-	// 检查key是否已存在
-	if _, exists := m[key]; exists {
-		return false
-	}
+/*
+ * SetInInt32MapIfErr 同 SetInInt32MapIf，失败时返回具体原因
+ */
+func SetInInt32MapIfErr(cycle CycleType, typeKey TypeKey, userID UserID, mapKey string, key, val int32, cond func(map[int32]int32) bool) error {
+	return defaultStore.SetInInt32MapIfErr(cycle, typeKey, userID, mapKey, key, val, cond)
+}
 
-	// 满足条件，设置值
-	m[key] = val
-	pd.MiscData[mapKey] = m
-	pd.UpdateTime = time.Now()
-	return true
+/*
+ * SetInInt32MapIfErr 同 Store.SetInInt32MapIf，失败时返回具体原因
+ */
+func (s *Store) SetInInt32MapIfErr(cycle CycleType, typeKey TypeKey, userID UserID, mapKey string, key, val int32, cond func(map[int32]int32) bool) error {
+	return s.SetWithCDInInt32MapIfErr(cycle, typeKey, userID, mapKey, key, val, 0, cond)
 }
 
 /*
@@ -61,49 +43,47 @@ func SetInInt32MapIf(cycle CycleType, typeKey TypeKey, userID UserID, mapKey str
  * 返回是否设置成功
  */
 func SetWithCDInInt32MapIf(cycle CycleType, typeKey TypeKey, userID UserID, mapKey string, key, val int32, lastUpdateLimitSec int, cond func(map[int32]int32) bool) bool {
-	pd := GetData(cycle, typeKey, userID)
-	if pd == nil {
-		return false
-	}
-
-	pd.mu.Lock()
-	defer pd.mu.Unlock()
-
-	raw, ok := pd.MiscData[mapKey]
-	var m map[int32]int32
-
-	if ok {
-		m, ok = raw.(map[int32]int32)
-		if !ok {
-			// 字段存在，但不是map[int32]int32类型，直接返回false
-			return false
-		}
-	} else {
-		// 字段不存在，初始化一个空map
-		m = make(map[int32]int32)
-	}
-
-	// 检查时间间隔
-	if lastUpdateLimitSec > 0 {
-		if time.Since(pd.UpdateTime) > time.Duration(lastUpdateLimitSec)*time.Second {
-			return false
-		}
-	}
-
-	if !cond(m) {
-		return false
-	}
-
-	// 检查key是否已存在
-	if _, exists := m[key]; exists {
-		return false
-	}
-
-	// 满足条件，设置值
-	m[key] = val
-	pd.MiscData[mapKey] = m
-	pd.UpdateTime = time.Now()
-	return true
+	return defaultStore.SetWithCDInInt32MapIf(cycle, typeKey, userID, mapKey, key, val, lastUpdateLimitSec, cond)
+}
+
+/*
+ * SetWithCDInInt32MapIf 在实例中尝试向指定 map[int32]int32 类型的键值设置元素 key:val
+ */
+func (s *Store) SetWithCDInInt32MapIf(cycle CycleType, typeKey TypeKey, userID UserID, mapKey string, key, val int32, lastUpdateLimitSec int, cond func(map[int32]int32) bool) bool {
+	return s.SetWithCDInInt32MapIfErr(cycle, typeKey, userID, mapKey, key, val, lastUpdateLimitSec, cond) == nil
+}
+
+/*
+ * SetWithCDInInt32MapIfErr 同 SetWithCDInInt32MapIf，失败时返回具体原因
+ *   - ErrTypeMismatch: 字段存在但不是 map[int32]int32
+ *   - ErrConditionFailed: CD 未满足或 cond 返回 false
+ *   - ErrKeyExists: key 已存在
+ */
+func SetWithCDInInt32MapIfErr(cycle CycleType, typeKey TypeKey, userID UserID, mapKey string, key, val int32, lastUpdateLimitSec int, cond func(map[int32]int32) bool) error {
+	return defaultStore.SetWithCDInInt32MapIfErr(cycle, typeKey, userID, mapKey, key, val, lastUpdateLimitSec, cond)
+}
+
+/*
+ * SetWithCDInInt32MapIfErr 同 Store.SetWithCDInInt32MapIf，失败时返回具体原因
+ */
+func (s *Store) SetWithCDInInt32MapIfErr(cycle CycleType, typeKey TypeKey, userID UserID, mapKey string, key, val int32, lastUpdateLimitSec int, cond func(map[int32]int32) bool) error {
+	return mutateField(NewField[map[int32]int32](cycle, typeKey, mapKey).In(s), userID,
+		func(pd *PlayerData, m map[int32]int32, _ bool) (map[int32]int32, error) {
+			if m == nil {
+				// 字段不存在，初始化一个空map
+				m = make(map[int32]int32)
+			}
+			if !withinCD(pd, lastUpdateLimitSec) || !cond(m) {
+				return m, ErrConditionFailed
+			}
+			// 检查key是否已存在
+			if _, exists := m[key]; exists {
+				return m, ErrKeyExists
+			}
+			// 满足条件，设置值
+			m[key] = val
+			return m, nil
+		})
 }
 
 /*
@@ -116,46 +96,45 @@ func SetWithCDInInt32MapIf(cycle CycleType, typeKey TypeKey, userID UserID, mapK
  * 返回是否删除成功
  */
 func RemoveWithCDFromInt32MapIf(cycle CycleType, typeKey TypeKey, userID UserID, mapKey string, key int32, lastUpdateLimitSec int, cond func(map[int32]int32) bool) bool {
-	pd := GetData(cycle, typeKey, userID)
-	if pd == nil {
-		return false
-	}
-
-	pd.mu.Lock()
-	defer pd.mu.Unlock()
-
-	raw, ok := pd.MiscData[mapKey]
-	if !ok {
-		return false
-	}
-
-	m, ok := raw.(map[int32]int32)
-	if !ok {
-		// 字段存在，但不是map[int32]int32类型，直接返回false
-		return false
-	}
-
-	// 检查时间间隔
-	if lastUpdateLimitSec > 0 {
-		if time.Since(pd.UpdateTime) > time.Duration(lastUpdateLimitSec)*time.Second {
-			return false
-		}
-	}
+	return defaultStore.RemoveWithCDFromInt32MapIf(cycle, typeKey, userID, mapKey, key, lastUpdateLimitSec, cond)
+}
 
-	if !cond(m) {
-		return false
-	}
+/*
+ * RemoveWithCDFromInt32MapIf 在实例中尝试从指定 map[int32]int32 类型的键值中删除元素 key
+ */
+func (s *Store) RemoveWithCDFromInt32MapIf(cycle CycleType, typeKey TypeKey, userID UserID, mapKey string, key int32, lastUpdateLimitSec int, cond func(map[int32]int32) bool) bool {
+	return s.RemoveWithCDFromInt32MapIfErr(cycle, typeKey, userID, mapKey, key, lastUpdateLimitSec, cond) == nil
+}
 
-	// 检查key是否存在
-	if _, exists := m[key]; !exists {
-		return false
-	}
+/*
+ * RemoveWithCDFromInt32MapIfErr 同 RemoveWithCDFromInt32MapIf，失败时返回具体原因
+ *   - ErrKeyNotFound: 字段或 key 不存在
+ *   - ErrConditionFailed: CD 未满足或 cond 返回 false
+ */
+func RemoveWithCDFromInt32MapIfErr(cycle CycleType, typeKey TypeKey, userID UserID, mapKey string, key int32, lastUpdateLimitSec int, cond func(map[int32]int32) bool) error {
+	return defaultStore.RemoveWithCDFromInt32MapIfErr(cycle, typeKey, userID, mapKey, key, lastUpdateLimitSec, cond)
+}
 
-	// 删除元素
-	delete(m, key)
-	pd.MiscData[mapKey] = m
-	pd.UpdateTime = time.Now()
-	return true
+/*
+ * RemoveWithCDFromInt32MapIfErr 同 Store.RemoveWithCDFromInt32MapIf，失败时返回具体原因
+ */
+func (s *Store) RemoveWithCDFromInt32MapIfErr(cycle CycleType, typeKey TypeKey, userID UserID, mapKey string, key int32, lastUpdateLimitSec int, cond func(map[int32]int32) bool) error {
+	return mutateField(NewField[map[int32]int32](cycle, typeKey, mapKey).In(s), userID,
+		func(pd *PlayerData, m map[int32]int32, exists bool) (map[int32]int32, error) {
+			if !exists {
+				return m, ErrKeyNotFound
+			}
+			if !withinCD(pd, lastUpdateLimitSec) || !cond(m) {
+				return m, ErrConditionFailed
+			}
+			// 检查key是否存在
+			if _, found := m[key]; !found {
+				return m, ErrKeyNotFound
+			}
+			// 删除元素
+			delete(m, key)
+			return m, nil
+		})
 }
 
 /*
@@ -167,37 +146,43 @@ func RemoveWithCDFromInt32MapIf(cycle CycleType, typeKey TypeKey, userID UserID,
  * 返回是否更新成功
  */
 func UpdateInInt32MapIf(cycle CycleType, typeKey TypeKey, userID UserID, mapKey string, key, val int32, cond func(map[int32]int32) bool) bool {
-	pd := GetData(cycle, typeKey, userID)
-	if pd == nil {
-		return false
-	}
-
-	pd.mu.Lock()
-	defer pd.mu.Unlock()
-
-	raw, ok := pd.MiscData[mapKey]
-	if !ok {
-		return false
-	}
-
-	m, ok := raw.(map[int32]int32)
-	if !ok {
-		// 字段存在，但不是map[int32]int32类型，直接返回false
-		return false
-	}
-
-	if !cond(m) {
-		return false
-	}
-
-	// 检查key是否存在
-	if _, exists := m[key]; !exists {
-		return false
-	}
-
-	// 满足条件，更新值
-	m[key] = val
-	pd.MiscData[mapKey] = m
-	pd.UpdateTime = time.Now()
-	return true
+	return defaultStore.UpdateInInt32MapIf(cycle, typeKey, userID, mapKey, key, val, cond)
+}
+
+/*
+ * UpdateInInt32MapIf 在实例中尝试更新指定 map[int32]int32 类型中已存在的键值 key:val
+ */
+func (s *Store) UpdateInInt32MapIf(cycle CycleType, typeKey TypeKey, userID UserID, mapKey string, key, val int32, cond func(map[int32]int32) bool) bool {
+	return s.UpdateInInt32MapIfErr(cycle, typeKey, userID, mapKey, key, val, cond) == nil
+}
+
+/*
+ * UpdateInInt32MapIfErr 同 UpdateInInt32MapIf，失败时返回具体原因
+ *   - ErrKeyNotFound: 字段或 key 不存在
+ *   - ErrConditionFailed: cond 返回 false
+ */
+func UpdateInInt32MapIfErr(cycle CycleType, typeKey TypeKey, userID UserID, mapKey string, key, val int32, cond func(map[int32]int32) bool) error {
+	return defaultStore.UpdateInInt32MapIfErr(cycle, typeKey, userID, mapKey, key, val, cond)
+}
+
+/*
+ * UpdateInInt32MapIfErr 同 Store.UpdateInInt32MapIf，失败时返回具体原因
+ */
+func (s *Store) UpdateInInt32MapIfErr(cycle CycleType, typeKey TypeKey, userID UserID, mapKey string, key, val int32, cond func(map[int32]int32) bool) error {
+	return mutateField(NewField[map[int32]int32](cycle, typeKey, mapKey).In(s), userID,
+		func(_ *PlayerData, m map[int32]int32, exists bool) (map[int32]int32, error) {
+			if !exists {
+				return m, ErrKeyNotFound
+			}
+			if !cond(m) {
+				return m, ErrConditionFailed
+			}
+			// 检查key是否存在
+			if _, found := m[key]; !found {
+				return m, ErrKeyNotFound
+			}
+			// 满足条件，更新值
+			m[key] = val
+			return m, nil
+		})
 }
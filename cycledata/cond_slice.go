@@ -13,134 +13,136 @@ import (
  * 返回是否添加成功
  */
 func AppendToInt32SliceIf(cycle CycleType, typeKey TypeKey, userID UserID, key string, val int32, cond func([]int32) bool) bool {
-	pd := GetData(cycle, typeKey, userID)
-	if pd == nil {
-		return false
-	}
-
-	pd.mu.Lock()
-	defer pd.mu.Unlock()
-
-	raw, ok := pd.MiscData[key]
-	var slice []int32
+	return defaultStore.AppendToInt32SliceIf(cycle, typeKey, userID, key, val, cond)
+}
 
-	if ok {
-		slice, ok = raw.([]int32)
-		if !ok {
-			// 字段存在，但不是[]int32类型，直接返回false
-			return false
-		}
-	} else {
-		// 字段不存在，初始化一个空切片
-		slice = []int32{}
-	}
+/*
+ * AppendToInt32SliceIf 在实例中尝试向指定 []int32 类型的键值添加元素 val
+ */
+func (s *Store) AppendToInt32SliceIf(cycle CycleType, typeKey TypeKey, userID UserID, key string, val int32, cond func([]int32) bool) bool {
+	return s.AppendToInt32SliceIfErr(cycle, typeKey, userID, key, val, cond) == nil
+}
 
-	if !cond(slice) {
-		return false
-	}
+/*
+ * AppendToInt32SliceIfErr 同 AppendToInt32SliceIf，失败时返回具体原因
+ */
+func AppendToInt32SliceIfErr(cycle CycleType, typeKey TypeKey, userID UserID, key string, val int32, cond func([]int32) bool) error {
+	return defaultStore.AppendToInt32SliceIfErr(cycle, typeKey, userID, key, val, cond)
+}
 
-	// 满足条件，追加值
-	slice = append(slice, val)
-	pd.MiscData[key] = slice
-	pd.UpdateTime = time.Now()
-	return true
+/*
+ * AppendToInt32SliceIfErr 同 Store.AppendToInt32SliceIf，失败时返回具体原因
+ */
+func (s *Store) AppendToInt32SliceIfErr(cycle CycleType, typeKey TypeKey, userID UserID, key string, val int32, cond func([]int32) bool) error {
+	return s.AppendWithCDToInt32SliceIfErr(cycle, typeKey, userID, key, val, 0, cond)
 }
 
 /*
  * AppendWithCDToInt32SliceIf 尝试向指定 []int32 类型的键值添加元素 val
  * 条件：
-  *  - lastUpdateLimitSec 与上次cd间隔限制
+ *   - lastUpdateLimitSec 与上次cd间隔限制
  *   - val 不存在于切片中
  *   - cond(slice) 返回 true
  * 添加成功后更新时间
  * 返回是否添加成功
-*/
+ */
 func AppendWithCDToInt32SliceIf(cycle CycleType, typeKey TypeKey, userID UserID, key string, val int32, lastUpdateLimitSec int, cond func([]int32) bool) bool {
-	pd := GetData(cycle, typeKey, userID)
-	if pd == nil {
-		return false
-	}
-
-	pd.mu.Lock()
-	defer pd.mu.Unlock()
+	return defaultStore.AppendWithCDToInt32SliceIf(cycle, typeKey, userID, key, val, lastUpdateLimitSec, cond)
+}
 
-	raw, ok := pd.MiscData[key]
-	var slice []int32
+/*
+ * AppendWithCDToInt32SliceIf 在实例中尝试向指定 []int32 类型的键值添加元素 val
+ */
+func (s *Store) AppendWithCDToInt32SliceIf(cycle CycleType, typeKey TypeKey, userID UserID, key string, val int32, lastUpdateLimitSec int, cond func([]int32) bool) bool {
+	return s.AppendWithCDToInt32SliceIfErr(cycle, typeKey, userID, key, val, lastUpdateLimitSec, cond) == nil
+}
 
-	if ok {
-		slice, ok = raw.([]int32)
-		if !ok {
-			// 字段存在，但不是[]int32类型，直接返回false
-			return false
-		}
-	} else {
-		// 字段不存在，初始化一个空切片
-		slice = []int32{}
-	}
-	// 检查时间间隔
-	if lastUpdateLimitSec > 0 {
-		if time.Since(pd.UpdateTime) > time.Duration(lastUpdateLimitSec)*time.Second {
-			return false
-		}
-	}
-	if !cond(slice) {
-		return false
-	}
+/*
+ * AppendWithCDToInt32SliceIfErr 同 AppendWithCDToInt32SliceIf，失败时返回具体原因
+ *   - ErrTypeMismatch: 字段存在但不是 []int32
+ *   - ErrConditionFailed: CD 未满足或 cond 返回 false
+ */
+func AppendWithCDToInt32SliceIfErr(cycle CycleType, typeKey TypeKey, userID UserID, key string, val int32, lastUpdateLimitSec int, cond func([]int32) bool) error {
+	return defaultStore.AppendWithCDToInt32SliceIfErr(cycle, typeKey, userID, key, val, lastUpdateLimitSec, cond)
+}
 
-	// 满足条件，追加值
-	slice = append(slice, val)
-	pd.MiscData[key] = slice
-	pd.UpdateTime = time.Now()
-	return true
+/*
+ * AppendWithCDToInt32SliceIfErr 同 Store.AppendWithCDToInt32SliceIf，失败时返回具体原因
+ */
+func (s *Store) AppendWithCDToInt32SliceIfErr(cycle CycleType, typeKey TypeKey, userID UserID, key string, val int32, lastUpdateLimitSec int, cond func([]int32) bool) error {
+	return mutateField(NewField[[]int32](cycle, typeKey, key).In(s), userID,
+		func(pd *PlayerData, slice []int32, _ bool) ([]int32, error) {
+			if slice == nil {
+				// 字段不存在，初始化一个空切片
+				slice = []int32{}
+			}
+			if !withinCD(pd, lastUpdateLimitSec) || !cond(slice) {
+				return slice, ErrConditionFailed
+			}
+			// 满足条件，追加值
+			return append(slice, val), nil
+		})
 }
 
 /*
  * RemoveWithCDFromInt32SliceIf 尝试从指定 []int32 类型的键值中删除元素 val
  * 条件：
-*  - lastUpdateLimitSec 与上次cd间隔限制
+ *   - lastUpdateLimitSec 与上次cd间隔限制
  *   - val 存在于切片中
  *   - cond(slice) 返回 true
  * 删除成功后更新时间
  * 返回是否删除成功
-*/
+ */
 func RemoveWithCDFromInt32SliceIf(cycle CycleType, typeKey TypeKey, userID UserID, key string, val int32, lastUpdateLimitSec int, cond func([]int32) bool) bool {
-	pd := GetData(cycle, typeKey, userID)
-	if pd == nil {
-		return false
-	}
+	return defaultStore.RemoveWithCDFromInt32SliceIf(cycle, typeKey, userID, key, val, lastUpdateLimitSec, cond)
+}
 
-	pd.mu.Lock()
-	defer pd.mu.Unlock()
+/*
+ * RemoveWithCDFromInt32SliceIf 在实例中尝试从指定 []int32 类型的键值中删除元素 val
+ */
+func (s *Store) RemoveWithCDFromInt32SliceIf(cycle CycleType, typeKey TypeKey, userID UserID, key string, val int32, lastUpdateLimitSec int, cond func([]int32) bool) bool {
+	return s.RemoveWithCDFromInt32SliceIfErr(cycle, typeKey, userID, key, val, lastUpdateLimitSec, cond) == nil
+}
 
-	raw, ok := pd.MiscData[key]
-	if !ok {
-		return false
-	}
+/*
+ * RemoveWithCDFromInt32SliceIfErr 同 RemoveWithCDFromInt32SliceIf，失败时返回具体原因
+ *   - ErrKeyNotFound: 字段不存在
+ *   - ErrConditionFailed: CD 未满足或 cond 返回 false
+ */
+func RemoveWithCDFromInt32SliceIfErr(cycle CycleType, typeKey TypeKey, userID UserID, key string, val int32, lastUpdateLimitSec int, cond func([]int32) bool) error {
+	return defaultStore.RemoveWithCDFromInt32SliceIfErr(cycle, typeKey, userID, key, val, lastUpdateLimitSec, cond)
+}
 
-	slice, ok := raw.([]int32)
-	if !ok {
-		// 字段存在，但不是[]int32类型，直接返回false
-		return false
-	}
-	// 检查时间间隔
-	if lastUpdateLimitSec > 0 {
-		if time.Since(pd.UpdateTime) > time.Duration(lastUpdateLimitSec)*time.Second {
-			return false
-		}
-	}
-	if !cond(slice) {
-		return false
-	}
+/*
+ * RemoveWithCDFromInt32SliceIfErr 同 Store.RemoveWithCDFromInt32SliceIf，失败时返回具体原因
+ */
+func (s *Store) RemoveWithCDFromInt32SliceIfErr(cycle CycleType, typeKey TypeKey, userID UserID, key string, val int32, lastUpdateLimitSec int, cond func([]int32) bool) error {
+	return mutateField(NewField[[]int32](cycle, typeKey, key).In(s), userID,
+		func(pd *PlayerData, slice []int32, exists bool) ([]int32, error) {
+			if !exists {
+				return slice, ErrKeyNotFound
+			}
+			if !withinCD(pd, lastUpdateLimitSec) || !cond(slice) {
+				return slice, ErrConditionFailed
+			}
+
+			// 删除元素
+			newSlice := make([]int32, 0, len(slice))
+			for _, v := range slice {
+				if v != val {
+					newSlice = append(newSlice, v)
+				}
+			}
+			return newSlice, nil
+		})
+}
 
-	// 删除元素
-	newSlice := make([]int32, 0, len(slice)-1)
-	for _, v := range slice {
-		if v != val {
-			newSlice = append(newSlice, v)
-		}
+/*
+ * withinCD 检查距上次更新是否仍在 lastUpdateLimitSec 秒内（<= 0 表示不限制）
+ */
+func withinCD(pd *PlayerData, lastUpdateLimitSec int) bool {
+	if lastUpdateLimitSec <= 0 {
+		return true
 	}
-
-	pd.MiscData[key] = newSlice
-	pd.UpdateTime = time.Now()
-	return true
+	return time.Since(pd.UpdateTime) <= time.Duration(lastUpdateLimitSec)*time.Second
 }
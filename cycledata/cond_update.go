@@ -1,9 +1,5 @@
 package cycledata
 
-import (
-	"time"
-)
-
 /*
  * UpdateIf 尝试根据条件更新指定周期、类型和玩家ID对应的数据
  * 仅当 cond 函数返回 true 时才执行更新
@@ -14,24 +10,35 @@ import (
  *   - bool 是否执行了更新
  */
 func UpdateIf(cycle CycleType, typeKey TypeKey, userID UserID, key string, newVal interface{}, cond func(oldVal, newVal interface{}) bool) bool {
-	pd := GetData(cycle, typeKey, userID)
-	if pd == nil {
-		return false
-	}
-
-	pd.mu.Lock()
-	defer pd.mu.Unlock()
+	return defaultStore.UpdateIf(cycle, typeKey, userID, key, newVal, cond)
+}
 
-	oldVal, ok := pd.MiscData[key]
-	if !ok {
-		oldVal = nil
-	}
+/*
+ * UpdateIf 在实例中尝试根据条件更新指定周期、类型和玩家ID对应的数据
+ */
+func (s *Store) UpdateIf(cycle CycleType, typeKey TypeKey, userID UserID, key string, newVal interface{}, cond func(oldVal, newVal interface{}) bool) bool {
+	return s.UpdateIfErr(cycle, typeKey, userID, key, newVal, cond) == nil
+}
 
-	if !cond(oldVal, newVal) {
-		return false
-	}
+/*
+ * UpdateIfErr 同 UpdateIf，失败时返回具体原因
+ *   - ErrNoData 系列: 数据不可用
+ *   - ErrConditionFailed: cond 返回 false
+ *   - ErrSchemaViolation: 不符合注册的 Schema
+ */
+func UpdateIfErr(cycle CycleType, typeKey TypeKey, userID UserID, key string, newVal interface{}, cond func(oldVal, newVal interface{}) bool) error {
+	return defaultStore.UpdateIfErr(cycle, typeKey, userID, key, newVal, cond)
+}
 
-	pd.MiscData[key] = newVal
-	pd.UpdateTime = time.Now()
-	return true
+/*
+ * UpdateIfErr 同 Store.UpdateIf，失败时返回具体原因
+ */
+func (s *Store) UpdateIfErr(cycle CycleType, typeKey TypeKey, userID UserID, key string, newVal interface{}, cond func(oldVal, newVal interface{}) bool) error {
+	return mutateField(NewField[interface{}](cycle, typeKey, key).In(s), userID,
+		func(_ *PlayerData, oldVal interface{}, _ bool) (interface{}, error) {
+			if !cond(oldVal, newVal) {
+				return oldVal, ErrConditionFailed
+			}
+			return newVal, nil
+		})
 }
@@ -1,9 +1,12 @@
 package cycledata
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
-	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -56,10 +59,33 @@ var (
 	/* 数据存储函数 */
 	stores = make(map[CycleType]map[TypeKey]func(cycle CycleType, typeKey TypeKey, data *PlayerData) error)
 
+	/* 批量数据存储函数 */
+	batchStores = make(map[CycleType]map[TypeKey]batchStorer)
+
 	/* 自定义过期处理函数 */
 	cleanExpireds = make(map[CycleType]map[TypeKey]func(cycle CycleType, typeKey TypeKey, data *PlayerData))
+
+	/* 存储失败死信处理函数（超过最大重试次数后调用） */
+	storeFailures = make(map[CycleType]map[TypeKey]func(cycle CycleType, typeKey TypeKey, data *PlayerData, err error))
+
+	/* 支持 context 的加载器、创建器、存储器、过期处理函数，优先于同名的旧版注册 */
+	loaderCtxs       = make(map[CycleType]map[TypeKey]func(ctx context.Context, cycle CycleType, typeKey TypeKey, userID UserID) (*PlayerData, error))
+	creatorCtxs      = make(map[CycleType]map[TypeKey]func(ctx context.Context, userID UserID) (*PlayerData, error))
+	storeCtxs        = make(map[CycleType]map[TypeKey]func(ctx context.Context, cycle CycleType, typeKey TypeKey, data *PlayerData) error)
+	cleanExpiredCtxs = make(map[CycleType]map[TypeKey]func(ctx context.Context, cycle CycleType, typeKey TypeKey, data *PlayerData))
 )
 
+// DefaultBatchSize 批量存储器未指定批大小时的默认值
+const DefaultBatchSize = 500
+
+/*
+ * batchStorer 批量存储函数及其批大小
+ */
+type batchStorer struct {
+	store func(ctx context.Context, cycle CycleType, typeKey TypeKey, batch []*PlayerData) error
+	size  int
+}
+
 func init() {
 	loaders = make(map[CycleType]map[TypeKey]func(CycleType, TypeKey, UserID) *PlayerData)
 	creators = make(map[CycleType]map[TypeKey]func(UserID) *PlayerData)
@@ -74,9 +100,24 @@ func init() {
 type PlayerData struct {
 	UserID     UserID
 	UpdateTime time.Time
-	ExpireTime int32
+	ExpireTime int64 // 过期时间（Unix 秒），0 表示永不过期
+	Loop       int64 // LoopTime 记录所属的循环序号，存储器需要一并持久化
+	Version    int64 // 存储中的版本号，由加载器填充，写入成功后加 1（见 cycledata_version.go）
 	MiscData   map[string]interface{}
 	mu         sync.RWMutex
+
+	dirty   bool          // 自上次持久化以来是否被修改
+	dirtyAt time.Time     // 首次变脏的时间
+	owner   *dirtyCounter // 所属集合的脏记录计数，不在集合中时为 nil
+
+	accessAt atomic.Int64  // 最近一次访问时间（UnixNano），用于淘汰
+	hits     atomic.Uint64 // 访问次数，用于 LFU 淘汰
+
+	wal    *walLog // 写入过的 WAL，持久化成功后通知其条目失效
+	walSeq uint64  // 最后一条 WAL 日志的序号
+
+	changes uint64     // markDirtyLocked 的调用次数，写入存储器期间被再次修改的记录据此保持为脏
+	storeMu sync.Mutex // 串行化同一记录的持久化，写入存储器期间不持有 mu
 }
 
 /*
@@ -87,6 +128,129 @@ func (pd *PlayerData) update(key string, value interface{}) {
 	defer pd.mu.Unlock()
 	pd.MiscData[key] = value
 	pd.UpdateTime = time.Now()
+	pd.markDirtyLocked()
+}
+
+/*
+ * MarkDirty 标记数据已修改，直接修改 MiscData 的调用方需要手动调用，
+ * 否则 Flush 会认为数据未变化而跳过持久化
+ */
+func (pd *PlayerData) MarkDirty() {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	pd.markDirtyLocked()
+}
+
+/*
+ * IsDirty 数据自上次持久化以来是否被修改
+ */
+func (pd *PlayerData) IsDirty() bool {
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+	return pd.dirty
+}
+
+/*
+ * markDirtyLocked 标记脏数据（调用方需持有 pd.mu 写锁）
+ */
+func (pd *PlayerData) markDirtyLocked() {
+	pd.changes++
+	if !pd.dirty {
+		pd.dirty = true
+		pd.dirtyAt = time.Now()
+		if pd.owner != nil {
+			pd.owner.add(pd.dirtyAt)
+		}
+	}
+}
+
+/*
+ * dirtySince 首次变脏的时间，未修改时返回 false
+ */
+func (pd *PlayerData) dirtySince() (time.Time, bool) {
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+	return pd.dirtyAt, pd.dirty
+}
+
+/*
+ * markCleanLocked 持久化成功后清除脏标记（调用方需持有 pd.mu 写锁）
+ */
+func (pd *PlayerData) markCleanLocked() {
+	if pd.dirty && pd.owner != nil {
+		pd.owner.count.Add(-1)
+	}
+	pd.dirty = false
+	pd.dirtyAt = time.Time{}
+	if pd.wal != nil {
+		pd.wal.ack(pd, pd.walSeq)
+	}
+}
+
+/*
+ * attachLocked 记录加入集合时登记到集合的脏记录计数（调用方需持有 pd.mu 写锁）
+ */
+func (pd *PlayerData) attachLocked(owner *dirtyCounter) {
+	pd.owner = owner
+	if pd.dirty {
+		owner.add(pd.dirtyAt)
+	}
+}
+
+/*
+ * detachLocked 记录移出集合时从脏记录计数中注销（调用方需持有 pd.mu 写锁）
+ */
+func (pd *PlayerData) detachLocked() {
+	if pd.dirty && pd.owner != nil {
+		pd.owner.count.Add(-1)
+	}
+	pd.owner = nil
+}
+
+/*
+ * dirtyCounter 集合内脏记录的计数，写回协程据此判断是否需要写回而不必逐条扫描
+ */
+type dirtyCounter struct {
+	count  atomic.Int64
+	oldest atomic.Int64 // 最早变脏的时间（UnixNano），只会偏早，登记时原子地调早，每次写回后重新计算；未知时为 0
+}
+
+/*
+ * add 登记一条脏记录
+ */
+func (c *dirtyCounter) add(dirtyAt time.Time) {
+	c.count.Add(1)
+	c.lower(dirtyAt.UnixNano())
+}
+
+/*
+ * lower 将最早变脏的时间原子地调早到 at（at 为 0 或不早于当前值时不变）
+ */
+func (c *dirtyCounter) lower(at int64) {
+	if at == 0 {
+		return
+	}
+	for {
+		cur := c.oldest.Load()
+		if cur != 0 && cur <= at {
+			return
+		}
+		if c.oldest.CompareAndSwap(cur, at) {
+			return
+		}
+	}
+}
+
+/*
+ * lag 最早一条脏记录已等待的时长，最早时间未知时从现在开始计时
+ */
+func (c *dirtyCounter) lag(now time.Time) time.Duration {
+	oldest := c.oldest.Load()
+	if oldest == 0 {
+		c.oldest.CompareAndSwap(0, now.UnixNano())
+		return 0
+	}
+	return now.Sub(time.Unix(0, oldest))
 }
 
 /*
@@ -94,8 +258,57 @@ func (pd *PlayerData) update(key string, value interface{}) {
  * 用于管理单个周期和类型下的所有玩家数据
  */
 type dataCollection struct {
-	mu   sync.RWMutex
-	data map[UserID]*PlayerData
+	mu      sync.RWMutex
+	data    map[UserID]*PlayerData
+	loading map[UserID]*loadCall // 正在加载的玩家，同一玩家的并发请求共享一次加载
+	retry   *retryQueue          // 写入失败记录的重试队列，为 nil 时只保留在内存中
+	h       *cycleHandler        // 所属处理器，合并冲突后据此写 WAL 和投递事件，为 nil 时跳过
+	dirty   dirtyCounter         // 常驻的脏记录数
+}
+
+/*
+ * putLocked 将记录放入集合（调用方需持有 dc.mu 写锁）
+ */
+func (dc *dataCollection) putLocked(data *PlayerData) {
+	data.mu.Lock()
+	data.attachLocked(&dc.dirty)
+	data.mu.Unlock()
+	dc.data[data.UserID] = data
+}
+
+/*
+ * dropLocked 将记录移出集合（调用方需持有 dc.mu 写锁）
+ */
+func (dc *dataCollection) dropLocked(data *PlayerData) {
+	delete(dc.data, data.UserID)
+	data.mu.Lock()
+	data.detachLocked()
+	data.mu.Unlock()
+}
+
+/*
+ * evictClean 移出 records 中仍在集合内且未被修改的记录
+ * 存储器在集合锁之外调用，写入期间被再次修改或已被替换的记录继续常驻
+ */
+func (dc *dataCollection) evictClean(records []*PlayerData) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	for _, data := range records {
+		if dc.data[data.UserID] == data && !data.IsDirty() {
+			dc.dropLocked(data)
+		}
+	}
+}
+
+/*
+ * loadCall 一次进行中的加载，done 关闭后 data / err 可读
+ * data 与 err 均为 nil 表示过期处理的占位，等待者需要重新获取
+ */
+type loadCall struct {
+	done chan struct{}
+	data *PlayerData
+	err  error
 }
 
 /*
@@ -103,7 +316,8 @@ type dataCollection struct {
  */
 func newCollection() *dataCollection {
 	return &dataCollection{
-		data: make(map[UserID]*PlayerData),
+		data:    make(map[UserID]*PlayerData),
+		loading: make(map[UserID]*loadCall),
 	}
 }
 
@@ -111,166 +325,360 @@ func newCollection() *dataCollection {
  * 获取玩家数据（不存在则尝试通过注册的加载器/创建器构建）
  */
 func (dc *dataCollection) get(cycle CycleType, typeKey TypeKey, userID UserID) *PlayerData {
+	data, _ := dc.getErr(cycle, typeKey, userID)
+	return data
+}
+
+/*
+ * 获取玩家数据，失败时返回具体原因
+ */
+func (dc *dataCollection) getErr(cycle CycleType, typeKey TypeKey, userID UserID) (*PlayerData, error) {
+	return dc.getCtx(context.Background(), cycle, typeKey, userID)
+}
+
+/*
+ * 获取玩家数据（支持 context），失败时返回具体原因
+ *   - ErrNoCreator: 未注册加载器和创建器
+ *   - ErrNilData: 加载器/创建器均返回 nil
+ *   - ErrLoadFailed: 加载器/创建器返回错误或 panic（可用 errors.Is 匹配到原始错误）
+ *   - ErrNewbieEnded: 玩家的新手期已结束
+ *   - ErrInactive: LimitTime 活动不在开放时间内
+ *   - ctx.Err(): 等待加载期间 ctx 结束
+ *
+ * 加载在集合锁之外进行：同一玩家的并发请求等待同一次加载并得到相同的结果，
+ * 其他玩家的读写不受慢加载影响；加载失败不会被缓存，下次请求重新加载。
+ * 加载使用首个请求的 ctx，其超时/取消产生的错误同样会传递给所有等待者。
+ *
+ * 常驻记录在访问时已过期（过期清理尚未执行或重启期间错过）时，先移出内存，
+ * 交给过期处理函数并写入存储器，再与未命中一样重新加载/创建，调用方不会拿到过期数据
+ */
+func (dc *dataCollection) getCtx(ctx context.Context, cycle CycleType, typeKey TypeKey, userID UserID) (*PlayerData, error) {
+	now := time.Now().Unix()
+
 	dc.mu.RLock()
-	if data, ok := dc.data[userID]; ok {
+	if data, ok := dc.data[userID]; ok && !isStale(cycle, typeKey, data, now) {
 		dc.mu.RUnlock()
-		return data
+		data.touch()
+		return data, nil
 	}
 	dc.mu.RUnlock()
 
 	dc.mu.Lock()
-	defer dc.mu.Unlock()
-
 	// 二次检查
-	if data, ok := dc.data[userID]; ok {
-		return data
+	stale, ok := dc.data[userID]
+	if ok && !isStale(cycle, typeKey, stale, now) {
+		dc.mu.Unlock()
+		stale.touch()
+		return stale, nil
 	}
-
-	// 加载器
-	if loader := getLoader(cycle, typeKey); loader != nil {
-		if loaded := loader(cycle, typeKey, userID); loaded != nil {
-			dc.data[userID] = loaded
-			return loaded
+	// 已有进行中的加载，等待其结果
+	if call, ok := dc.loading[userID]; ok {
+		dc.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if call.data == nil && call.err == nil {
+			return dc.getCtx(ctx, cycle, typeKey, userID)
 		}
+		if call.data != nil {
+			call.data.touch()
+		}
+		return call.data, call.err
+	}
+	if ok {
+		dc.dropLocked(stale)
 	}
+	call := &loadCall{done: make(chan struct{})}
+	dc.loading[userID] = call
+	dc.mu.Unlock()
 
-	// 创建器
-	if creator := getCreator(cycle, typeKey); creator != nil {
-		created := creator(userID)
-		if created != nil {
-			dc.data[userID] = created
-			return created
+	// 过期记录在重新加载前处理，并发请求等待本次加载
+	if stale != nil {
+		dc.expire(ctx, cycle, typeKey, []*PlayerData{stale})
+	}
+	data, err := load(ctx, cycle, typeKey, userID)
+
+	dc.mu.Lock()
+	if err == nil {
+		// 加载期间数据可能已被 set 写入，以集合中已有的为准
+		if existing, ok := dc.data[userID]; ok {
+			data = existing
+		} else {
+			dc.putLocked(data)
 		}
+		data.touch()
 	}
+	delete(dc.loading, userID)
+	dc.mu.Unlock()
 
-	return nil
+	call.data, call.err = data, err
+	close(call.done)
+	return data, err
 }
 
 /*
- * 设置玩家数据（使用注册创建器，并注入 MiscData）
+ * load 依次尝试加载器和创建器构造玩家数据（不持有任何集合锁）
  */
-func (dc *dataCollection) set(cycle CycleType, typeKey TypeKey, userID UserID, miscData map[string]interface{}) bool {
-	dc.mu.Lock()
-	defer dc.mu.Unlock()
+func load(ctx context.Context, cycle CycleType, typeKey TypeKey, userID UserID) (data *PlayerData, err error) {
+	loader := getLoaderCtx(cycle, typeKey)
+	creator := getCreatorCtx(cycle, typeKey)
+	if loader == nil && creator == nil {
+		return nil, ErrNoCreator
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, loadFailed(cycle, typeKey, userID, err)
+	}
 
-	// 如果已存在，则直接更新 MiscData
-	if existing, ok := dc.data[userID]; ok {
-		existing.MiscData = miscData
-		return true
+	defer func() {
+		if r := recover(); r != nil {
+			data, err = nil, fmt.Errorf("%w: uid %d, cycle %v, type %v: %v", ErrLoadFailed, userID, cycle, typeKey, r)
+		}
+	}()
+
+	now := time.Now()
+	if err := windowClosed(cycle, typeKey, userID, now); err != nil {
+		return nil, err
 	}
 
-	// 使用注册的创建器构造新的 PlayerData
-	if creator := getCreator(cycle, typeKey); creator != nil {
-		created := creator(userID)
+	// 加载器（已过期的记录视为不存在，由创建器构造新周期的记录）
+	if loader != nil {
+		loaded, err := loader(ctx, cycle, typeKey, userID)
+		if err != nil {
+			return nil, loadFailed(cycle, typeKey, userID, err)
+		}
+		if loaded != nil && !isStale(cycle, typeKey, loaded, now.Unix()) {
+			NormalizeMiscData(cycle, typeKey, loaded.MiscData)
+			fillExpireTime(cycle, typeKey, loaded, now)
+			return loaded, nil
+		}
+	}
+
+	// 创建器
+	if creator != nil {
+		created, err := creator(ctx, userID)
+		if err != nil {
+			return nil, loadFailed(cycle, typeKey, userID, err)
+		}
 		if created != nil {
-			created.MiscData = miscData
-			dc.data[userID] = created
-			return true
+			applySchemaDefaults(cycle, typeKey, created)
+			fillExpireTime(cycle, typeKey, created, now)
+			return created, nil
 		}
 	}
 
-	return false
+	return nil, ErrNilData
 }
 
 /*
- * 清理冷数据回收内存
+ * loadFailed 包装加载器/创建器返回的错误
  */
-func (dc *dataCollection) cleanCoolData(now int32, cycle CycleType, typeKey TypeKey) {
+func loadFailed(cycle CycleType, typeKey TypeKey, userID UserID, err error) error {
+	return fmt.Errorf("%w: uid %d, cycle %v, type %v: %w", ErrLoadFailed, userID, cycle, typeKey, err)
+}
+
+/*
+ * 设置玩家数据（使用注册创建器，并注入 MiscData）
+ * 修改在持有记录锁时写入 h 的 WAL，h 有订阅者时新旧 MiscData 的差异事件也在记录锁内入队，
+ * 返回的同步投递由调用方在释放锁后执行
+ */
+func (dc *dataCollection) set(h *cycleHandler, cycle CycleType, typeKey TypeKey, userID UserID, miscData map[string]interface{}) (pendingEvents, error) {
+	// 校验结果写入副本，调用方传入的 map 不会被修改，之后对它的修改也不会影响记录
+	miscData, err := validateMiscData(cycle, typeKey, miscData)
+	if err != nil {
+		return pendingEvents{}, err
+	}
+	watched := h.events.watched(cycle, typeKey)
+
 	dc.mu.Lock()
-	defer dc.mu.Unlock()
+	for {
+		// 如果已存在且未过期，则直接更新 MiscData；已过期的先按过期处理，再重新检查
+		if existing, ok := dc.data[userID]; ok {
+			if !isStale(cycle, typeKey, existing, time.Now().Unix()) {
+				existing.mu.Lock()
+				dc.mu.Unlock()
+				defer existing.mu.Unlock()
+				var events []Event
+				if watched {
+					events = diffEvents(cycle, typeKey, userID, OpSetData, cloneMiscData(existing.MiscData), miscData)
+				}
+				existing.MiscData = miscData
+				existing.markDirtyLocked()
+				h.logMutationLocked(cycle, typeKey, existing)
+				return h.events.publishLocked(events), nil
+			}
+			dc.dropLocked(existing)
+			dc.expireLocked(context.Background(), cycle, typeKey, []*PlayerData{existing})
+			continue
+		}
+		// 正在加载或过期处理中，等待完成后重新检查
+		if call, ok := dc.loading[userID]; ok {
+			dc.mu.Unlock()
+			<-call.done
+			dc.mu.Lock()
+			continue
+		}
+		break
+	}
 
-	// First check if there's a custom expiration handler for this cycle and type
-	handler := getStore(cycle, typeKey)
+	// 使用注册的创建器构造新的 PlayerData；与 getCtx 相同，创建在集合锁之外进行，
+	// 期间登记占位的加载，同一玩家的并发读取和写入等待创建完成后重新检查
+	creator := getCreatorCtx(cycle, typeKey)
+	if creator == nil {
+		dc.mu.Unlock()
+		return pendingEvents{}, ErrNoCreator
+	}
+	call := &loadCall{done: make(chan struct{})}
+	dc.loading[userID] = call
+	dc.mu.Unlock()
 
-	// If no handler exists and no data to process, return early
-	if handler == nil || len(dc.data) == 0 {
-		return
+	now := time.Now()
+	created, err := create(cycle, typeKey, userID, creator, now)
+
+	dc.mu.Lock()
+	delete(dc.loading, userID)
+	close(call.done)
+	if err != nil {
+		dc.mu.Unlock()
+		return pendingEvents{}, err
 	}
-	// 把 now(int32 秒) 转成 time.Time
-	nowTime := time.Unix(int64(now), 0)
-	// 定义阈值时间，例如 4 小时之前
-	threshold := nowTime.Add(-4 * time.Hour)
-	hotData := make(map[UserID]*PlayerData)
-	for uid, data := range dc.data {
-		data.mu.Lock()
-		lastUpdate := data.UpdateTime
-
-		if lastUpdate.Before(threshold) {
-			if err := handler(cycle, typeKey, data); err != nil {
-				log.Printf("Failed to store cold data for user %d: %v", uid, err)
-			}
-		} else {
-			hotData[uid] = data
+	var events []Event
+	if watched {
+		events = diffEvents(cycle, typeKey, userID, OpSetData, nil, miscData)
+	}
+	created.MiscData = miscData
+	fillExpireTime(cycle, typeKey, created, now)
+	created.markDirtyLocked()
+	dc.putLocked(created)
+
+	created.mu.Lock()
+	dc.mu.Unlock()
+	defer created.mu.Unlock()
+	h.logMutationLocked(cycle, typeKey, created)
+	return h.events.publishLocked(events), nil
+}
+
+/*
+ * create 调用创建器构造 set 写入的新记录（不持有任何集合锁），创建器 panic 时与 load 一样转换为 ErrLoadFailed
+ */
+func create(cycle CycleType, typeKey TypeKey, userID UserID,
+	creator func(context.Context, UserID) (*PlayerData, error), now time.Time) (created *PlayerData, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			created, err = nil, fmt.Errorf("%w: uid %d, cycle %v, type %v: %v", ErrLoadFailed, userID, cycle, typeKey, r)
 		}
-		data.mu.Unlock()
+	}()
+	if err := windowClosed(cycle, typeKey, userID, now); err != nil {
+		return nil, err
+	}
+	created, err = creator(context.Background(), userID)
+	if err != nil {
+		return nil, loadFailed(cycle, typeKey, userID, err)
+	}
+	if created == nil {
+		return nil, ErrNilData
 	}
-	dc.data = hotData
+	return created, nil
 }
 
 /*
  * 清理过期数据
+ * 过期数据先移出内存，再交给自定义过期处理函数并将脏数据写入存储器（不持有集合锁）
+ * 写入失败的过期数据不再对外可见，由重试队列持有直到写入成功或进入死信
  */
-func (dc *dataCollection) cleanExpired(now int32, cycle CycleType, typeKey TypeKey) {
+func (dc *dataCollection) cleanExpired(now int64, cycle CycleType, typeKey TypeKey) {
 	dc.mu.Lock()
 	defer dc.mu.Unlock()
 
-	handler := getCleanExpired(cycle, typeKey)
-	if handler == nil || len(dc.data) == 0 {
+	if len(dc.data) == 0 {
 		return
 	}
 
-	isAllExpired := true
-
-	for uid, data := range dc.data {
-		dataExpireTime := data.ExpireTime
-		if dataExpireTime == 0 {
-			// 永不过期，不能整体清空
-			isAllExpired = false
-			continue
-		}
-		if dataExpireTime <= now {
-			// if int64(dataExpireTime) <= int64(now) {
-			data.mu.Lock()
-			handler(cycle, typeKey, data)
-			data.mu.Unlock()
-			delete(dc.data, uid)
-			log.Printf("Deleted expired data for uid %d", uid)
-		} else {
-			isAllExpired = false
+	var expired []*PlayerData
+	for _, data := range dc.data {
+		// ExpireTime 为 0 表示永不过期
+		if isStale(cycle, typeKey, data, now) {
+			expired = append(expired, data)
 		}
 	}
 
-	if isAllExpired {
-		dc.data = make(map[UserID]*PlayerData)
+	for _, data := range expired {
+		dc.dropLocked(data)
+		log.Printf("Deleted expired data for uid %d", data.UserID)
 	}
+	dc.expireLocked(context.Background(), cycle, typeKey, expired)
 }
 
 /*
- * 将集合中所有数据刷入存储器
+ * expireLocked 释放集合锁后处理已移出集合的过期记录，返回前重新加锁（调用方需持有 dc.mu 写锁）
+ * 处理期间为这些玩家登记占位的加载，同一玩家的并发请求等待写入完成后重新加载，不会读到写入前的旧数据
  */
-// flushAll 将集合中的所有数据刷入存储器，并清空
-func (dc *dataCollection) flushAll(cycle CycleType, typeKey TypeKey) {
-	store := getStore(cycle, typeKey)
-	if store == nil {
+func (dc *dataCollection) expireLocked(ctx context.Context, cycle CycleType, typeKey TypeKey, expired []*PlayerData) {
+	if len(expired) == 0 {
 		return
 	}
+	placeholders := make(map[UserID]*loadCall, len(expired))
+	for _, data := range expired {
+		if _, ok := dc.loading[data.UserID]; ok {
+			continue
+		}
+		call := &loadCall{done: make(chan struct{})}
+		dc.loading[data.UserID] = call
+		placeholders[data.UserID] = call
+	}
+	dc.mu.Unlock()
 
-	dc.mu.Lock()
-	defer dc.mu.Unlock()
-
-	for uid, data := range dc.data {
-		data.mu.Lock()
+	dc.expire(ctx, cycle, typeKey, expired)
 
-		err := store(cycle, typeKey, data)
+	dc.mu.Lock()
+	for userID, call := range placeholders {
+		delete(dc.loading, userID)
+		close(call.done)
+	}
+}
 
-		if err != nil {
-			log.Printf("Failed to store data for uid %d, cycle %v, type %v, data %v: %v", uid, cycle, typeKey, data.MiscData, err)
+/*
+ * expire 过期记录先交给自定义过期处理函数，再将脏数据写入存储器，写入失败的进入重试队列
+ * 不负责移出内存，由调用方处理
+ */
+func (dc *dataCollection) expire(ctx context.Context, cycle CycleType, typeKey TypeKey, expired []*PlayerData) {
+	if len(expired) == 0 {
+		return
+	}
+	if handler := getCleanExpiredCtx(cycle, typeKey); handler != nil {
+		for _, data := range expired {
+			data.mu.Lock()
+			handler(ctx, cycle, typeKey, data)
+			data.mu.Unlock()
 		}
+	}
+
+	_, failed := persist(ctx, dc.h, cycle, typeKey, expired)
+	dc.retry.enqueue(cycle, typeKey, failed)
+}
 
-		data.mu.Unlock()
+/*
+ * 将集合中所有数据刷入存储器
+ */
+// flushAll 将集合中的脏数据刷入存储器，并清空（未修改的数据直接移出内存，写入失败的数据继续常驻并进入重试队列）
+// 写入时不持有集合锁，写入期间新加载或再次被修改的数据继续常驻
+// 有记录写入失败时返回 ErrStoreFailed（可用 errors.Is 匹配到存储器返回的错误或 ctx.Err()）
+func (dc *dataCollection) flushAll(ctx context.Context, cycle CycleType, typeKey TypeKey) error {
+	if !hasStorer(cycle, typeKey) {
+		return nil
 	}
 
-	dc.data = make(map[UserID]*PlayerData)
+	all := dc.residents()
+	_, failed := persist(ctx, dc.h, cycle, typeKey, all)
+	dc.evictClean(all)
+	dc.retry.enqueue(cycle, typeKey, failed)
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%w: %d records, cycle %v, type %v: %w", ErrStoreFailed, len(failed), cycle, typeKey, failed[0].err)
+	}
+	return nil
 }
 
 /*
@@ -280,13 +688,15 @@ func (dc *dataCollection) flushAll(cycle CycleType, typeKey TypeKey) {
 type cycleService struct {
 	mu            sync.RWMutex
 	collections   map[TypeKey]*dataCollection
-	defaultExpire int32
+	defaultExpire int64
+	retry         *retryQueue   // 由处理器注入，传递给新建的数据集合
+	h             *cycleHandler // 所属处理器，传递给新建的数据集合
 }
 
 /*
  * 创建周期服务实例
  */
-func newService(expire int32) *cycleService {
+func newService(expire int64) *cycleService {
 	return &cycleService{
 		collections:   make(map[TypeKey]*dataCollection),
 		defaultExpire: expire,
@@ -313,6 +723,8 @@ func (cs *cycleService) getCollection(typeKey TypeKey) *dataCollection {
 	}
 
 	col = newCollection()
+	col.retry = cs.retry
+	col.h = cs.h
 	cs.collections[typeKey] = col
 	return col
 }
@@ -321,24 +733,36 @@ func (cs *cycleService) getCollection(typeKey TypeKey) *dataCollection {
  * 刷新指定 typeKey 的数据
  */
 func (cs *cycleService) flush(typeKey TypeKey, cycle CycleType) {
+	_ = cs.flushCtx(context.Background(), typeKey, cycle)
+}
+
+/*
+ * 刷新指定 typeKey 的数据（支持 context）
+ */
+func (cs *cycleService) flushCtx(ctx context.Context, typeKey TypeKey, cycle CycleType) error {
 	cs.mu.RLock()
 	col, ok := cs.collections[typeKey]
 	cs.mu.RUnlock()
 	if ok {
-		col.flushAll(cycle, typeKey)
+		return col.flushAll(ctx, cycle, typeKey)
 	}
+	return nil
 }
 
 /*
  * 刷新所有类型的数据
  */
-func (cs *cycleService) flushAll(cycle CycleType) {
+func (cs *cycleService) flushAll(ctx context.Context, cycle CycleType) error {
 	cs.mu.RLock()
 	defer cs.mu.RUnlock()
 
+	var errs []error
 	for typeKey, col := range cs.collections {
-		col.flushAll(cycle, typeKey)
+		if err := col.flushAll(ctx, cycle, typeKey); err != nil {
+			errs = append(errs, err)
+		}
 	}
+	return errors.Join(errs...)
 }
 
 /*
@@ -348,6 +772,13 @@ func (cs *cycleService) flushAll(cycle CycleType) {
 type cycleHandler struct {
 	mu       sync.RWMutex
 	services map[CycleType]*cycleService
+
+	writeBehind writeBehindSet         // 后台写回协程
+	eviction    evictionScheduler      // 冷数据淘汰调度器
+	retry       *retryQueue            // 存储失败重试队列
+	wal         atomic.Pointer[walLog] // 预写日志，未开启时为 nil
+	events      eventBus               // 修改事件订阅
+	autoStart   func()                 // 首次创建周期服务时调用一次，默认实例借此延迟启动后台任务
 }
 
 /*
@@ -356,43 +787,12 @@ type cycleHandler struct {
 func newCycleHandler() *cycleHandler {
 	h := &cycleHandler{
 		services: make(map[CycleType]*cycleService),
+		retry:    &retryQueue{items: make(map[RecordKey]*retryItem)},
 	}
-	h.initPeriodicTasks()
+	h.retry.h = h
 	return h
 }
 
-/*
- * 启动定期冷数据清理任务
- */
-func (h *cycleHandler) initPeriodicTasks() {
-	go h.startCleanupRoutine()
-}
-
-/*
- * 每小时清理一次过期数据
- * 通过定时器触发，遍历所有周期类型，执行对应的过期数据清理操作
- * 过程先复制周期列表，避免长时间持锁，提升并发性能和安全性
- */
-func (h *cycleHandler) startCleanupRoutine() {
-	randMinutes := rand.Intn(40) + 10 // 10~50分钟
-	ticker := time.NewTicker(time.Duration(randMinutes) * time.Minute)
-	for range ticker.C {
-		// 读取锁保护访问 services map
-		h.mu.RLock()
-		// 复制所有周期类型的切片，避免持锁时间过长
-		cycles := make([]CycleType, 0, len(h.services))
-		for cycle := range h.services {
-			cycles = append(cycles, cycle)
-		}
-		h.mu.RUnlock()
-
-		// 解锁后逐个清理对应周期的冷数据，避免持锁时间过长阻塞其他操作
-		for _, cycle := range cycles {
-			h.cleanCoolData(cycle)
-		}
-	}
-}
-
 /*
  * cleanExpiredDataByType 根据传入的周期 CycleType 和类型 TypeKey，清理对应数据集合中的过期数据
  *
@@ -422,7 +822,7 @@ func (h *cycleHandler) cleanExpiredDataByType(cycle CycleType, typeKey TypeKey)
 
 	// 获取当前时间戳并清理过期数据
 	now := time.Now()
-	timestamp := int32(now.Unix())
+	timestamp := now.Unix()
 	col.cleanExpired(timestamp, cycle, typeKey)
 }
 
@@ -430,20 +830,33 @@ func (h *cycleHandler) cleanExpiredDataByType(cycle CycleType, typeKey TypeKey)
  * CleanExpiredDataByType 公开方法，清理指定周期和类型的过期数据
  */
 func CleanExpiredDataByType(cycle CycleType, typeKey TypeKey) {
-	globalHandler.cleanExpiredDataByType(cycle, typeKey)
+	defaultStore.CleanExpiredDataByType(cycle, typeKey)
 }
 
 /*
- * cleanExpiredData 根据传入的周期 CycleType，清理对应周期服务中的过期数据
+ * CleanExpiredDataByType 清理指定周期和类型的过期数据
+ */
+func (s *Store) CleanExpiredDataByType(cycle CycleType, typeKey TypeKey) {
+	s.h.cleanExpiredDataByType(cycle, typeKey)
+}
+
+/*
+ * cleanExpiredData 根据传入的周期 CycleType，以当前时间清理对应周期服务中的过期数据
+ */
+func (h *cycleHandler) cleanExpiredData(cycle CycleType) {
+	h.cleanExpiredAt(cycle, time.Now().Unix())
+}
+
+/*
+ * cleanExpiredAt 以指定时间戳为基准清理对应周期服务中的过期数据
  *
  * 1. 先对 cycleHandler 的服务 map 加读锁，获取对应周期的 service 指针
  * 2. 解锁，避免长时间持锁影响并发
  * 3. 如果对应周期的 service 不存在，直接返回
- * 4. 获取当前时间，作为过期判断依据
- * 5. 对 service 内部的 collections 加读锁，遍历所有 TypeKey 对应的数据集合
- * 6. 调用各集合的 cleanExpired 方法，执行具体的过期清理逻辑
+ * 4. 对 service 内部的 collections 加读锁，复制所有 TypeKey 对应的数据集合
+ * 5. 解锁后调用各集合的 cleanExpired 方法，执行具体的过期清理逻辑
  */
-func (h *cycleHandler) cleanExpiredData(cycle CycleType) {
+func (h *cycleHandler) cleanExpiredAt(cycle CycleType, timestamp int64) {
 	// 加读锁读取指定周期的 service
 	h.mu.RLock()
 	service, ok := h.services[cycle]
@@ -454,67 +867,68 @@ func (h *cycleHandler) cleanExpiredData(cycle CycleType) {
 		return
 	}
 
-	now := time.Now()
-	timestamp := int32(now.Unix())
-
-	// 加读锁访问 service 内部 collections
+	// 加读锁复制 service 内部 collections，清理时不持有服务锁（存储器可能较慢）
 	service.mu.RLock()
-	defer service.mu.RUnlock()
+	cols := make(map[TypeKey]*dataCollection, len(service.collections))
+	for typeKey, col := range service.collections {
+		cols[typeKey] = col
+	}
+	service.mu.RUnlock()
 
 	// 遍历所有 TypeKey 对应的数据集合，执行过期清理
-	for typeKey, col := range service.collections {
+	for typeKey, col := range cols {
 		col.cleanExpired(timestamp, cycle, typeKey)
 	}
 }
 
 /*
-* cleanCoolData 根据传入的周期 CycleType，清理对应周期服务中的过期数据
-*
-* 1. 先对 cycleHandler 的服务 map 加读锁，获取对应周期的 service 指针
-* 2. 解锁，避免长时间持锁影响并发
-* 3. 如果对应周期的 service 不存在，直接返回
-* 4. 获取当前时间，作为过期判断依据
-* 5. 对 service 内部的 collections 加读锁，遍历所有 TypeKey 对应的数据集合
-* 6. 调用各集合的 cleanExpired 方法，执行具体的过期清理逻辑
+ * 查找已存在的数据集合（不自动创建），不存在返回 nil
  */
-func (h *cycleHandler) cleanCoolData(cycle CycleType) {
-	// 加读锁读取指定周期的 service
+func (h *cycleHandler) findCollection(cycle CycleType, typeKey TypeKey) *dataCollection {
 	h.mu.RLock()
 	service, ok := h.services[cycle]
 	h.mu.RUnlock()
 
 	if !ok || service == nil {
-		// 没有对应周期的服务则不做任何处理
-		return
+		return nil
 	}
 
-	now := time.Now()
-	timestamp := int32(now.Unix())
-
-	// 先获取所有的 typeKey 列表
 	service.mu.RLock()
-	var keys []TypeKey
-	for key := range service.collections {
-		keys = append(keys, key)
+	defer service.mu.RUnlock()
+	return service.collections[typeKey]
+}
+
+/*
+ * tryPeek 非阻塞地查找已常驻内存的记录
+ * 任一层锁被占用、记录不在内存中或已过期时返回 false，供持有记录锁的事务使用以避免死锁
+ */
+func (h *cycleHandler) tryPeek(cycle CycleType, typeKey TypeKey, userID UserID) (*PlayerData, bool) {
+	if !h.mu.TryRLock() {
+		return nil, false
+	}
+	service, ok := h.services[cycle]
+	h.mu.RUnlock()
+	if !ok || service == nil || !service.mu.TryRLock() {
+		return nil, false
 	}
+	col, ok := service.collections[typeKey]
 	service.mu.RUnlock()
-
-	// 遍历所有 TypeKey 执行清理（避免在锁内清理影响并发）
-	for _, typeKey := range keys {
-		service.mu.RLock()
-		col, ok := service.collections[typeKey]
-		service.mu.RUnlock()
-
-		if ok && col != nil {
-			col.cleanCoolData(timestamp, cycle, typeKey)
-		}
+	if !ok || col == nil || !col.mu.TryRLock() {
+		return nil, false
+	}
+	data, ok := col.data[userID]
+	col.mu.RUnlock()
+	// 已过期的记录需要经 getCtx 处理后重新加载
+	if ok && isStale(cycle, typeKey, data, time.Now().Unix()) {
+		return nil, false
 	}
+	return data, ok
 }
 
 /*
  * 获取指定周期服务（自动初始化）
  */
-func (h *cycleHandler) getService(cycle CycleType, expire int32) *cycleService {
+func (h *cycleHandler) getService(cycle CycleType, expire int64) *cycleService {
 	h.mu.RLock()
 	s, exists := h.services[cycle]
 	h.mu.RUnlock()
@@ -524,41 +938,105 @@ func (h *cycleHandler) getService(cycle CycleType, expire int32) *cycleService {
 	}
 
 	h.mu.Lock()
-	defer h.mu.Unlock()
-
 	if s, exists = h.services[cycle]; exists {
+		h.mu.Unlock()
 		return s
 	}
-
 	s = newService(expire)
+	s.retry = h.retry
+	s.h = h
 	h.services[cycle] = s
+	start := h.autoStart
+	h.autoStart = nil
+	h.mu.Unlock()
+
+	if start != nil {
+		start()
+	}
 	return s
 }
 
+/*
+ * cancelAutoStart 显式调用 Start / Stop 后不再自动启动
+ */
+func (h *cycleHandler) cancelAutoStart() {
+	h.mu.Lock()
+	h.autoStart = nil
+	h.mu.Unlock()
+}
+
 /*
  * 刷新指定周期和类型的所有玩家数据
  */
 func Flush(cycle CycleType, typeKey TypeKey) {
-	globalHandler.getService(cycle, DefaultExpireFor(cycle, typeKey)).
-		flush(typeKey, cycle)
+	defaultStore.Flush(cycle, typeKey)
+}
+
+/*
+ * FlushCtx 同 Flush，ctx 传递给存储器；有记录写入失败时返回 ErrStoreFailed
+ */
+func FlushCtx(ctx context.Context, cycle CycleType, typeKey TypeKey) error {
+	return defaultStore.FlushCtx(ctx, cycle, typeKey)
+}
+
+/*
+ * Flush 刷新指定周期和类型的所有玩家数据
+ */
+func (s *Store) Flush(cycle CycleType, typeKey TypeKey) {
+	_ = s.FlushCtx(context.Background(), cycle, typeKey)
+}
+
+/*
+ * FlushCtx 刷新实例中指定周期和类型的所有玩家数据
+ */
+func (s *Store) FlushCtx(ctx context.Context, cycle CycleType, typeKey TypeKey) error {
+	return s.h.getService(cycle, DefaultExpireFor(cycle, typeKey)).
+		flushCtx(ctx, typeKey, cycle)
 }
 
 /*
  * 刷新所有周期、类型、用户数据
  */
 func FlushAll() {
-	globalHandler.mu.RLock()
-	defer globalHandler.mu.RUnlock()
+	defaultStore.FlushAll()
+}
 
-	for cycle, service := range globalHandler.services {
-		service.flushAll(cycle)
-	}
+/*
+ * FlushAllCtx 同 FlushAll，ctx 传递给存储器；返回所有集合的写入错误
+ */
+func FlushAllCtx(ctx context.Context) error {
+	return defaultStore.FlushAllCtx(ctx)
+}
+
+/*
+ * FlushAll 刷新所有周期、类型、用户数据
+ */
+func (s *Store) FlushAll() {
+	_ = s.FlushAllCtx(context.Background())
+}
+
+/*
+ * FlushAllCtx 刷新实例中所有周期、类型、用户数据
+ */
+func (s *Store) FlushAllCtx(ctx context.Context) error {
+	return s.h.flushAll(ctx)
 }
 
 /*
- * 全局周期处理器实例
+ * flushAll 刷新处理器中的全部集合
  */
-var globalHandler = newCycleHandler()
+func (h *cycleHandler) flushAll(ctx context.Context) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var errs []error
+	for cycle, service := range h.services {
+		if err := service.flushAll(ctx, cycle); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
 
 /*
  * 获取指定加载器
@@ -593,6 +1071,95 @@ func getStore(cycle CycleType, typeKey TypeKey) func(CycleType, TypeKey, *Player
 	return nil
 }
 
+/*
+ * 获取支持 context 的加载器，未注册 RegisterLoaderCtx 时适配 RegisterLoader 注册的加载器
+ */
+func getLoaderCtx(cycle CycleType, typeKey TypeKey) func(context.Context, CycleType, TypeKey, UserID) (*PlayerData, error) {
+	if m, ok := loaderCtxs[cycle]; ok {
+		if loader, ok := m[typeKey]; ok && loader != nil {
+			return loader
+		}
+	}
+	if loader := getLoader(cycle, typeKey); loader != nil {
+		return func(_ context.Context, cycle CycleType, typeKey TypeKey, userID UserID) (*PlayerData, error) {
+			return loader(cycle, typeKey, userID), nil
+		}
+	}
+	return nil
+}
+
+/*
+ * 获取支持 context 的创建器，未注册 RegisterCreatorCtx 时适配 RegisterCreator 注册的创建器
+ */
+func getCreatorCtx(cycle CycleType, typeKey TypeKey) func(context.Context, UserID) (*PlayerData, error) {
+	if m, ok := creatorCtxs[cycle]; ok {
+		if creator, ok := m[typeKey]; ok && creator != nil {
+			return creator
+		}
+	}
+	if creator := getCreator(cycle, typeKey); creator != nil {
+		return func(_ context.Context, userID UserID) (*PlayerData, error) {
+			return creator(userID), nil
+		}
+	}
+	return nil
+}
+
+/*
+ * 获取支持 context 的单条存储器，未注册 RegisterStorerCtx 时适配 RegisterStorer 注册的存储器
+ */
+func getStoreCtx(cycle CycleType, typeKey TypeKey) func(context.Context, CycleType, TypeKey, *PlayerData) error {
+	if m, ok := storeCtxs[cycle]; ok {
+		if store, ok := m[typeKey]; ok && store != nil {
+			return store
+		}
+	}
+	if store := getStore(cycle, typeKey); store != nil {
+		return func(_ context.Context, cycle CycleType, typeKey TypeKey, data *PlayerData) error {
+			return store(cycle, typeKey, data)
+		}
+	}
+	return nil
+}
+
+/*
+ * 获取批量存储器
+ * 优先使用 RegisterBatchStorer(Ctx) 注册的批量函数，否则把单条存储器适配为批大小为 1 的批量函数
+ */
+func getBatchStore(cycle CycleType, typeKey TypeKey) batchStorer {
+	if m, ok := batchStores[cycle]; ok {
+		if storer, ok := m[typeKey]; ok && storer.store != nil {
+			return storer
+		}
+	}
+	if store := getStoreCtx(cycle, typeKey); store != nil {
+		return batchStorer{
+			store: func(ctx context.Context, cycle CycleType, typeKey TypeKey, batch []*PlayerData) error {
+				return store(ctx, cycle, typeKey, batch[0])
+			},
+			size: 1,
+		}
+	}
+	return batchStorer{}
+}
+
+/*
+ * 是否注册了任意一种存储器
+ */
+func hasStorer(cycle CycleType, typeKey TypeKey) bool {
+	return getBatchStore(cycle, typeKey).store != nil
+}
+
+/*
+ * 获取存储失败死信处理函数
+ */
+func getStoreFailure(cycle CycleType, typeKey TypeKey) func(cycle CycleType, typeKey TypeKey, data *PlayerData, err error) {
+	if m, ok := storeFailures[cycle]; ok {
+		return m[typeKey]
+	}
+	return nil
+}
+
 /*
  * 获取指定过期处理函数
  */
@@ -602,3 +1169,20 @@ func getCleanExpired(cycle CycleType, typeKey TypeKey) func(cycle CycleType, typ
 	}
 	return nil
 }
+
+/*
+ * 获取支持 context 的过期处理函数，未注册 RegisterCleanExpiredCtx 时适配 RegisterCleanExpired 注册的函数
+ */
+func getCleanExpiredCtx(cycle CycleType, typeKey TypeKey) func(context.Context, CycleType, TypeKey, *PlayerData) {
+	if m, ok := cleanExpiredCtxs[cycle]; ok {
+		if handler, ok := m[typeKey]; ok && handler != nil {
+			return handler
+		}
+	}
+	if handler := getCleanExpired(cycle, typeKey); handler != nil {
+		return func(_ context.Context, cycle CycleType, typeKey TypeKey, data *PlayerData) {
+			handler(cycle, typeKey, data)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+/*
+ * LimitTime 活动日历
+ *
+ * 模块用途：
+ *   按 TypeKey 注册限时活动的开放时间窗口（开始、结束、可选的重复周期）：
+ *   - 窗口之外 GetDataErr 等返回 ErrInactive，不会加载/创建数据
+ *   - 记录创建/加载时 ExpireTime 自动填充为本轮窗口的结束时间（加载器设置的更晚时间截断为窗口结束），
+ *     到达结束时间时所有已启动的 Store 自动执行过期清理（过期处理函数 -> 存储器 -> 移出内存）
+ *   - RegisterActivityHook 注册的函数在活动开启/关闭时调用（关闭时先调用，再清理数据）
+ *
+ *   时间按秒取整；Repeat 为 0 表示只开放一次，否则每隔 Repeat 重复一轮（End - Start 不应超过 Repeat）。
+ *   未注册活动窗口的 LimitTime 类型不受限制。
+ *
+ * 示例：
+ *   RegisterActivity(TypeKey(1), ActivityWindow{
+ *       Start:  time.Date(2025, 1, 6, 10, 0, 0, 0, time.Local),
+ *       End:    time.Date(2025, 1, 6, 22, 0, 0, 0, time.Local),
+ *       Repeat: 7 * 24 * time.Hour, // 每周一
+ *   })
+ *   RegisterActivityHook(TypeKey(1), func(typeKey TypeKey, open bool, start, end time.Time) {
+ *       if !open { settleRank(typeKey) }
+ *   })
+ */
+package cycledata
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+ * ActivityWindow 活动开放时间窗口
+ */
+type ActivityWindow struct {
+	Start  time.Time     // 首轮开始时间
+	End    time.Time     // 首轮结束时间（不含）
+	Repeat time.Duration // 重复周期，0 表示不重复
+}
+
+/*
+ * ActivityHook 活动开启（open 为 true）/关闭时的回调，start / end 为本轮窗口
+ */
+type ActivityHook func(typeKey TypeKey, open bool, start, end time.Time)
+
+/*
+ * activity 单个 TypeKey 的活动规则
+ */
+type activity struct {
+	window ActivityWindow
+	timer  *time.Timer
+}
+
+var (
+	// activities 类型 -> 活动规则
+	activities = make(map[TypeKey]*activity)
+
+	// activityHooks 类型 -> 开启/关闭回调
+	activityHooks = make(map[TypeKey]ActivityHook)
+
+	// activityMu 保护 activities / activityHooks 的并发访问
+	activityMu sync.Mutex
+)
+
+/*
+ * RegisterActivity 注册 LimitTime 类型的活动窗口，重复注册会替换旧规则
+ */
+func RegisterActivity(typeKey TypeKey, window ActivityWindow) {
+	window.Start = window.Start.Truncate(time.Second)
+	window.End = window.End.Truncate(time.Second)
+	if window.Repeat > 0 && window.Repeat < time.Second {
+		window.Repeat = time.Second
+	}
+	window.Repeat = window.Repeat.Truncate(time.Second)
+	act := &activity{window: window}
+
+	activityMu.Lock()
+	defer activityMu.Unlock()
+
+	if old, ok := activities[typeKey]; ok && old.timer != nil {
+		old.timer.Stop()
+	}
+	activities[typeKey] = act
+	scheduleActivityLocked(typeKey, act, time.Now())
+}
+
+/*
+ * RegisterActivityHook 注册活动开启/关闭时的回调
+ */
+func RegisterActivityHook(typeKey TypeKey, hook ActivityHook) {
+	activityMu.Lock()
+	defer activityMu.Unlock()
+	activityHooks[typeKey] = hook
+}
+
+/*
+ * ActivityAt 获取 now 所在（或下一轮）的窗口，active 表示 now 是否在窗口内；
+ * 活动已全部结束时返回最后一轮窗口，未注册时 ok 为 false
+ */
+func ActivityAt(typeKey TypeKey, now time.Time) (start, end time.Time, active, ok bool) {
+	activityMu.Lock()
+	act, ok := activities[typeKey]
+	activityMu.Unlock()
+	if !ok {
+		return time.Time{}, time.Time{}, false, false
+	}
+	start, end = act.window.at(now)
+	return start, end, !now.Before(start) && now.Before(end), true
+}
+
+/*
+ * at 计算 now 所在的窗口；now 已过本轮结束时间且会重复时返回下一轮
+ */
+func (w ActivityWindow) at(now time.Time) (time.Time, time.Time) {
+	if w.Repeat <= 0 || now.Before(w.Start) {
+		return w.Start, w.End
+	}
+	k := int64(now.Sub(w.Start) / w.Repeat)
+	start := w.Start.Add(time.Duration(k) * w.Repeat)
+	end := w.End.Add(time.Duration(k) * w.Repeat)
+	if !now.Before(end) {
+		start, end = start.Add(w.Repeat), end.Add(w.Repeat)
+	}
+	return start, end
+}
+
+/*
+ * scheduleActivityLocked 在下一次开启/关闭时触发回调和过期清理，并安排再下一次（调用方需持有 activityMu）
+ */
+func scheduleActivityLocked(typeKey TypeKey, act *activity, now time.Time) {
+	start, end := act.window.at(now)
+	open, at := true, start
+	if !now.Before(start) {
+		open, at = false, end
+	}
+	if !now.Before(at) {
+		// 不重复的活动已结束
+		act.timer = nil
+		return
+	}
+
+	act.timer = time.AfterFunc(at.Sub(now), func() {
+		activityMu.Lock()
+		hook := activityHooks[typeKey]
+		current := activities[typeKey] == act
+		activityMu.Unlock()
+		if !current {
+			return
+		}
+
+		log.Printf("LimitTime type %v activity open=%v, window %v - %v", typeKey, open, start, end)
+		if hook != nil {
+			hook(typeKey, open, start, end)
+		}
+		if !open {
+			rolloverType(LimitTime, typeKey, end)
+		}
+
+		// 回调或清理耗时超过窗口时从当前时间计算下一次边界，避免补发已过期的边界
+		now := time.Now()
+		if now.Before(at) {
+			now = at
+		}
+		activityMu.Lock()
+		defer activityMu.Unlock()
+		if activities[typeKey] == act {
+			scheduleActivityLocked(typeKey, act, now)
+		}
+	})
+}
+
+/*
+ * activityInactive 活动未开放时返回 ErrInactive，未注册活动窗口的类型不受限制
+ */
+func activityInactive(typeKey TypeKey, now time.Time) error {
+	start, end, active, ok := ActivityAt(typeKey, now)
+	if !ok || active {
+		return nil
+	}
+	return fmt.Errorf("%w: type %v, window %v - %v", ErrInactive, typeKey, start, end)
+}
+
+/*
+ * fillActivity 为 LimitTime 记录填充过期时间为本轮窗口的结束时间
+ * 已设置的过期时间晚于窗口结束时截断到窗口结束，常驻内存的记录不会跨过窗口继续被访问
+ */
+func fillActivity(typeKey TypeKey, data *PlayerData, now time.Time) {
+	_, end, active, ok := ActivityAt(typeKey, now)
+	if !ok || !active {
+		return
+	}
+	if data.ExpireTime == 0 || data.ExpireTime > end.Unix() {
+		data.ExpireTime = end.Unix()
+	}
+}
@@ -0,0 +1,450 @@
+/*
+ * MiscData 序列化编解码
+ *
+ * 模块用途：
+ *   MiscData 中的 map[int32]int32、[]int32 等值经普通 JSON 往返后会变成 map[string]interface{}、
+ *   []interface{}（元素为 float64），cond_* 辅助函数随之失效。Codec 在编码时保留每个值的具体 Go 类型：
+ *   - JSONCodec:    每个值带类型标签（{"t":"[]int32","v":[1,2]}），与 Snapshot / WAL / backend 的格式一致；
+ *                   解码时兼容不带标签的旧数据
+ *   - GobCodec:     encoding/gob，类型信息由 gob 自身保存
+ *   - MsgpackCodec: MessagePack，每个值编码为 [类型标签, 值]
+ *
+ *   已登记的类型见 codecTypes，业务自定义类型可通过 RegisterCodecType 追加；
+ *   未登记的类型 JSON / Msgpack 按 JSON 原样保存（恢复为 json.Unmarshal 的默认类型），Gob 编码失败。
+ *
+ *   加载器返回的数据、JSONCodec 解码的旧数据会经过 NormalizeMiscData 规整：
+ *   有 Schema 时按声明的类型转换，否则把全为整数的 []interface{} 转为 []int32、
+ *   键和值全为整数的 map 转为 map[int32]int32。
+ *
+ * 示例：
+ *   raw, err := cycledata.MsgpackCodec.Marshal(data.MiscData)
+ *   misc, err := cycledata.MsgpackCodec.Unmarshal(raw)
+ */
+package cycledata
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ * Codec MiscData 编解码器
+ */
+type Codec interface {
+	Name() string
+	Marshal(m map[string]interface{}) ([]byte, error)
+	Unmarshal(b []byte) (map[string]interface{}, error)
+}
+
+var (
+	// JSONCodec 带类型标签的 JSON
+	JSONCodec Codec = jsonCodec{}
+
+	// GobCodec encoding/gob
+	GobCodec Codec = gobCodec{}
+
+	// MsgpackCodec 带类型标签的 MessagePack
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+// rawJSONTag 未登记类型的值按 JSON 原样保存
+const rawJSONTag = "json"
+
+var (
+	// codecTypes 类型标签（reflect.Type.String()）-> 类型
+	codecTypes = make(map[string]reflect.Type)
+
+	// codecMu 保护 codecTypes 的并发访问
+	codecMu sync.RWMutex
+
+	timeType = reflect.TypeOf(time.Time{})
+)
+
+func init() {
+	for _, v := range []interface{}{
+		false, "", int(0), int32(0), int64(0), uint32(0), uint64(0), float32(0), float64(0), time.Time{},
+		[]int(nil), []int32(nil), []int64(nil), []string(nil),
+		map[int32]int32(nil), map[int32]int64(nil),
+		map[string]int(nil), map[string]int32(nil), map[string]int64(nil),
+		map[string]string(nil), map[string]float64(nil), map[string]bool(nil),
+	} {
+		registerCodecType(reflect.TypeOf(v))
+	}
+}
+
+/*
+ * RegisterCodecType 登记 MiscData 中使用的自定义类型，编解码后保持类型不变
+ */
+func RegisterCodecType[T any]() {
+	registerCodecType(reflect.TypeOf((*T)(nil)).Elem())
+}
+
+/*
+ * registerCodecType 登记类型，同时注册到 gob
+ */
+func registerCodecType(t reflect.Type) {
+	codecMu.Lock()
+	defer codecMu.Unlock()
+
+	codecTypes[t.String()] = t
+	gob.Register(reflect.Zero(t).Interface())
+}
+
+/*
+ * codecType 按类型标签查找已登记的类型
+ */
+func codecType(tag string) (reflect.Type, bool) {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+	t, ok := codecTypes[tag]
+	return t, ok
+}
+
+/*
+ * typeTag 值的类型标签，未登记的类型返回 rawJSONTag
+ */
+func typeTag(v interface{}) string {
+	if v == nil {
+		return rawJSONTag
+	}
+	tag := reflect.TypeOf(v).String()
+	if _, ok := codecType(tag); ok {
+		return tag
+	}
+	return rawJSONTag
+}
+
+/*
+ * taggedValue 带类型标签的 MiscData 值
+ */
+type taggedValue struct {
+	Type  string          `json:"t"`
+	Value json.RawMessage `json:"v"`
+}
+
+/*
+ * encodeValue 为值附加类型标签
+ */
+func encodeValue(v interface{}) (taggedValue, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return taggedValue{}, err
+	}
+	return taggedValue{Type: typeTag(v), Value: raw}, nil
+}
+
+/*
+ * decodeValue 按类型标签还原值
+ */
+func decodeValue(tv taggedValue) (interface{}, error) {
+	if tv.Type == rawJSONTag {
+		var v interface{}
+		err := json.Unmarshal(tv.Value, &v)
+		return v, err
+	}
+	t, ok := codecType(tv.Type)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown value type %q", ErrSnapshotFormat, tv.Type)
+	}
+	ptr := reflect.New(t)
+	if err := json.Unmarshal(tv.Value, ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+/*
+ * MarshalMiscData 使用 JSONCodec 编码 MiscData，供自定义存储器使用
+ * 在存储器中调用时记录已由调用方加锁
+ */
+func MarshalMiscData(m map[string]interface{}) ([]byte, error) {
+	return JSONCodec.Marshal(m)
+}
+
+/*
+ * UnmarshalMiscData 使用 JSONCodec 解码，还原各值的原始类型（兼容不带类型标签的旧数据）
+ */
+func UnmarshalMiscData(b []byte) (map[string]interface{}, error) {
+	return JSONCodec.Unmarshal(b)
+}
+
+/*
+ * jsonCodec 带类型标签的 JSON
+ */
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(m map[string]interface{}) ([]byte, error) {
+	tagged := make(map[string]taggedValue, len(m))
+	for key, value := range m {
+		tv, err := encodeValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", key, err)
+		}
+		tagged[key] = tv
+	}
+	return json.Marshal(tagged)
+}
+
+func (jsonCodec) Unmarshal(b []byte) (map[string]interface{}, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSnapshotFormat, err)
+	}
+
+	m := make(map[string]interface{}, len(fields))
+	legacy := make(map[string]interface{})
+	for key, raw := range fields {
+		var tv taggedValue
+		if isTagged(raw, &tv) {
+			value, err := decodeValue(tv)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", key, err)
+			}
+			m[key] = value
+			continue
+		}
+		// 不带类型标签的旧数据
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, fmt.Errorf("%w: key %q: %w", ErrSnapshotFormat, key, err)
+		}
+		legacy[key] = value
+	}
+	normalizeMiscData(nil, legacy)
+	for key, value := range legacy {
+		m[key] = value
+	}
+	return m, nil
+}
+
+/*
+ * isTagged 判断 JSON 是否为带类型标签的值（只包含 t、v 两个字段且标签已知）
+ */
+func isTagged(raw json.RawMessage, tv *taggedValue) bool {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(raw, &obj) != nil || len(obj) != 2 || obj["t"] == nil || obj["v"] == nil {
+		return false
+	}
+	if json.Unmarshal(raw, tv) != nil {
+		return false
+	}
+	if tv.Type == rawJSONTag {
+		return true
+	}
+	_, ok := codecType(tv.Type)
+	return ok
+}
+
+/*
+ * gobCodec encoding/gob，值的类型需已登记
+ */
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(m map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(b []byte) (map[string]interface{}, error) {
+	var m map[string]interface{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&m); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSnapshotFormat, err)
+	}
+	if m == nil {
+		m = make(map[string]interface{})
+	}
+	return m, nil
+}
+
+/*
+ * NormalizeMiscData 规整加载器返回的旧数据，使 cond_* 辅助函数可以直接使用：
+ * 有 Schema 时按声明的类型转换；否则全为整数的 []interface{} 转为 []int32，
+ * 键和值全为整数的 map 转为 map[int32]int32。无法转换的值保持不变
+ */
+func NormalizeMiscData(cycle CycleType, typeKey TypeKey, m map[string]interface{}) {
+	var schema Schema
+	if entry := getSchema(cycle, typeKey); entry != nil {
+		schema = entry.schema
+	}
+	normalizeMiscData(schema, m)
+}
+
+/*
+ * normalizeMiscData 按 Schema（可为 nil）规整 MiscData
+ */
+func normalizeMiscData(schema Schema, m map[string]interface{}) {
+	for key, value := range m {
+		if value == nil {
+			continue
+		}
+		if spec, ok := schema[key]; ok && spec.Type != nil {
+			if reflect.TypeOf(value) != spec.Type {
+				if rv, ok := convertValue(value, spec.Type); ok {
+					m[key] = rv.Interface()
+				}
+			}
+			continue
+		}
+
+		switch value.(type) {
+		case []interface{}:
+			if s, ok := toInt32Slice(value); ok {
+				m[key] = s
+			}
+		case map[string]interface{}, map[interface{}]interface{}:
+			if mm, ok := toInt32Map(value); ok {
+				m[key] = mm
+			}
+		}
+	}
+}
+
+/*
+ * convertValue 将 JSON / MessagePack 解码得到的通用值转换为 t 类型
+ * 支持数值之间（浮点转整数需为整数值）、字符串形式的整数键、slice、map、time.Time（UnixNano）
+ */
+func convertValue(v interface{}, t reflect.Type) (reflect.Value, bool) {
+	if v == nil {
+		return reflect.Zero(t), true
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Type() == t {
+		return rv, true
+	}
+	if t == timeType {
+		if n, ok := toInt64(v); ok {
+			return reflect.ValueOf(time.Unix(0, n)), true
+		}
+		return reflect.Value{}, false
+	}
+
+	out := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Interface:
+		out.Set(rv)
+	case reflect.Bool:
+		b, ok := v.(bool)
+		if !ok {
+			return reflect.Value{}, false
+		}
+		out.SetBool(b)
+	case reflect.String:
+		switch s := v.(type) {
+		case string:
+			out.SetString(s)
+		case []byte:
+			out.SetString(string(s))
+		default:
+			return reflect.Value{}, false
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := integerOf(v)
+		if !ok || out.OverflowInt(n) {
+			return reflect.Value{}, false
+		}
+		out.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, ok := v.(uint64)
+		if !ok {
+			n, isInt := integerOf(v)
+			if !isInt || n < 0 {
+				return reflect.Value{}, false
+			}
+			u = uint64(n)
+		}
+		if out.OverflowUint(u) {
+			return reflect.Value{}, false
+		}
+		out.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, ok := toFloat64(v)
+		if n, isU := v.(uint64); isU {
+			f, ok = float64(n), true
+		}
+		if !ok {
+			return reflect.Value{}, false
+		}
+		out.SetFloat(f)
+	case reflect.Slice:
+		if b, ok := v.([]byte); ok && t.Elem().Kind() == reflect.Uint8 {
+			out.SetBytes(b)
+			break
+		}
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return reflect.Value{}, false
+		}
+		out = reflect.MakeSlice(t, rv.Len(), rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			elem, ok := convertValue(rv.Index(i).Interface(), t.Elem())
+			if !ok {
+				return reflect.Value{}, false
+			}
+			out.Index(i).Set(elem)
+		}
+	case reflect.Map:
+		if rv.Kind() != reflect.Map {
+			return reflect.Value{}, false
+		}
+		out = reflect.MakeMapWithSize(t, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			key, ok := convertValue(iter.Key().Interface(), t.Key())
+			if !ok {
+				return reflect.Value{}, false
+			}
+			val, ok := convertValue(iter.Value().Interface(), t.Elem())
+			if !ok {
+				return reflect.Value{}, false
+			}
+			out.SetMapIndex(key, val)
+		}
+	default:
+		return reflect.Value{}, false
+	}
+	return out, true
+}
+
+/*
+ * integerOf 取整数值：整数类型直接转换，float64 需为整数值，字符串（JSON 的 map 键）按十进制解析
+ */
+func integerOf(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case float64:
+		if n != math.Trunc(n) || n < math.MinInt64 || n >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(n), true
+	case float32:
+		return integerOf(float64(n))
+	case string:
+		i, err := strconv.ParseInt(n, 10, 64)
+		return i, err == nil
+	case uint64:
+		if n > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	default:
+		return toInt64(v)
+	}
+}
@@ -0,0 +1,335 @@
+/*
+ * MessagePack 编解码
+ *
+ * MiscData 编码为 map，每个值为 [类型标签, 值] 两元素数组；
+ * 整数统一使用 int64 / uint64 格式，time.Time 编码为 UnixNano，未登记的类型以 JSON 字节（bin）保存。
+ * 解码支持 MessagePack 规范中除 ext 外的全部格式，按类型标签还原为具体的 Go 类型。
+ */
+package cycledata
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// errMsgpackTruncated 数据不完整
+var errMsgpackTruncated = errors.New("msgpack: unexpected end of data")
+
+/*
+ * msgpackCodec 带类型标签的 MessagePack
+ */
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (msgpackCodec) Marshal(m map[string]interface{}) ([]byte, error) {
+	buf := appendMsgpackHeader(nil, 0xdf, len(m))
+	for key, value := range m {
+		tag := typeTag(value)
+		buf = appendMsgpackString(buf, key)
+		buf = appendMsgpackHeader(buf, 0xdd, 2)
+		buf = appendMsgpackString(buf, tag)
+
+		var err error
+		if tag == rawJSONTag {
+			var raw []byte
+			if raw, err = json.Marshal(value); err == nil {
+				buf = appendMsgpackBytes(buf, raw)
+			}
+		} else {
+			buf, err = appendMsgpackValue(buf, reflect.ValueOf(value))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", key, err)
+		}
+	}
+	return buf, nil
+}
+
+func (msgpackCodec) Unmarshal(b []byte) (map[string]interface{}, error) {
+	d := &msgpackDecoder{buf: b}
+	v, err := d.decode()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSnapshotFormat, err)
+	}
+	fields, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: msgpack payload is %T, want map", ErrSnapshotFormat, v)
+	}
+
+	m := make(map[string]interface{}, len(fields))
+	for k, field := range fields {
+		key, ok := k.(string)
+		pair, isPair := field.([]interface{})
+		if !ok || !isPair || len(pair) != 2 {
+			return nil, fmt.Errorf("%w: malformed msgpack field %v", ErrSnapshotFormat, k)
+		}
+		tag, _ := pair[0].(string)
+
+		if tag == rawJSONTag {
+			raw, _ := pair[1].([]byte)
+			var value interface{}
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return nil, fmt.Errorf("%w: key %q: %w", ErrSnapshotFormat, key, err)
+			}
+			m[key] = value
+			continue
+		}
+		t, ok := codecType(tag)
+		if !ok {
+			return nil, fmt.Errorf("%w: key %q: unknown value type %q", ErrSnapshotFormat, key, tag)
+		}
+		rv, ok := convertValue(pair[1], t)
+		if !ok {
+			return nil, fmt.Errorf("%w: key %q: cannot convert %T to %v", ErrSnapshotFormat, key, pair[1], t)
+		}
+		m[key] = rv.Interface()
+	}
+	return m, nil
+}
+
+/*
+ * appendMsgpackValue 按值的种类编码
+ */
+func appendMsgpackValue(buf []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return append(buf, 0xc0), nil
+	}
+	if v.Type() == timeType {
+		return appendMsgpackInt(buf, v.Interface().(time.Time).UnixNano()), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendMsgpackInt(buf, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf = append(buf, 0xcf)
+		return binary.BigEndian.AppendUint64(buf, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		buf = append(buf, 0xcb)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return appendMsgpackString(buf, v.String()), nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 && v.Kind() == reflect.Slice {
+			return appendMsgpackBytes(buf, v.Bytes()), nil
+		}
+		buf = appendMsgpackHeader(buf, 0xdd, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if buf, err = appendMsgpackValue(buf, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		buf = appendMsgpackHeader(buf, 0xdf, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			var err error
+			if buf, err = appendMsgpackValue(buf, iter.Key()); err != nil {
+				return nil, err
+			}
+			if buf, err = appendMsgpackValue(buf, iter.Value()); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return append(buf, 0xc0), nil
+		}
+		return appendMsgpackValue(buf, v.Elem())
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type %v", v.Type())
+}
+
+func appendMsgpackInt(buf []byte, n int64) []byte {
+	buf = append(buf, 0xd3)
+	return binary.BigEndian.AppendUint64(buf, uint64(n))
+}
+
+func appendMsgpackString(buf []byte, s string) []byte {
+	buf = appendMsgpackHeader(buf, 0xdb, len(s))
+	return append(buf, s...)
+}
+
+func appendMsgpackBytes(buf []byte, b []byte) []byte {
+	buf = appendMsgpackHeader(buf, 0xc6, len(b))
+	return append(buf, b...)
+}
+
+/*
+ * appendMsgpackHeader 写入 32 位长度的类型头（str32 / bin32 / array32 / map32）
+ */
+func appendMsgpackHeader(buf []byte, code byte, n int) []byte {
+	buf = append(buf, code)
+	return binary.BigEndian.AppendUint32(buf, uint32(n))
+}
+
+/*
+ * msgpackDecoder 解码为通用值：nil、bool、int64、uint64、float64、string、[]byte、
+ * []interface{}、map[interface{}]interface{}
+ */
+type msgpackDecoder struct {
+	buf []byte
+	pos int
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.buf) {
+		return nil, errMsgpackTruncated
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	head, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := head[0]
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.decodeMap(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return d.decodeArray(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return d.decodeString(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+	case 0xca:
+		u, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.uint(8)
+		return math.Float64frombits(u), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(1 << (c - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		u, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		shift := 64 - 8*size
+		return int64(u<<shift) >> shift, nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n))
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n))
+	}
+	return nil, fmt.Errorf("msgpack: unsupported format 0x%02x", c)
+}
+
+func (d *msgpackDecoder) decodeString(n int) (interface{}, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) decodeArray(n int) (interface{}, error) {
+	if n > len(d.buf)-d.pos {
+		return nil, errMsgpackTruncated
+	}
+	out := make([]interface{}, n)
+	for i := range out {
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int) (interface{}, error) {
+	if n > len(d.buf)-d.pos {
+		return nil, errMsgpackTruncated
+	}
+	out := make(map[interface{}]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		switch k.(type) {
+		case []interface{}, map[interface{}]interface{}, []byte:
+			return nil, fmt.Errorf("msgpack: unsupported map key %T", k)
+		}
+		out[k] = v
+	}
+	return out, nil
+}
@@ -0,0 +1,73 @@
+/*
+ * 周期数据错误定义
+ * 统一的哨兵错误，调用方可通过 errors.Is 判断失败原因并返回精确的错误码
+ *
+ * 示例：
+ *   switch err := DecreaseIfEnough(coins, userID, 50); {
+ *   case errors.Is(err, ErrInsufficient):   // 余额不足
+ *   case errors.Is(err, ErrNoData):         // 数据不可用（含 ErrNoCreator / ErrNilData）
+ *   }
+ */
+package cycledata
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNoData 无法获取玩家数据（ErrNoCreator、ErrNilData 均可用 errors.Is 匹配到它）
+	ErrNoData = errors.New("cycledata: player data unavailable")
+
+	// ErrNoCreator 未注册加载器和创建器
+	ErrNoCreator = fmt.Errorf("%w: no loader or creator registered", ErrNoData)
+
+	// ErrNilData 加载器/创建器返回 nil
+	ErrNilData = fmt.Errorf("%w: loader and creator returned nil", ErrNoData)
+
+	// ErrLoadFailed 加载器/创建器执行失败（如 panic），等待同一次加载的调用方都会收到该错误
+	ErrLoadFailed = fmt.Errorf("%w: load failed", ErrNoData)
+
+	// ErrTypeMismatch MiscData 中存储的值无法转换为字段声明的类型
+	ErrTypeMismatch = errors.New("cycledata: value type mismatch")
+
+	// ErrConditionFailed 条件函数拒绝了本次修改（含 CD 未满足）
+	ErrConditionFailed = errors.New("cycledata: condition rejected")
+
+	// ErrInsufficient 扣减时余额不足
+	ErrInsufficient = errors.New("cycledata: insufficient balance")
+
+	// ErrKeyNotFound 要删除/更新的字段或 map 键不存在
+	ErrKeyNotFound = errors.New("cycledata: key not found")
+
+	// ErrKeyExists 要设置的 map 键已存在
+	ErrKeyExists = errors.New("cycledata: key already exists")
+
+	// ErrNoLoopCycle LoopTime 类型未注册循环规则（或按时间循环的类型调用了 AdvanceLoop）
+	ErrNoLoopCycle = errors.New("cycledata: loop cycle not registered")
+
+	// ErrNewbieEnded 玩家的新手期已结束，不再加载/创建 Newbie 数据
+	ErrNewbieEnded = fmt.Errorf("%w: newbie window ended", ErrNoData)
+
+	// ErrInactive LimitTime 活动不在开放时间内，不加载/创建数据
+	ErrInactive = fmt.Errorf("%w: activity inactive", ErrNoData)
+
+	// ErrSnapshotFormat 快照内容无法识别（文件头缺失、版本过高或记录损坏）
+	ErrSnapshotFormat = errors.New("cycledata: invalid snapshot")
+
+	// ErrWALOpen 实例已开启 WAL
+	ErrWALOpen = errors.New("cycledata: wal already open")
+
+	// ErrVersionConflict 存储中的版本号与 PlayerData.Version 不一致，由存储器返回（见 VersionConflictError）
+	ErrVersionConflict = errors.New("cycledata: version conflict")
+
+	// ErrStoreFailed 存储器写入失败（失败的记录继续常驻并进入重试队列）
+	ErrStoreFailed = errors.New("cycledata: store failed")
+)
+
+/*
+ * typeMismatch 构造带上下文信息的类型不匹配错误
+ */
+func typeMismatch(key string, raw interface{}, want interface{}) error {
+	return fmt.Errorf("%w: key %q holds %T, want %T", ErrTypeMismatch, key, raw, want)
+}
@@ -0,0 +1,320 @@
+/*
+ * MiscData 修改事件订阅
+ *
+ * 模块用途：
+ *   任务进度等需要在计数变化时推送给客户端，Subscribe 在每次成功修改后按字段投递 Event：
+ *   - Field / cond_* 辅助函数:                     OpField，每次一个事件
+ *   - SetData:                                     OpSetData，按新旧 MiscData 的差异逐键投递
+ *   - SetWithAllMiscData / SetMiscDataMapCond*:     OpSetMiscData，同上
+ *   - Txn 提交:                                     OpTxn，每条被写过的记录按差异逐键投递
+ *   - 版本冲突后的合并（见 cycledata_version.go）:    OpMerge，同上
+ *   条件不满足、校验失败等未写入的修改不产生事件；直接修改 MiscData 后调用 MarkDirty 的修改不会被感知。
+ *
+ *   投递方式：
+ *   - Subscribe:      同步投递，在修改方的协程中、释放记录锁之后调用，回调可以安全地读取同一玩家的数据
+ *   - SubscribeAsync: 异步投递，事件在修改方持有记录锁时进入订阅自己的有界队列，由独立协程按顺序调用回调，
+ *                     同一玩家的事件与修改顺序一致；队列已满时丢弃新事件并计数（见 Subscription.Stats），修改方永不阻塞
+ *   回调 panic 只记录日志，不影响修改方和后续事件。
+ *   Event 中的 Old / New 是修改时复制的值，回调可以持有它们，但同一事件会交给全部订阅，不要修改。
+ *
+ * 示例：
+ *   sub := cycledata.SubscribeAsync(DailyCycle, TypeKey(1), 4096, func(ev cycledata.Event) {
+ *       if ev.Key == "questProgress" {
+ *           pushToClient(ev.UserID, ev.New)
+ *       }
+ *   })
+ *   defer sub.Unsubscribe()
+ */
+package cycledata
+
+import (
+	"log"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * EventOp 产生事件的修改方式
+ */
+type EventOp string
+
+const (
+	// OpField Field / cond_* 辅助函数的字段级修改
+	OpField EventOp = "field"
+
+	// OpSetData SetData 覆盖 MiscData
+	OpSetData EventOp = "setData"
+
+	// OpSetMiscData SetWithAllMiscData / SetMiscDataMapCond / SetMiscDataMapCondMapString
+	OpSetMiscData EventOp = "setMiscData"
+
+	// OpTxn 事务提交
+	OpTxn EventOp = "txn"
+
+	// OpMerge 版本冲突后合并存储中的数据
+	OpMerge EventOp = "merge"
+)
+
+// DefaultEventQueueSize SubscribeAsync 未指定队列长度时的默认值
+const DefaultEventQueueSize = 1024
+
+/*
+ * Event 一个字段的修改
+ */
+type Event struct {
+	Cycle   CycleType
+	TypeKey TypeKey
+	UserID  UserID
+	Key     string
+	Old     interface{} // 修改前的值，字段原本不存在时为 nil
+	New     interface{} // 修改后的值，字段被删除时为 nil
+	Op      EventOp
+	Time    time.Time
+}
+
+/*
+ * SubscriptionStats 订阅的投递统计
+ */
+type SubscriptionStats struct {
+	Delivered uint64 // 已调用回调的事件数
+	Dropped   uint64 // 队列已满被丢弃的事件数（同步订阅始终为 0）
+	Queued    int    // 队列中等待投递的事件数
+}
+
+/*
+ * Subscription 一个订阅，Unsubscribe 后不再接收新事件
+ */
+type Subscription struct {
+	bus   *eventBus
+	key   collectionKey
+	fn    func(Event)
+	queue chan Event // 异步订阅的有界队列，同步订阅为 nil
+
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+	closed    bool // 受 bus.mu 保护
+}
+
+/*
+ * eventBus 实例内的全部订阅
+ */
+type eventBus struct {
+	mu   sync.RWMutex
+	subs map[collectionKey][]*Subscription
+}
+
+/*
+ * Subscribe 同步订阅默认实例中 (cycle, typeKey) 的修改事件
+ */
+func Subscribe(cycle CycleType, typeKey TypeKey, fn func(Event)) *Subscription {
+	return defaultStore.Subscribe(cycle, typeKey, fn)
+}
+
+/*
+ * Subscribe 同步订阅实例中 (cycle, typeKey) 的修改事件，回调在修改方的协程中执行
+ */
+func (s *Store) Subscribe(cycle CycleType, typeKey TypeKey, fn func(Event)) *Subscription {
+	return s.h.events.subscribe(collectionKey{cycle: cycle, typeKey: typeKey}, fn, 0)
+}
+
+/*
+ * SubscribeAsync 异步订阅默认实例中 (cycle, typeKey) 的修改事件
+ */
+func SubscribeAsync(cycle CycleType, typeKey TypeKey, queueSize int, fn func(Event)) *Subscription {
+	return defaultStore.SubscribeAsync(cycle, typeKey, queueSize, fn)
+}
+
+/*
+ * SubscribeAsync 异步订阅实例中 (cycle, typeKey) 的修改事件
+ * queueSize 为队列长度，<= 0 时使用 DefaultEventQueueSize；队列已满时丢弃新事件
+ */
+func (s *Store) SubscribeAsync(cycle CycleType, typeKey TypeKey, queueSize int, fn func(Event)) *Subscription {
+	if queueSize <= 0 {
+		queueSize = DefaultEventQueueSize
+	}
+	return s.h.events.subscribe(collectionKey{cycle: cycle, typeKey: typeKey}, fn, queueSize)
+}
+
+/*
+ * subscribe 注册订阅，queueSize > 0 时为异步订阅并启动投递协程
+ */
+func (b *eventBus) subscribe(key collectionKey, fn func(Event), queueSize int) *Subscription {
+	sub := &Subscription{bus: b, key: key, fn: fn}
+	if queueSize > 0 {
+		sub.queue = make(chan Event, queueSize)
+		go sub.run()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[collectionKey][]*Subscription)
+	}
+	b.subs[key] = append(b.subs[key], sub)
+	return sub
+}
+
+/*
+ * Unsubscribe 取消订阅；异步订阅队列中已有的事件仍会投递完，之后投递协程退出
+ * 可重复调用，也可以在回调中调用
+ */
+func (sub *Subscription) Unsubscribe() {
+	b := sub.bus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	subs := b.subs[sub.key]
+	for i, s := range subs {
+		if s == sub {
+			b.subs[sub.key] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(b.subs[sub.key]) == 0 {
+		delete(b.subs, sub.key)
+	}
+	if sub.queue != nil {
+		close(sub.queue)
+	}
+}
+
+/*
+ * Stats 订阅的投递统计
+ */
+func (sub *Subscription) Stats() SubscriptionStats {
+	return SubscriptionStats{
+		Delivered: sub.delivered.Load(),
+		Dropped:   sub.dropped.Load(),
+		Queued:    len(sub.queue),
+	}
+}
+
+/*
+ * run 异步订阅的投递协程
+ */
+func (sub *Subscription) run() {
+	for ev := range sub.queue {
+		sub.deliver(ev)
+	}
+}
+
+/*
+ * deliver 调用回调，panic 只记录日志
+ */
+func (sub *Subscription) deliver(ev Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Event subscriber panic for uid %d, cycle %v, type %v, key %q: %v",
+				ev.UserID, ev.Cycle, ev.TypeKey, ev.Key, r)
+		}
+	}()
+	sub.fn(ev)
+	sub.delivered.Add(1)
+}
+
+/*
+ * watched 是否有订阅关注 (cycle, typeKey)，没有时修改方无需复制旧值
+ */
+func (b *eventBus) watched(cycle CycleType, typeKey TypeKey) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs[collectionKey{cycle: cycle, typeKey: typeKey}]) > 0
+}
+
+/*
+ * pendingEvents 已放入异步队列、等待释放记录锁后同步投递的事件
+ */
+type pendingEvents struct {
+	events []Event
+	subs   [][]*Subscription // 与 events 一一对应的同步订阅，没有同步订阅时为 nil
+}
+
+/*
+ * publishLocked 投递事件的第一步（调用方需持有产生事件的记录锁）
+ * 事件在记录锁内放入异步订阅的队列，同一记录的事件按修改顺序入队；入队不阻塞，队列已满时丢弃并计数。
+ * 异步订阅在持有 b.mu 读锁时入队，避免与 Unsubscribe 关闭队列竞争；
+ * 返回的同步投递需在释放记录锁后调用 deliver
+ */
+func (b *eventBus) publishLocked(events []Event) pendingEvents {
+	if len(events) == 0 {
+		return pendingEvents{}
+	}
+
+	var syncSubs [][]*Subscription
+	b.mu.RLock()
+	for i, ev := range events {
+		subs := b.subs[collectionKey{cycle: ev.Cycle, typeKey: ev.TypeKey}]
+		if syncSubs == nil && len(subs) > 0 {
+			syncSubs = make([][]*Subscription, len(events))
+		}
+		for _, sub := range subs {
+			if sub.queue == nil {
+				syncSubs[i] = append(syncSubs[i], sub)
+				continue
+			}
+			select {
+			case sub.queue <- ev:
+			default:
+				sub.dropped.Add(1)
+			}
+		}
+	}
+	b.mu.RUnlock()
+	return pendingEvents{events: events, subs: syncSubs}
+}
+
+/*
+ * deliver 调用同步订阅的回调（调用方不能持有记录锁）
+ */
+func (p pendingEvents) deliver() {
+	if p.subs == nil {
+		return
+	}
+	for i, ev := range p.events {
+		for _, sub := range p.subs[i] {
+			sub.deliver(ev)
+		}
+	}
+}
+
+/*
+ * cloneMiscData 复制 MiscData 作为修改前的快照
+ */
+func cloneMiscData(m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		out[key] = cloneValue(value)
+	}
+	return out
+}
+
+/*
+ * diffEvents 比较修改前的快照 before 与修改后的 after，为每个变化的键生成事件
+ */
+func diffEvents(cycle CycleType, typeKey TypeKey, userID UserID, op EventOp,
+	before, after map[string]interface{}) []Event {
+
+	now := time.Now()
+	var events []Event
+	for key, value := range after {
+		old, ok := before[key]
+		if ok && reflect.DeepEqual(old, value) {
+			continue
+		}
+		events = append(events, Event{Cycle: cycle, TypeKey: typeKey, UserID: userID, Key: key,
+			Old: old, New: cloneValue(value), Op: op, Time: now})
+	}
+	for key, old := range before {
+		if _, ok := after[key]; !ok {
+			events = append(events, Event{Cycle: cycle, TypeKey: typeKey, UserID: userID, Key: key,
+				Old: old, Op: op, Time: now})
+		}
+	}
+	return events
+}
@@ -0,0 +1,530 @@
+/*
+ * 冷数据淘汰策略
+ *
+ * 模块用途：
+ *   按 (CycleType, TypeKey) 配置常驻内存数据的淘汰规则，由可启停的调度器定期执行：
+ *   - IdleTTL：超过该时长既未访问也未修改的记录被淘汰（默认 4 小时）
+ *   - MaxResident：常驻记录数上限，超出部分按 LRU（最久未访问）或 LFU（访问次数最少）淘汰
+ *   - 内存预算：实例内所有集合估算内存之和超过预算时，按最久未访问的顺序跨集合淘汰
+ *
+ *   淘汰前脏数据先写入存储器，写入失败的记录继续常驻并进入重试队列；
+ *   未注册存储器的集合无法持久化，其数据不会被淘汰。
+ *
+ * 示例：
+ *   RegisterEvictionPolicy(DailyCycle, TypeKey(1), EvictionPolicy{
+ *       IdleTTL:     30 * time.Minute,
+ *       MaxResident: 100000,
+ *       Strategy:    EvictLFU,
+ *   })
+ *   SetMemoryBudget(512 << 20)
+ *   StartEviction(5 * time.Minute)
+ *   defer StopEviction()
+ */
+package cycledata
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * EvictStrategy 超过常驻上限时的淘汰策略
+ */
+type EvictStrategy int
+
+const (
+	// EvictLRU 优先淘汰最久未访问的记录
+	EvictLRU EvictStrategy = iota
+
+	// EvictLFU 优先淘汰访问次数最少的记录（次数相同时淘汰最久未访问的）
+	EvictLFU
+)
+
+/*
+ * EvictionPolicy 集合的淘汰策略
+ */
+type EvictionPolicy struct {
+	IdleTTL     time.Duration // 空闲超时，<= 0 表示不按空闲时长淘汰
+	MaxResident int           // 常驻记录数上限，<= 0 表示不限制
+	Strategy    EvictStrategy // 超过上限时的淘汰策略
+}
+
+// DefaultEvictionPolicy 未注册淘汰策略时使用的默认策略
+var DefaultEvictionPolicy = EvictionPolicy{
+	IdleTTL:  4 * time.Hour,
+	Strategy: EvictLRU,
+}
+
+var (
+	// evictionPolicies 周期 -> 类型 -> 淘汰策略
+	evictionPolicies = make(map[CycleType]map[TypeKey]EvictionPolicy)
+
+	// evictionPolicyMu 保护 evictionPolicies 的并发访问
+	evictionPolicyMu sync.RWMutex
+)
+
+/*
+ * RegisterEvictionPolicy 注册指定周期和类型的淘汰策略
+ */
+func RegisterEvictionPolicy(cycle CycleType, typeKey TypeKey, policy EvictionPolicy) {
+	evictionPolicyMu.Lock()
+	defer evictionPolicyMu.Unlock()
+
+	if _, ok := evictionPolicies[cycle]; !ok {
+		evictionPolicies[cycle] = make(map[TypeKey]EvictionPolicy)
+	}
+	evictionPolicies[cycle][typeKey] = policy
+}
+
+/*
+ * getEvictionPolicy 获取淘汰策略，未注册返回 DefaultEvictionPolicy
+ */
+func getEvictionPolicy(cycle CycleType, typeKey TypeKey) EvictionPolicy {
+	evictionPolicyMu.RLock()
+	defer evictionPolicyMu.RUnlock()
+
+	if m, ok := evictionPolicies[cycle]; ok {
+		if policy, ok := m[typeKey]; ok {
+			return policy
+		}
+	}
+	return DefaultEvictionPolicy
+}
+
+/*
+ * SetMemoryBudget 设置默认实例的内存预算（字节，按 MiscData 内容估算），<= 0 表示不限制
+ */
+func SetMemoryBudget(bytes int64) {
+	defaultStore.SetMemoryBudget(bytes)
+}
+
+/*
+ * SetMemoryBudget 设置实例的内存预算，各实例的预算互不影响
+ */
+func (s *Store) SetMemoryBudget(bytes int64) {
+	s.h.eviction.budget.Store(bytes)
+}
+
+/*
+ * MemoryUsage 估算所有常驻记录占用的内存（字节）
+ */
+func MemoryUsage() int64 {
+	return defaultStore.MemoryUsage()
+}
+
+/*
+ * MemoryUsage 估算实例中所有常驻记录占用的内存（字节）
+ */
+func (s *Store) MemoryUsage() int64 {
+	var total int64
+	s.h.eachCollection(func(_ CycleType, _ TypeKey, col *dataCollection) {
+		col.mu.RLock()
+		for _, data := range col.data {
+			total += data.estimateSize()
+		}
+		col.mu.RUnlock()
+	})
+	return total
+}
+
+/*
+ * StartEviction 以 interval 为周期启动淘汰调度器，已启动时按新周期重启
+ * interval <= 0 时使用 10~50 分钟的随机周期，避免多个进程同时写库
+ */
+func StartEviction(interval time.Duration) {
+	defaultStore.StartEviction(interval)
+}
+
+/*
+ * StartEviction 以 interval 为周期启动（或重启）实例的淘汰调度器，Stop 后再次 Start 时沿用该周期
+ */
+func (s *Store) StartEviction(interval time.Duration) {
+	s.h.startEviction(interval)
+}
+
+/*
+ * StopEviction 停止淘汰调度器并等待正在进行的淘汰完成
+ */
+func StopEviction() {
+	defaultStore.StopEviction()
+}
+
+/*
+ * StopEviction 停止实例的淘汰调度器，之后的 Start（含默认实例的自动启动）不会再启动它
+ */
+func (s *Store) StopEviction() {
+	s.h.stopEviction()
+}
+
+/*
+ * RunEviction 立即执行一次淘汰（不依赖调度器）
+ */
+func RunEviction() {
+	defaultStore.RunEviction()
+}
+
+/*
+ * RunEviction 立即对实例执行一次淘汰
+ */
+func (s *Store) RunEviction() {
+	s.h.evict(time.Now())
+}
+
+/*
+ * evictionScheduler 可启停的淘汰调度器
+ */
+type evictionScheduler struct {
+	mu       sync.Mutex
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	interval time.Duration // StartEviction 指定的周期，Start 时沿用；<= 0 表示随机周期
+	off      bool          // 已调用 StopEviction，Start 不再启动调度器
+	budget   atomic.Int64  // 内存预算（字节），<= 0 表示不限制
+}
+
+/*
+ * startEviction 按调用方指定的周期启动（或重启）淘汰调度器，之后的 Start 沿用该周期
+ */
+func (h *cycleHandler) startEviction(interval time.Duration) {
+	s := &h.eviction
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.interval, s.off = interval, false
+	s.stopLocked()
+	s.startLocked(h)
+}
+
+/*
+ * stopEviction 停止淘汰调度器，之后的 Start 不再启动它，直到再次调用 startEviction
+ */
+func (h *cycleHandler) stopEviction() {
+	s := &h.eviction
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.off = true
+	s.stopLocked()
+}
+
+/*
+ * resumeEviction 按已有配置启动淘汰调度器（Start 时调用），已在运行或被显式停止时不做任何事
+ */
+func (h *cycleHandler) resumeEviction() {
+	s := &h.eviction
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.off || s.stopCh != nil {
+		return
+	}
+	s.startLocked(h)
+}
+
+/*
+ * haltEviction 停止淘汰调度器但保留配置（Stop 时调用）
+ */
+func (h *cycleHandler) haltEviction() {
+	s := &h.eviction
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopLocked()
+}
+
+/*
+ * startLocked 启动调度协程（调用方需持有 s.mu）
+ */
+func (s *evictionScheduler) startLocked(h *cycleHandler) {
+	interval := s.interval
+	if interval <= 0 {
+		interval = time.Duration(rand.Intn(40)+10) * time.Minute // 10~50分钟
+	}
+	s.stopCh = make(chan struct{})
+	s.doneCh = make(chan struct{})
+	go h.evictionLoop(interval, s.stopCh, s.doneCh)
+}
+
+/*
+ * stopLocked 通知调度协程退出并等待（调用方需持有 s.mu）
+ */
+func (s *evictionScheduler) stopLocked() {
+	if s.stopCh == nil {
+		return
+	}
+	close(s.stopCh)
+	<-s.doneCh
+	s.stopCh, s.doneCh = nil, nil
+}
+
+/*
+ * evictionLoop 调度主循环
+ */
+func (h *cycleHandler) evictionLoop(interval time.Duration, stopCh <-chan struct{}, doneCh chan<- struct{}) {
+	defer close(doneCh)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			h.evict(now)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+/*
+ * evict 执行一次完整的淘汰
+ * 0. 清理 Newbie 周期中已过期的记录
+ * 1. 各集合按自身策略淘汰空闲记录和超出上限的记录
+ * 2. 仍超出全局内存预算时跨集合按 LRU 继续淘汰（预算按实例分别计算）
+ */
+func (h *cycleHandler) evict(now time.Time) {
+	// Newbie 按玩家各自过期，没有统一的边界回调，随淘汰一并清理
+	h.cleanExpiredAt(Newbie, now.Unix())
+	h.eachCollection(func(cycle CycleType, typeKey TypeKey, col *dataCollection) {
+		col.cleanCoolData(now, cycle, typeKey)
+	})
+	h.enforceMemoryBudget()
+}
+
+/*
+ * eachCollection 遍历所有数据集合，遍历前复制集合列表，回调时不持有处理器和服务的锁
+ */
+func (h *cycleHandler) eachCollection(fn func(cycle CycleType, typeKey TypeKey, col *dataCollection)) {
+	type entry struct {
+		key collectionKey
+		col *dataCollection
+	}
+	var entries []entry
+
+	h.mu.RLock()
+	for cycle, service := range h.services {
+		service.mu.RLock()
+		for typeKey, col := range service.collections {
+			entries = append(entries, entry{key: collectionKey{cycle: cycle, typeKey: typeKey}, col: col})
+		}
+		service.mu.RUnlock()
+	}
+	h.mu.RUnlock()
+
+	for _, e := range entries {
+		fn(e.key.cycle, e.key.typeKey, e.col)
+	}
+}
+
+/*
+ * evictCandidate 全局预算淘汰的候选记录
+ */
+type evictCandidate struct {
+	data       *PlayerData
+	size       int64
+	lastActive time.Time
+}
+
+/*
+ * enforceMemoryBudget 总估算内存超过预算时，从可持久化的集合中按最久未访问的顺序淘汰
+ */
+func (h *cycleHandler) enforceMemoryBudget() {
+	budget := h.eviction.budget.Load()
+	if budget <= 0 {
+		return
+	}
+
+	var (
+		total      int64
+		candidates []evictCandidate
+		owners     = make(map[*PlayerData]collectionKey)
+		cols       = make(map[collectionKey]*dataCollection)
+	)
+	h.eachCollection(func(cycle CycleType, typeKey TypeKey, col *dataCollection) {
+		evictable := hasStorer(cycle, typeKey)
+		key := collectionKey{cycle: cycle, typeKey: typeKey}
+		cols[key] = col
+
+		col.mu.RLock()
+		defer col.mu.RUnlock()
+		for _, data := range col.data {
+			size := data.estimateSize()
+			total += size
+			if evictable {
+				candidates = append(candidates, evictCandidate{data: data, size: size, lastActive: data.lastActive()})
+				owners[data] = key
+			}
+		}
+	})
+	if total <= budget {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastActive.Before(candidates[j].lastActive) })
+	victims := make(map[collectionKey][]*PlayerData)
+	for _, c := range candidates {
+		if total <= budget {
+			break
+		}
+		key := owners[c.data]
+		victims[key] = append(victims[key], c.data)
+		total -= c.size
+	}
+
+	for key, records := range victims {
+		cols[key].evictRecords(key.cycle, key.typeKey, records)
+	}
+}
+
+/*
+ * 清理冷数据回收内存
+ * 按集合的淘汰策略选出空闲记录和超出常驻上限的记录，
+ * 冷数据中只有脏数据需要写入存储器，未修改的直接移出内存
+ */
+func (dc *dataCollection) cleanCoolData(now time.Time, cycle CycleType, typeKey TypeKey) {
+	// 没有存储器时无法持久化，冷数据继续留在内存
+	if !hasStorer(cycle, typeKey) {
+		return
+	}
+	policy := getEvictionPolicy(cycle, typeKey)
+
+	var cold, hot []*PlayerData
+	for _, data := range dc.residents() {
+		if policy.IdleTTL > 0 && now.Sub(data.lastActive()) > policy.IdleTTL {
+			cold = append(cold, data)
+		} else {
+			hot = append(hot, data)
+		}
+	}
+
+	if policy.MaxResident > 0 && len(hot) > policy.MaxResident {
+		policy.sortByEviction(hot)
+		excess := len(hot) - policy.MaxResident
+		cold = append(cold, hot[:excess]...)
+	}
+
+	dc.evictRecords(cycle, typeKey, cold)
+}
+
+/*
+ * evictRecords 写入脏数据后淘汰指定记录，写入失败的记录继续常驻并进入重试队列
+ * 写入时不持有集合锁，之后只移出仍在集合中且未被再次修改的记录
+ */
+func (dc *dataCollection) evictRecords(cycle CycleType, typeKey TypeKey, records []*PlayerData) {
+	if len(records) == 0 {
+		return
+	}
+	_, failed := persist(context.Background(), dc.h, cycle, typeKey, records)
+	dc.evictClean(records)
+	dc.retry.enqueue(cycle, typeKey, failed)
+}
+
+/*
+ * sortByEviction 按淘汰优先级排序，最先被淘汰的排在前面
+ */
+func (p EvictionPolicy) sortByEviction(records []*PlayerData) {
+	type key struct {
+		data       *PlayerData
+		hits       uint64
+		lastActive time.Time
+	}
+	keys := make([]key, len(records))
+	for i, data := range records {
+		keys[i] = key{data: data, hits: data.hits.Load(), lastActive: data.lastActive()}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if p.Strategy == EvictLFU && keys[i].hits != keys[j].hits {
+			return keys[i].hits < keys[j].hits
+		}
+		return keys[i].lastActive.Before(keys[j].lastActive)
+	})
+	for i := range keys {
+		records[i] = keys[i].data
+	}
+}
+
+/*
+ * touch 记录一次访问
+ */
+func (pd *PlayerData) touch() {
+	pd.accessAt.Store(time.Now().UnixNano())
+	pd.hits.Add(1)
+}
+
+/*
+ * lastActive 最近一次访问或修改的时间
+ */
+func (pd *PlayerData) lastActive() time.Time {
+	pd.mu.RLock()
+	updated := pd.UpdateTime
+	pd.mu.RUnlock()
+
+	if at := pd.accessAt.Load(); at != 0 {
+		if accessed := time.Unix(0, at); accessed.After(updated) {
+			return accessed
+		}
+	}
+	return updated
+}
+
+// recordOverhead 单条记录除 MiscData 内容外的估算开销（结构体、锁、map 头、集合索引）
+const recordOverhead = 256
+
+/*
+ * estimateSize 估算记录占用的内存（字节）
+ */
+func (pd *PlayerData) estimateSize() int64 {
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+
+	size := int64(recordOverhead)
+	for k, v := range pd.MiscData {
+		size += int64(len(k)) + 16 + estimateValueSize(reflect.ValueOf(v))
+	}
+	return size
+}
+
+/*
+ * estimateValueSize 粗略估算值占用的内存（字节）
+ */
+func estimateValueSize(v reflect.Value) int64 {
+	if !v.IsValid() {
+		return 0
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return 16 + int64(v.Len())
+	case reflect.Slice, reflect.Array:
+		size := int64(24)
+		elem := v.Type().Elem()
+		if isFixedSize(elem.Kind()) {
+			return size + int64(v.Len())*int64(elem.Size())
+		}
+		for i := 0; i < v.Len(); i++ {
+			size += estimateValueSize(v.Index(i))
+		}
+		return size
+	case reflect.Map:
+		size := int64(48)
+		iter := v.MapRange()
+		for iter.Next() {
+			size += 16 + estimateValueSize(iter.Key()) + estimateValueSize(iter.Value())
+		}
+		return size
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return 8
+		}
+		return 8 + estimateValueSize(v.Elem())
+	default:
+		return int64(v.Type().Size())
+	}
+}
+
+/*
+ * isFixedSize 是否为不含指针的定长类型
+ */
+func isFixedSize(kind reflect.Kind) bool {
+	return kind >= reflect.Bool && kind <= reflect.Complex128
+}
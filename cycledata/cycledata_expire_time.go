@@ -3,7 +3,7 @@
  *
  * 模块用途：
  *   用于为不同的周期类型（CycleType）与类型键（TypeKey）组合注册默认过期时间函数，
- *   并在需要时获取对应的过期时间（单位为秒，int32）。
+ *   并在需要时获取对应的过期时间（单位为秒，int64）。
  *
  * 使用场景：
  *   - 数据缓存模块中，不同业务类型的数据需要配置不同的过期时长。
@@ -11,16 +11,19 @@
  *   - 可根据具体类型键（如 "default"、"vip"）注册差异化策略。
  *
  * 主要接口：
- *   - RegisterDefaultExpireFunc(cycle, key, fn): 注册默认过期时间函数
- *   - DefaultExpireFor(cycle, key): 获取指定周期与类型键的默认过期时间（秒）
+ *   - RegisterDefaultExpireFunc(cycle, key, fn): 注册默认过期时间函数（func() int32）
+ *   - RegisterDefaultExpireFunc64(cycle, key, fn): 注册默认过期时间函数（func() int64）
+ *   - DefaultExpireFor(cycle, key): 获取指定周期与类型键的默认过期时间（秒），返回 int64（原为 int32）
  *
  * 特性：
  *   - 线程安全（内部使用 sync.RWMutex 加锁）
  *   - 未注册返回 0，调用方可自行处理 fallback 逻辑
  *   - 默认过期时间函数支持自定义逻辑（如从配置读取、动态计算）
+ *   - 内部统一按 int64 保存，避免 2038 年溢出；RegisterDefaultExpireFunc 保持原有的 func() int32 签名
  *
  * 示例：
  *   RegisterDefaultExpireFunc(DailyCycle, "default", func() int32 { return 86400 }) // 注册每日过期为 86400 秒
+ *   RegisterDefaultExpireFunc64(LiftTime, "default", func() int64 { return 1 << 40 })
  *   expire := DefaultExpireFor(DailyCycle, "default") // 获取每日的默认过期时间
  */
 package cycledata
@@ -30,7 +33,7 @@ import (
 )
 
 // expireFunc 定义返回秒数的过期时间函数
-type expireFunc func() int32
+type expireFunc func() int64
 
 var (
 	// expireFuncRegistry 存储每个周期类型和类型键对应的过期时间函数
@@ -48,9 +51,21 @@ var (
  * 参数：
  *   - cycle: 周期类型（如每日、每周等）
  *   - key: 类型键（可用于区分具体类型，如 "default", "vip"）
- *   - fn: 返回默认过期时间（单位秒）的函数（如 func() int32 { return 86400 }）
+ *   - fn: 返回默认过期时间（单位秒）的函数（如 func() int32 { return 86400 }），传入 nil 清除注册；
+ *     超出 int32 范围的时长使用 RegisterDefaultExpireFunc64
  */
 func RegisterDefaultExpireFunc(cycle CycleType, key TypeKey, fn func() int32) {
+	var wrapped func() int64
+	if fn != nil {
+		wrapped = func() int64 { return int64(fn()) }
+	}
+	RegisterDefaultExpireFunc64(cycle, key, wrapped)
+}
+
+/*
+ * RegisterDefaultExpireFunc64 同 RegisterDefaultExpireFunc，fn 返回 int64 秒数
+ */
+func RegisterDefaultExpireFunc64(cycle CycleType, key TypeKey, fn func() int64) {
 	registryMu.Lock()
 	defer registryMu.Unlock()
 
@@ -68,9 +83,9 @@ func RegisterDefaultExpireFunc(cycle CycleType, key TypeKey, fn func() int32) {
  *   - cycle: 周期类型（如每日、每周等）
  *   - key: 类型键（如 "default"、"vip" 等）
  * 返回值：
- *   - int32: 默认过期时间（单位秒），未注册则为 0
+ *   - int64: 默认过期时间（单位秒），未注册则为 0
  */
-func DefaultExpireFor(cycle CycleType, key TypeKey) int32 {
+func DefaultExpireFor(cycle CycleType, key TypeKey) int64 {
 	registryMu.RLock()
 	defer registryMu.RUnlock()
 
@@ -0,0 +1,290 @@
+/*
+ * 类型安全的 MiscData 字段访问
+ *
+ * Field[T] 描述某个 (CycleType, TypeKey) 下 MiscData 的一个键及其 Go 类型，
+ * 数值读写经 toInt/toInt32/toInt64/toFloat64 做无损转换，溢出或带小数的值不会被截断，
+ * 转换失败返回 ErrTypeMismatch 而不是简单的 false，其余失败原因见 cycledata_errors.go。
+ *
+ * Field 默认作用于默认实例，In(store) 返回绑定到指定实例的副本。
+ *
+ * 示例：
+ *   coins := NewField[int64](LiftTime, TypeKey(1), "coins")
+ *   err := DecreaseIfEnough(coins, userID, 50)
+ *   err = DecreaseIfEnough(coins.In(store), userID, 50)
+ */
+package cycledata
+
+import (
+	"reflect"
+	"time"
+)
+
+/*
+ * Number 支持数值运算的字段类型
+ */
+type Number interface {
+	int | int32 | int64 | float64
+}
+
+/*
+ * Field 带类型的 MiscData 字段描述
+ */
+type Field[T any] struct {
+	cycle   CycleType
+	typeKey TypeKey
+	key     string
+	store   *Store // 为 nil 时使用默认实例
+
+	keepType bool // 写回时保持字段原有的数值类型，见 keepStoredType
+}
+
+/*
+ * NewField 创建字段描述
+ */
+func NewField[T any](cycle CycleType, typeKey TypeKey, key string) Field[T] {
+	return Field[T]{cycle: cycle, typeKey: typeKey, key: key}
+}
+
+/*
+ * In 返回绑定到实例 s 的字段描述，原字段不受影响
+ */
+func (f Field[T]) In(s *Store) Field[T] {
+	f.store = s
+	return f
+}
+
+/*
+ * keepStoredType 返回写回时保持字段原有数值类型的副本，供 cond_* 兼容接口使用：
+ * 以 int32 存储的字段经 IncreaseIfCondInt 累加后仍为 int32，结果超出原类型范围时返回 ErrTypeMismatch
+ */
+func (f Field[T]) keepStoredType() Field[T] {
+	f.keepType = true
+	return f
+}
+
+/*
+ * storeOf 字段作用的实例
+ */
+func (f Field[T]) storeOf() *Store {
+	if f.store != nil {
+		return f.store
+	}
+	return defaultStore
+}
+
+/*
+ * Cycle 字段所属周期
+ */
+func (f Field[T]) Cycle() CycleType { return f.cycle }
+
+/*
+ * TypeKey 字段所属类型
+ */
+func (f Field[T]) TypeKey() TypeKey { return f.typeKey }
+
+/*
+ * Key 字段在 MiscData 中的键名
+ */
+func (f Field[T]) Key() string { return f.key }
+
+/*
+ * Get 读取字段值，字段不存在时返回零值
+ */
+func (f Field[T]) Get(userID UserID) (T, error) {
+	var zero T
+	pd, err := f.storeOf().GetDataErr(f.cycle, f.typeKey, userID)
+	if err != nil {
+		return zero, err
+	}
+
+	pd.mu.RLock()
+	defer pd.mu.RUnlock()
+
+	raw, ok := pd.MiscData[f.key]
+	if !ok {
+		return zero, nil
+	}
+	val, ok := coerce[T](raw)
+	if !ok {
+		return zero, typeMismatch(f.key, raw, zero)
+	}
+	return val, nil
+}
+
+/*
+ * Set 无条件写入字段值
+ */
+func (f Field[T]) Set(userID UserID, val T) error {
+	return mutateField(f, userID, func(_ *PlayerData, _ T, _ bool) (T, error) {
+		return val, nil
+	})
+}
+
+/*
+ * Update 基于旧值计算新值，fn 返回 false 时不写入并返回 ErrConditionFailed
+ */
+func (f Field[T]) Update(userID UserID, fn func(old T) (T, bool)) error {
+	return mutateField(f, userID, func(_ *PlayerData, old T, _ bool) (T, error) {
+		newVal, ok := fn(old)
+		if !ok {
+			return old, ErrConditionFailed
+		}
+		return newVal, nil
+	})
+}
+
+/*
+ * CompareAndSwap 仅当当前值等于 old 时写入 newVal（字段不存在视为零值）
+ * 当前值不等于 old 时返回 ErrConditionFailed
+ */
+func (f Field[T]) CompareAndSwap(userID UserID, old, newVal T) error {
+	return mutateField(f, userID, func(_ *PlayerData, cur T, _ bool) (T, error) {
+		if !reflect.DeepEqual(cur, old) {
+			return cur, ErrConditionFailed
+		}
+		return newVal, nil
+	})
+}
+
+/*
+ * IncreaseIf 仅当 cond(current) 返回 true 时增加 amount，字段不存在视为零值
+ * cond 拒绝时返回 ErrConditionFailed
+ */
+func IncreaseIf[T Number](f Field[T], userID UserID, amount T, cond func(current T) bool) error {
+	return mutateField(f, userID, func(_ *PlayerData, old T, _ bool) (T, error) {
+		if !cond(old) {
+			return old, ErrConditionFailed
+		}
+		return old + amount, nil
+	})
+}
+
+/*
+ * DecreaseIfEnough 仅当字段存在且当前值 >= amount 时扣减
+ * 余额不足（含字段不存在）时返回 ErrInsufficient
+ */
+func DecreaseIfEnough[T Number](f Field[T], userID UserID, amount T) error {
+	return mutateField(f, userID, func(_ *PlayerData, old T, exists bool) (T, error) {
+		if !exists || old < amount {
+			return old, ErrInsufficient
+		}
+		return old - amount, nil
+	})
+}
+
+/*
+ * mutateField 所有字段级修改的统一入口
+ * 在持有 PlayerData 写锁的情况下读取旧值的副本并交给 fn 计算新值，
+ * fn 返回错误时不写入；新值经 Schema 校验后写入并刷新 UpdateTime，修改事件在写锁内入队，释放写锁后同步投递
+ */
+func mutateField[T any](f Field[T], userID UserID,
+	fn func(pd *PlayerData, old T, exists bool) (T, error)) error {
+
+	s := f.storeOf()
+	h := s.h
+	var pending pendingEvents
+	defer func() { pending.deliver() }()
+
+	pd, err := s.lockResident(f.cycle, f.typeKey, userID)
+	if err != nil {
+		return err
+	}
+	defer pd.mu.Unlock()
+
+	var old T
+	raw, exists := pd.MiscData[f.key]
+	if exists {
+		val, ok := coerce[T](raw)
+		if !ok {
+			return typeMismatch(f.key, raw, old)
+		}
+		// fn 可能原地修改 slice/map，交给它一份副本，失败或校验不通过时原值保持不变
+		old, _ = cloneValue(val).(T)
+	}
+
+	newVal, err := fn(pd, old, exists)
+	if err != nil {
+		return err
+	}
+
+	var val interface{} = newVal
+	if f.keepType && exists {
+		var ok bool
+		if val, ok = asStoredType(raw, newVal); !ok {
+			return typeMismatch(f.key, newVal, raw)
+		}
+	}
+	stored, err := validateField(f.cycle, f.typeKey, f.key, val)
+	if err != nil {
+		return err
+	}
+
+	if pd.MiscData == nil {
+		pd.MiscData = make(map[string]interface{})
+	}
+	pd.MiscData[f.key] = stored
+	pd.UpdateTime = time.Now()
+	pd.markDirtyLocked()
+	h.logMutationLocked(f.cycle, f.typeKey, pd)
+	if h.events.watched(f.cycle, f.typeKey) {
+		// raw 已被替换且没有被修改过，可以直接作为旧值
+		pending = h.events.publishLocked([]Event{{Cycle: f.cycle, TypeKey: f.typeKey, UserID: userID, Key: f.key,
+			Old: raw, New: cloneValue(stored), Op: OpField, Time: pd.UpdateTime}})
+	}
+	return nil
+}
+
+/*
+ * asStoredType 将新值转换为 raw 的数值类型，raw 不是数值时原样返回
+ */
+func asStoredType(raw, val interface{}) (interface{}, bool) {
+	switch raw.(type) {
+	case int:
+		return toInt(val)
+	case int32:
+		return toInt32(val)
+	case int64:
+		return toInt64(val)
+	case float64:
+		return toFloat64(val)
+	}
+	return val, true
+}
+
+/*
+ * coerce 将 MiscData 中的原始值转换为 T
+ * 数值类型经 toInt/toInt32/toInt64/toFloat64 无损转换，溢出或丢弃小数时返回 false；
+ * []int32 与 map[int32]int32 走 util.go 中的转换函数，其余类型要求精确匹配
+ */
+func coerce[T any](raw interface{}) (T, bool) {
+	var zero T
+	if raw == nil {
+		return zero, true
+	}
+	if val, ok := raw.(T); ok {
+		return val, true
+	}
+
+	var (
+		out interface{}
+		ok  bool
+	)
+	switch any(zero).(type) {
+	case int:
+		out, ok = toInt(raw)
+	case int32:
+		out, ok = toInt32(raw)
+	case int64:
+		out, ok = toInt64(raw)
+	case float64:
+		out, ok = toFloat64(raw)
+	case []int32:
+		out, ok = toInt32Slice(raw)
+	case map[int32]int32:
+		out, ok = toInt32Map(raw)
+	}
+	if !ok {
+		return zero, false
+	}
+	return out.(T), true
+}
@@ -4,6 +4,8 @@
  */
 package cycledata
 
+import "context"
+
 /*
  * GetData 获取指定周期、类型和玩家ID对应的数据
  * 返回值：
@@ -12,17 +14,83 @@ package cycledata
  */
 
 func GetData(cycle CycleType, typeKey TypeKey, userID UserID) *PlayerData {
-	return globalHandler.
+	return defaultStore.GetData(cycle, typeKey, userID)
+}
+
+/*
+ * GetData 获取实例中指定周期、类型和玩家ID对应的数据
+ */
+func (s *Store) GetData(cycle CycleType, typeKey TypeKey, userID UserID) *PlayerData {
+	return s.h.
 		getService(cycle, DefaultExpireFor(cycle, typeKey)).
 		getCollection(typeKey).
 		get(cycle, typeKey, userID)
 }
 
-func GetDataValue(cycle CycleType, typeKey TypeKey, userID UserID) map[string]interface{} {
-	pb := globalHandler.
+/*
+ * GetDataErr 同 GetData，失败时返回具体原因
+ *   - ErrNoCreator: 未注册加载器和创建器
+ *   - ErrNilData: 加载器/创建器均返回 nil
+ */
+func GetDataErr(cycle CycleType, typeKey TypeKey, userID UserID) (*PlayerData, error) {
+	return defaultStore.GetDataErr(cycle, typeKey, userID)
+}
+
+/*
+ * GetDataErr 同 Store.GetData，失败时返回具体原因
+ */
+func (s *Store) GetDataErr(cycle CycleType, typeKey TypeKey, userID UserID) (*PlayerData, error) {
+	return s.h.
 		getService(cycle, DefaultExpireFor(cycle, typeKey)).
 		getCollection(typeKey).
-		get(cycle, typeKey, userID)
+		getErr(cycle, typeKey, userID)
+}
+
+/*
+ * lockResident 获取记录并加写锁，返回时记录仍在集合中（调用方负责解锁）
+ * 获取与加锁之间记录可能被刷新、淘汰移出集合，修改写到已移出的记录上会丢失，此时重新获取
+ */
+func (s *Store) lockResident(cycle CycleType, typeKey TypeKey, userID UserID) (*PlayerData, error) {
+	for {
+		pd, err := s.GetDataErr(cycle, typeKey, userID)
+		if err != nil {
+			return nil, err
+		}
+		pd.mu.Lock()
+		if pd.owner != nil {
+			return pd, nil
+		}
+		pd.mu.Unlock()
+	}
+}
+
+/*
+ * GetDataCtx 同 GetDataErr，ctx 传递给加载器/创建器，等待其他请求的加载时也受 ctx 控制
+ *   - ErrLoadFailed: 加载器/创建器返回错误（含 ctx 超时/取消）或 panic
+ */
+func GetDataCtx(ctx context.Context, cycle CycleType, typeKey TypeKey, userID UserID) (*PlayerData, error) {
+	return defaultStore.GetDataCtx(ctx, cycle, typeKey, userID)
+}
+
+/*
+ * GetDataCtx 同 Store.GetDataErr，支持 context
+ */
+func (s *Store) GetDataCtx(ctx context.Context, cycle CycleType, typeKey TypeKey, userID UserID) (*PlayerData, error) {
+	return s.h.
+		getService(cycle, DefaultExpireFor(cycle, typeKey)).
+		getCollection(typeKey).
+		getCtx(ctx, cycle, typeKey, userID)
+}
+
+func GetDataValue(cycle CycleType, typeKey TypeKey, userID UserID) map[string]interface{} {
+	return defaultStore.GetDataValue(cycle, typeKey, userID)
+}
+
+/*
+ * GetDataValue 获取实例中玩家 MiscData 的副本
+ */
+func (s *Store) GetDataValue(cycle CycleType, typeKey TypeKey, userID UserID) map[string]interface{} {
+	pb := s.GetData(cycle, typeKey, userID)
 	if pb == nil || pb.MiscData == nil {
 		return make(map[string]interface{}) // return empty map if nil
 	}
@@ -0,0 +1,144 @@
+/*
+ * 常驻数据的遍历与查询
+ *
+ * 模块用途：
+ *   GM 工具、运营脚本需要查询"哪些玩家的数据当前在内存中"或对某类数据逐条执行操作：
+ *   - Keys / Count:       常驻玩家列表（升序）与数量（Count 不检查过期，开销为 O(1)）
+ *   - ForEach:            逐条遍历，fn 返回 false 时停止
+ *   - ForEachWhere:       只遍历 MiscData 满足 pred 的记录
+ *
+ *   遍历开始时在集合读锁下复制一份记录指针后立即释放集合锁，之后逐条持有记录读锁调用 pred / fn，
+ *   遍历期间其他协程可以正常加载、修改、淘汰数据：遍历开始后新加载的记录不会出现，
+ *   已过期（含 LoopTime 上一轮）的记录会被跳过。
+ *   fn 执行时持有该记录的读锁，不能在 fn 中修改同一记录（会死锁），需要修改时先收集 UserID 再调用修改函数。
+ *
+ * 示例：
+ *   var vip []UserID
+ *   cycledata.ForEachWhere(DailyCycle, TypeKey(1), func(misc map[string]interface{}) bool {
+ *       level, _ := misc["vip"].(int32)
+ *       return level >= 3
+ *   }, func(data *cycledata.PlayerData) bool {
+ *       vip = append(vip, data.UserID)
+ *       return true
+ *   })
+ */
+package cycledata
+
+import (
+	"sort"
+	"time"
+)
+
+/*
+ * Keys 默认实例中 (cycle, typeKey) 常驻内存的玩家（升序）
+ */
+func Keys(cycle CycleType, typeKey TypeKey) []UserID {
+	return defaultStore.Keys(cycle, typeKey)
+}
+
+/*
+ * Keys 实例中 (cycle, typeKey) 常驻内存的玩家（升序），不含已过期的记录
+ */
+func (s *Store) Keys(cycle CycleType, typeKey TypeKey) []UserID {
+	var keys []UserID
+	s.ForEach(cycle, typeKey, func(data *PlayerData) bool {
+		keys = append(keys, data.UserID)
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+/*
+ * Count 默认实例中 (cycle, typeKey) 常驻内存的记录数
+ */
+func Count(cycle CycleType, typeKey TypeKey) int {
+	return defaultStore.Count(cycle, typeKey)
+}
+
+/*
+ * Count 实例中 (cycle, typeKey) 常驻内存的记录数
+ * 只在集合读锁下读取记录数，不逐条检查，已过期但尚未清理的记录也会计入
+ */
+func (s *Store) Count(cycle CycleType, typeKey TypeKey) int {
+	col := s.h.findCollection(cycle, typeKey)
+	if col == nil {
+		return 0
+	}
+
+	col.mu.RLock()
+	defer col.mu.RUnlock()
+	return len(col.data)
+}
+
+/*
+ * ForEach 遍历默认实例中 (cycle, typeKey) 常驻内存的记录
+ */
+func ForEach(cycle CycleType, typeKey TypeKey, fn func(data *PlayerData) bool) {
+	defaultStore.ForEach(cycle, typeKey, fn)
+}
+
+/*
+ * ForEach 遍历实例中 (cycle, typeKey) 常驻内存的记录，fn 返回 false 时停止
+ * fn 执行时持有记录读锁，不能修改该记录
+ */
+func (s *Store) ForEach(cycle CycleType, typeKey TypeKey, fn func(data *PlayerData) bool) {
+	s.ForEachWhere(cycle, typeKey, nil, fn)
+}
+
+/*
+ * ForEachWhere 遍历默认实例中 MiscData 满足 pred 的记录
+ */
+func ForEachWhere(cycle CycleType, typeKey TypeKey, pred func(misc map[string]interface{}) bool, fn func(data *PlayerData) bool) {
+	defaultStore.ForEachWhere(cycle, typeKey, pred, fn)
+}
+
+/*
+ * ForEachWhere 遍历实例中 MiscData 满足 pred 的记录，pred 为 nil 时遍历全部，fn 返回 false 时停止
+ * pred 和 fn 在同一次记录读锁内执行，判断和处理看到的是同一份数据
+ */
+func (s *Store) ForEachWhere(cycle CycleType, typeKey TypeKey, pred func(misc map[string]interface{}) bool, fn func(data *PlayerData) bool) {
+	col := s.h.findCollection(cycle, typeKey)
+	if col == nil {
+		return
+	}
+
+	now := time.Now().Unix()
+	for _, data := range col.residents() {
+		if !visit(cycle, typeKey, data, now, pred, fn) {
+			return
+		}
+	}
+}
+
+/*
+ * residents 在集合读锁下复制全部记录指针
+ */
+func (dc *dataCollection) residents() []*PlayerData {
+	dc.mu.RLock()
+	defer dc.mu.RUnlock()
+
+	records := make([]*PlayerData, 0, len(dc.data))
+	for _, data := range dc.data {
+		records = append(records, data)
+	}
+	return records
+}
+
+/*
+ * visit 持有记录读锁，跳过已过期和不满足 pred 的记录后调用 fn，返回是否继续遍历
+ */
+func visit(cycle CycleType, typeKey TypeKey, data *PlayerData, now int64,
+	pred func(misc map[string]interface{}) bool, fn func(data *PlayerData) bool) bool {
+
+	data.mu.RLock()
+	defer data.mu.RUnlock()
+
+	if isStale(cycle, typeKey, data, now) {
+		return true
+	}
+	if pred != nil && !pred(data.MiscData) {
+		return true
+	}
+	return fn(data)
+}
@@ -0,0 +1,198 @@
+/*
+ * LoopTime 循环周期
+ *
+ * 模块用途：
+ *   按 TypeKey 配置 LoopTime 数据的循环规则，两种方式二选一：
+ *   - 按时间循环：RegisterLoopCycle(typeKey, anchor, period)，从 anchor 开始每隔 period 重置一次（如每 3 天）
+ *   - 按次数循环：RegisterLoopCounter(typeKey, period, count)，每调用 AdvanceLoop 累计 period 次重置一次（如每 10 局）
+ *
+ *   记录创建/加载时自动填充 Loop（当前循环序号）和 ExpireTime（按时间循环的下一次重置时间），
+ *   到达边界时所有已启动的 Store 自动执行过期清理（过期处理函数 -> 存储器 -> 移出内存），
+ *   下次访问时由创建器构造新一轮的记录。存储器需要一并持久化 Loop 和 ExpireTime。
+ *
+ * 示例：
+ *   RegisterLoopCycle(TypeKey(1), time.Date(2025, 1, 1, 5, 0, 0, 0, time.Local), 72*time.Hour)
+ *   RegisterLoopCounter(TypeKey(2), 10, savedMatchCount)
+ *   idx, _ := AdvanceLoop(TypeKey(2), 1) // 每局结束调用
+ */
+package cycledata
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+ * loopCycle 单个 TypeKey 的循环规则
+ */
+type loopCycle struct {
+	// 按时间循环
+	anchor time.Time
+	period time.Duration
+	timer  *time.Timer
+
+	// 按次数循环
+	countPeriod int64
+	count       int64
+}
+
+var (
+	// loopCycles 类型 -> 循环规则
+	loopCycles = make(map[TypeKey]*loopCycle)
+
+	// loopMu 保护 loopCycles 的并发访问（每次访问记录都会读取，读多写少）
+	loopMu sync.RWMutex
+)
+
+/*
+ * RegisterLoopCycle 注册按时间循环的 LoopTime 类型
+ * anchor 为第 0 轮的开始时间，period 为每轮时长（按秒取整，至少 1 秒）；重复注册会替换旧规则
+ */
+func RegisterLoopCycle(typeKey TypeKey, anchor time.Time, period time.Duration) {
+	if period < time.Second {
+		period = time.Second
+	}
+	loop := &loopCycle{anchor: anchor, period: period.Truncate(time.Second)}
+
+	loopMu.Lock()
+	defer loopMu.Unlock()
+
+	stopLoopLocked(typeKey)
+	loopCycles[typeKey] = loop
+	scheduleLoopLocked(typeKey, loop, time.Now())
+}
+
+/*
+ * RegisterLoopCounter 注册按次数循环的 LoopTime 类型
+ * 每累计 period 次 AdvanceLoop 进入下一轮；count 为当前已累计的次数（用于重启后恢复进度）
+ */
+func RegisterLoopCounter(typeKey TypeKey, period int64, count int64) {
+	if period <= 0 {
+		period = 1
+	}
+
+	loopMu.Lock()
+	defer loopMu.Unlock()
+
+	stopLoopLocked(typeKey)
+	loopCycles[typeKey] = &loopCycle{countPeriod: period, count: count}
+}
+
+/*
+ * AdvanceLoop 按次数循环的类型累计 n 次，返回当前循环序号
+ * 进入新一轮时，所有已启动 Store 中上一轮的记录立即过期
+ */
+func AdvanceLoop(typeKey TypeKey, n int64) (int64, error) {
+	loopMu.Lock()
+	loop, ok := loopCycles[typeKey]
+	if !ok || loop.countPeriod == 0 {
+		loopMu.Unlock()
+		return 0, ErrNoLoopCycle
+	}
+	prev := loop.count / loop.countPeriod
+	loop.count += n
+	index := loop.count / loop.countPeriod
+	loopMu.Unlock()
+
+	if index != prev {
+		log.Printf("LoopTime type %v advanced to loop %d", typeKey, index)
+		rolloverType(LoopTime, typeKey, time.Now())
+	}
+	return index, nil
+}
+
+/*
+ * LoopIndex 获取当前循环序号和下一次重置时间（按次数循环的 next 为零值）
+ */
+func LoopIndex(typeKey TypeKey, now time.Time) (index int64, next time.Time, err error) {
+	loopMu.RLock()
+	defer loopMu.RUnlock()
+
+	loop, ok := loopCycles[typeKey]
+	if !ok {
+		return 0, time.Time{}, ErrNoLoopCycle
+	}
+	index, next = loop.at(now)
+	return index, next, nil
+}
+
+/*
+ * at 计算 now 所在的循环序号和下一次重置时间
+ */
+func (l *loopCycle) at(now time.Time) (int64, time.Time) {
+	if l.countPeriod > 0 {
+		return l.count / l.countPeriod, time.Time{}
+	}
+
+	elapsed := now.Sub(l.anchor)
+	index := int64(elapsed / l.period)
+	if elapsed < 0 && elapsed%l.period != 0 {
+		index-- // anchor 之前向下取整
+	}
+	return index, l.anchor.Add(time.Duration(index+1) * l.period)
+}
+
+/*
+ * scheduleLoopLocked 在下一次重置时间触发过期清理，并安排再下一次（调用方需持有 loopMu）
+ */
+func scheduleLoopLocked(typeKey TypeKey, loop *loopCycle, now time.Time) {
+	_, next := loop.at(now)
+	loop.timer = time.AfterFunc(next.Sub(now), func() {
+		t := time.Now()
+		rolloverType(LoopTime, typeKey, t)
+
+		loopMu.Lock()
+		defer loopMu.Unlock()
+		if loopCycles[typeKey] == loop {
+			scheduleLoopLocked(typeKey, loop, t)
+		}
+	})
+}
+
+/*
+ * stopLoopLocked 停止旧规则的定时器（调用方需持有 loopMu）
+ */
+func stopLoopLocked(typeKey TypeKey) {
+	if old, ok := loopCycles[typeKey]; ok && old.timer != nil {
+		old.timer.Stop()
+	}
+}
+
+/*
+ * fillLoop 为 LoopTime 记录填充循环序号和过期时间，返回是否已注册循环规则
+ * 加载的记录在此之前已由 isStale 检查过循环序号，上一轮的记录不会走到这里
+ */
+func fillLoop(typeKey TypeKey, data *PlayerData, now time.Time) bool {
+	loopMu.RLock()
+	loop, ok := loopCycles[typeKey]
+	if !ok {
+		loopMu.RUnlock()
+		return false
+	}
+	// 与 loopStale 一样按秒计算，避免刚创建的记录在同一秒内被判定为上一轮
+	index, next := loop.at(time.Unix(now.Unix(), 0))
+	loopMu.RUnlock()
+
+	data.Loop = index
+	if data.ExpireTime == 0 && !next.IsZero() {
+		data.ExpireTime = next.Unix()
+	}
+	return true
+}
+
+/*
+ * loopStale 记录的循环序号是否与当前轮次不同（按时间和按次数循环都适用）
+ * 加载器返回的上一轮记录即使 ExpireTime 未设置或仍在未来，也按过期处理
+ */
+func loopStale(typeKey TypeKey, data *PlayerData, now int64) bool {
+	loopMu.RLock()
+	defer loopMu.RUnlock()
+
+	loop, ok := loopCycles[typeKey]
+	if !ok {
+		return false
+	}
+	index, _ := loop.at(time.Unix(now, 0))
+	return data.Loop != index
+}
@@ -0,0 +1,89 @@
+/*
+ * Newbie 新手周期
+ *
+ * 模块用途：
+ *   Newbie 数据的周期从每个玩家自己的注册时间开始，而不是全局边界：
+ *   - RegisterNewbieWindow(typeKey, resolver, window) 注册注册时间解析函数和新手期时长
+ *   - 记录创建/加载时 ExpireTime 自动填充为 注册时间 + window，每个玩家独立过期
+ *   - 过期记录在访问时立即处理，常驻的过期记录也会在冷数据淘汰时一并清理，
+ *     均通过 RegisterCleanExpired 注册的函数处理后写入存储器并移出内存
+ *   - 新手期已结束（或解析函数返回零值）的玩家不再加载/创建数据，返回 ErrNewbieEnded
+ *
+ * 示例：
+ *   RegisterNewbieWindow(TypeKey(1), func(uid UserID) time.Time {
+ *       return account.RegisterTime(uid)
+ *   }, 7*24*time.Hour)
+ */
+package cycledata
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+ * newbieWindow 新手期规则
+ */
+type newbieWindow struct {
+	resolve func(UserID) time.Time // 玩家注册时间
+	window  time.Duration          // 新手期时长
+}
+
+var (
+	// newbieWindows 类型 -> 新手期规则
+	newbieWindows = make(map[TypeKey]newbieWindow)
+
+	// newbieMu 保护 newbieWindows 的并发访问
+	newbieMu sync.RWMutex
+)
+
+/*
+ * RegisterNewbieWindow 注册 Newbie 类型的新手期：从 resolver 返回的注册时间开始，持续 window
+ */
+func RegisterNewbieWindow(typeKey TypeKey, resolver func(UserID) time.Time, window time.Duration) {
+	newbieMu.Lock()
+	defer newbieMu.Unlock()
+	newbieWindows[typeKey] = newbieWindow{resolve: resolver, window: window}
+}
+
+/*
+ * NewbieWindow 获取玩家新手期的开始和结束时间，未注册时 ok 为 false
+ */
+func NewbieWindow(typeKey TypeKey, userID UserID) (start, end time.Time, ok bool) {
+	newbieMu.RLock()
+	w, ok := newbieWindows[typeKey]
+	newbieMu.RUnlock()
+	if !ok || w.resolve == nil {
+		return time.Time{}, time.Time{}, false
+	}
+
+	start = w.resolve(userID)
+	if start.IsZero() {
+		return start, start, true
+	}
+	return start, start.Add(w.window), true
+}
+
+/*
+ * newbieEnded 玩家新手期已结束时返回 ErrNewbieEnded，未注册新手期规则的类型不受限制
+ */
+func newbieEnded(typeKey TypeKey, userID UserID, now time.Time) error {
+	_, end, ok := NewbieWindow(typeKey, userID)
+	if !ok || end.After(now) {
+		return nil
+	}
+	return fmt.Errorf("%w: uid %d, type %v, ended at %v", ErrNewbieEnded, userID, typeKey, end)
+}
+
+/*
+ * fillNewbie 为 Newbie 记录填充过期时间（已设置的保持不变）
+ */
+func fillNewbie(typeKey TypeKey, data *PlayerData) {
+	if data.ExpireTime != 0 {
+		return
+	}
+	if _, end, ok := NewbieWindow(typeKey, data.UserID); ok && !end.IsZero() {
+		data.ExpireTime = end.Unix()
+	}
+}
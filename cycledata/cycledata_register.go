@@ -1,5 +1,7 @@
 package cycledata
 
+import "context"
+
 /*
  * RegisterLoader
  * 注册数据加载器
@@ -42,6 +44,78 @@ func RegisterStorer(cycle CycleType, typeKey TypeKey,
 	stores[cycle][typeKey] = store
 }
 
+/*
+ * RegisterBatchStorer 注册批量存储函数
+ * Flush / FlushAll / 冷数据清理 / 过期清理时，脏数据按 batchSize 分批交给 store，
+ * 注册后优先于 RegisterStorer 注册的单条存储函数
+ *
+ * Parameters:
+ *   cycle - The cycle type (e.g., daily, weekly, monthly)
+ *   typeKey - The data type identifier
+ *   batchSize - 每批最多记录数，<= 0 时使用 DefaultBatchSize
+ *   store - 批量持久化函数，返回错误时整批视为失败
+ */
+func RegisterBatchStorer(cycle CycleType, typeKey TypeKey, batchSize int,
+	store func(cycle CycleType, typeKey TypeKey, batch []*PlayerData) error) {
+
+	RegisterBatchStorerCtx(cycle, typeKey, batchSize,
+		func(_ context.Context, cycle CycleType, typeKey TypeKey, batch []*PlayerData) error {
+			return store(cycle, typeKey, batch)
+		})
+}
+
+/*
+ * RegisterBatchStorerCtx 同 RegisterBatchStorer，store 接收 FlushCtx / Stop 等入口传入的 ctx
+ */
+func RegisterBatchStorerCtx(cycle CycleType, typeKey TypeKey, batchSize int,
+	store func(ctx context.Context, cycle CycleType, typeKey TypeKey, batch []*PlayerData) error) {
+
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	if _, ok := batchStores[cycle]; !ok {
+		batchStores[cycle] = make(map[TypeKey]batchStorer)
+	}
+	batchStores[cycle][typeKey] = batchStorer{store: store, size: batchSize}
+}
+
+/*
+ * RegisterLoaderCtx 注册支持 context 的数据加载器，优先于 RegisterLoader
+ * 返回错误时本次加载失败（不再尝试创建器），GetDataCtx 返回 ErrLoadFailed 并可用 errors.Is 匹配到原始错误
+ */
+func RegisterLoaderCtx(cycle CycleType, typeKey TypeKey,
+	loader func(ctx context.Context, cycle CycleType, typeKey TypeKey, userID UserID) (*PlayerData, error)) {
+
+	if _, ok := loaderCtxs[cycle]; !ok {
+		loaderCtxs[cycle] = make(map[TypeKey]func(context.Context, CycleType, TypeKey, UserID) (*PlayerData, error))
+	}
+	loaderCtxs[cycle][typeKey] = loader
+}
+
+/*
+ * RegisterCreatorCtx 注册支持 context 的数据创建器，优先于 RegisterCreator
+ */
+func RegisterCreatorCtx(cycle CycleType, typeKey TypeKey,
+	creator func(ctx context.Context, userID UserID) (*PlayerData, error)) {
+
+	if _, ok := creatorCtxs[cycle]; !ok {
+		creatorCtxs[cycle] = make(map[TypeKey]func(context.Context, UserID) (*PlayerData, error))
+	}
+	creatorCtxs[cycle][typeKey] = creator
+}
+
+/*
+ * RegisterStorerCtx 注册支持 context 的单条存储函数，优先于 RegisterStorer
+ */
+func RegisterStorerCtx(cycle CycleType, typeKey TypeKey,
+	store func(ctx context.Context, cycle CycleType, typeKey TypeKey, data *PlayerData) error) {
+
+	if _, ok := storeCtxs[cycle]; !ok {
+		storeCtxs[cycle] = make(map[TypeKey]func(context.Context, CycleType, TypeKey, *PlayerData) error)
+	}
+	storeCtxs[cycle][typeKey] = store
+}
+
 /*
  * 注册自定义过期处理函数
  */
@@ -51,3 +125,29 @@ func RegisterCleanExpired(cycle CycleType, typeKey TypeKey, handler func(cycle C
 	}
 	cleanExpireds[cycle][typeKey] = handler
 }
+
+/*
+ * RegisterStoreFailure 注册存储失败死信处理函数
+ * 写入失败的记录按 RetryPolicy 指数退避重试，超过最大重试次数后调用 handler（例如落地到本地磁盘），
+ * handler 调用期间记录处于加锁状态，返回后记录视为已处理；未注册时记录保持脏状态，留在重试队列中按最大退避间隔继续重试
+ */
+func RegisterStoreFailure(cycle CycleType, typeKey TypeKey,
+	handler func(cycle CycleType, typeKey TypeKey, data *PlayerData, err error)) {
+
+	if _, ok := storeFailures[cycle]; !ok {
+		storeFailures[cycle] = make(map[TypeKey]func(CycleType, TypeKey, *PlayerData, error))
+	}
+	storeFailures[cycle][typeKey] = handler
+}
+
+/*
+ * RegisterCleanExpiredCtx 注册支持 context 的过期处理函数，优先于 RegisterCleanExpired
+ */
+func RegisterCleanExpiredCtx(cycle CycleType, typeKey TypeKey,
+	handler func(ctx context.Context, cycle CycleType, typeKey TypeKey, data *PlayerData)) {
+
+	if _, ok := cleanExpiredCtxs[cycle]; !ok {
+		cleanExpiredCtxs[cycle] = make(map[TypeKey]func(context.Context, CycleType, TypeKey, *PlayerData))
+	}
+	cleanExpiredCtxs[cycle][typeKey] = handler
+}
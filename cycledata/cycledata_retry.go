@@ -0,0 +1,431 @@
+/*
+ * 存储失败重试与死信处理
+ *
+ * 模块用途：
+ *   存储器返回错误时数据不再被丢弃：
+ *   - Flush / FlushAll / 冷数据清理中写入失败的记录继续常驻内存
+ *   - 所有写入失败的记录（包括已过期移出内存的记录）进入重试队列，按指数退避重试
+ *   - 超过最大重试次数后交给 RegisterStoreFailure 注册的死信函数（例如落地到本地磁盘），
+ *     死信处理后记录视为已处理，不再重试
+ *   - 未注册死信函数时记录不会被丢弃，继续留在重试队列中按最大退避间隔重试，直到写入成功
+ *
+ * 示例：
+ *   RegisterRetryPolicy(DailyCycle, TypeKey(1), RetryPolicy{MaxAttempts: 8, BaseDelay: time.Second, MaxDelay: time.Minute})
+ *   RegisterStoreFailure(DailyCycle, TypeKey(1), func(cycle CycleType, typeKey TypeKey, data *PlayerData, err error) {
+ *       spillToDisk(cycle, typeKey, data, err)
+ *   })
+ */
+package cycledata
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// retryCheckInterval 重试队列的扫描周期
+const retryCheckInterval = time.Second
+
+/*
+ * RetryPolicy 存储失败的重试策略
+ */
+type RetryPolicy struct {
+	MaxAttempts int           // 最大重试次数（不含首次写入），<= 0 表示不重试直接进入死信
+	BaseDelay   time.Duration // 首次重试的等待时长，之后每次翻倍
+	MaxDelay    time.Duration // 单次等待时长上限
+}
+
+// DefaultRetryPolicy 未注册重试策略时使用的默认策略
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   time.Second,
+	MaxDelay:    5 * time.Minute,
+}
+
+var (
+	// retryPolicies 周期 -> 类型 -> 重试策略
+	retryPolicies = make(map[CycleType]map[TypeKey]RetryPolicy)
+
+	// retryPolicyMu 保护 retryPolicies 的并发访问
+	retryPolicyMu sync.RWMutex
+)
+
+/*
+ * RegisterRetryPolicy 注册指定周期和类型的重试策略
+ */
+func RegisterRetryPolicy(cycle CycleType, typeKey TypeKey, policy RetryPolicy) {
+	retryPolicyMu.Lock()
+	defer retryPolicyMu.Unlock()
+
+	if _, ok := retryPolicies[cycle]; !ok {
+		retryPolicies[cycle] = make(map[TypeKey]RetryPolicy)
+	}
+	retryPolicies[cycle][typeKey] = policy
+}
+
+/*
+ * getRetryPolicy 获取重试策略，未注册返回 DefaultRetryPolicy
+ */
+func getRetryPolicy(cycle CycleType, typeKey TypeKey) RetryPolicy {
+	retryPolicyMu.RLock()
+	defer retryPolicyMu.RUnlock()
+
+	if m, ok := retryPolicies[cycle]; ok {
+		if policy, ok := m[typeKey]; ok {
+			return policy
+		}
+	}
+	return DefaultRetryPolicy
+}
+
+/*
+ * backoff 第 attempt 次重试前的等待时长
+ */
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+/*
+ * storeFailure 一次写入失败
+ */
+type storeFailure struct {
+	data *PlayerData
+	err  error
+}
+
+/*
+ * retryItem 重试队列中的记录
+ */
+type retryItem struct {
+	key       RecordKey
+	data      *PlayerData
+	attempts  int
+	nextAt    time.Time
+	lastErr   error
+	exhausted bool // 已超过最大重试次数、因未注册死信函数而继续重试
+}
+
+/*
+ * retryQueue 存储失败的重试队列
+ */
+type retryQueue struct {
+	mu    sync.Mutex
+	items map[RecordKey]*retryItem
+	h     *cycleHandler // 所属处理器，重试时合并冲突用
+}
+
+/*
+ * enqueue 写入失败的记录进入重试队列（同一记录只保留一项）
+ */
+func (q *retryQueue) enqueue(cycle CycleType, typeKey TypeKey, failures []storeFailure) {
+	if q == nil || len(failures) == 0 {
+		return
+	}
+	policy := getRetryPolicy(cycle, typeKey)
+	now := time.Now()
+
+	handler := getStoreFailure(cycle, typeKey)
+
+	var dead, exhausted []*retryItem
+	q.mu.Lock()
+	if q.items == nil {
+		q.items = make(map[RecordKey]*retryItem)
+	}
+	for _, f := range failures {
+		key := RecordKey{Cycle: cycle, TypeKey: typeKey, UserID: f.data.UserID}
+		item, ok := q.items[key]
+		if !ok || item.data != f.data {
+			item = &retryItem{key: key, data: f.data}
+			q.items[key] = item
+		}
+		item.lastErr = f.err
+		if item.attempts >= policy.MaxAttempts {
+			if handler != nil {
+				delete(q.items, key)
+				dead = append(dead, item)
+				continue
+			}
+			// 没有死信函数时不能丢弃数据，保持在队列中按最大退避继续重试
+			if !item.exhausted {
+				item.exhausted = true
+				exhausted = append(exhausted, item)
+			}
+			item.nextAt = now.Add(policy.backoff(item.attempts))
+			continue
+		}
+		item.attempts++
+		item.nextAt = now.Add(policy.backoff(item.attempts))
+	}
+	q.mu.Unlock()
+
+	for _, item := range exhausted {
+		log.Printf("Still failing to store data for uid %d, cycle %v, type %v after %d attempts, retrying every %v: %v",
+			item.key.UserID, item.key.Cycle, item.key.TypeKey, item.attempts, policy.backoff(item.attempts), item.lastErr)
+	}
+	for _, item := range dead {
+		deadLetter(item, handler)
+	}
+}
+
+/*
+ * count 队列中指定集合的记录数
+ */
+func (q *retryQueue) count(cycle CycleType, typeKey TypeKey) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for key := range q.items {
+		if key.Cycle == cycle && key.TypeKey == typeKey {
+			n++
+		}
+	}
+	return n
+}
+
+/*
+ * process 重试所有到期的记录
+ */
+func (q *retryQueue) process(ctx context.Context, now time.Time) {
+	due := make(map[collectionKey][]*PlayerData)
+	q.mu.Lock()
+	for key, item := range q.items {
+		if item.nextAt.After(now) {
+			continue
+		}
+		if !item.data.IsDirty() {
+			// 已被其他路径（Flush、写回）成功写入
+			delete(q.items, key)
+			continue
+		}
+		ck := collectionKey{cycle: key.Cycle, typeKey: key.TypeKey}
+		due[ck] = append(due[ck], item.data)
+	}
+	q.mu.Unlock()
+
+	for ck, records := range due {
+		_, failures := persist(ctx, q.h, ck.cycle, ck.typeKey, records)
+		q.resolve(ck, records, failures)
+		q.enqueue(ck.cycle, ck.typeKey, failures)
+	}
+}
+
+/*
+ * resolve 移除重试成功的记录
+ */
+func (q *retryQueue) resolve(ck collectionKey, records []*PlayerData, failures []storeFailure) {
+	failed := make(map[*PlayerData]bool, len(failures))
+	for _, f := range failures {
+		failed[f.data] = true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, data := range records {
+		if failed[data] {
+			continue
+		}
+		key := RecordKey{Cycle: ck.cycle, TypeKey: ck.typeKey, UserID: data.UserID}
+		if item, ok := q.items[key]; ok && item.data == data {
+			delete(q.items, key)
+		}
+	}
+}
+
+/*
+ * drain 立即重试队列中的全部记录（不等待退避），用于停止前的最后一次写入
+ */
+func (q *retryQueue) drain(ctx context.Context) {
+	q.mu.Lock()
+	for _, item := range q.items {
+		item.nextAt = time.Time{}
+	}
+	q.mu.Unlock()
+	q.process(ctx, time.Now())
+}
+
+/*
+ * deadLetter 超过最大重试次数，交给死信函数处理，之后记录视为已处理
+ * 只在注册了死信函数时调用，未注册时记录留在重试队列中（见 enqueue）
+ */
+func deadLetter(item *retryItem, handler func(cycle CycleType, typeKey TypeKey, data *PlayerData, err error)) {
+	item.data.mu.Lock()
+	defer item.data.mu.Unlock()
+	handler(item.key.Cycle, item.key.TypeKey, item.data, item.lastErr)
+	item.data.markCleanLocked()
+}
+
+/*
+ * retryLoop 周期性处理重试队列，stopCh 关闭后退出
+ */
+func (h *cycleHandler) retryLoop(stopCh <-chan struct{}, doneCh chan<- struct{}) {
+	defer close(doneCh)
+
+	ticker := time.NewTicker(retryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			h.retry.process(context.Background(), now)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+/*
+ * persist 将 records 中的脏数据按批写入存储器
+ * 版本冲突的记录重新加载并合并后再写入一次（见 cycledata_version.go），仍然失败的记入写入失败；
+ * 合并结果经 h 写入 WAL 并投递事件，h 为 nil 时跳过
+ */
+func persist(ctx context.Context, h *cycleHandler, cycle CycleType, typeKey TypeKey, records []*PlayerData) (int, []storeFailure) {
+	stored, failed, conflicts := persistOnce(ctx, cycle, typeKey, records)
+	if len(conflicts) == 0 {
+		return stored, failed
+	}
+
+	merged, unresolved := mergeConflicts(ctx, h, cycle, typeKey, conflicts)
+	failed = append(failed, unresolved...)
+	if len(merged) > 0 {
+		n, retryFailed, again := persistOnce(ctx, cycle, typeKey, merged)
+		stored += n
+		failed = append(append(failed, retryFailed...), again...)
+	}
+	return stored, failed
+}
+
+/*
+ * persistOnce 将 records 中的脏数据按批写入一次
+ *
+ * 1. 过滤出脏数据并按 UserID 排序（批内按此顺序获取 storeMu，避免并发写入之间死锁）
+ * 2. 按存储器的批大小分批，逐条在记录锁内复制后立即释放，存储器收到的是副本，写入期间记录可以继续读写
+ * 3. 写入成功的记录在记录锁内版本号加 1，写入期间未被再次修改的才清除脏标记；
+ *    返回写入成功的记录数、写入失败的记录和版本冲突的记录
+ * ctx 结束后剩余的批次不再调用存储器，直接以 ctx.Err() 记为失败
+ */
+func persistOnce(ctx context.Context, cycle CycleType, typeKey TypeKey, records []*PlayerData) (int, []storeFailure, []storeFailure) {
+	storer := getBatchStore(cycle, typeKey)
+	if storer.store == nil || len(records) == 0 {
+		return 0, nil, nil
+	}
+
+	dirty := make([]*PlayerData, 0, len(records))
+	for _, data := range records {
+		if data.IsDirty() {
+			dirty = append(dirty, data)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i].UserID < dirty[j].UserID })
+
+	var failed, conflicted []storeFailure
+	for start := 0; start < len(dirty); start += storer.size {
+		end := start + storer.size
+		if end > len(dirty) {
+			end = len(dirty)
+		}
+		batch := dirty[start:end]
+
+		if err := ctx.Err(); err != nil {
+			for _, data := range batch {
+				failed = append(failed, storeFailure{data: data, err: err})
+			}
+			continue
+		}
+
+		for _, data := range batch {
+			data.storeMu.Lock()
+		}
+		snaps := make([]storeSnapshot, len(batch))
+		copies := make([]*PlayerData, len(batch))
+		for i, data := range batch {
+			snaps[i] = snapshotForStore(data)
+			copies[i] = snaps[i].copy
+		}
+		err := storer.store(ctx, cycle, typeKey, copies)
+		conflicts := conflictsIn(err, copies)
+		for i, data := range batch {
+			if err == nil || (conflicts != nil && !conflicts[copies[i]]) {
+				data.mu.Lock()
+				data.storedLocked(snaps[i])
+				data.mu.Unlock()
+			}
+			data.storeMu.Unlock()
+		}
+		if conflicts != nil {
+			// 冲突按副本识别，转换回原记录交给合并
+			for i, data := range batch {
+				if conflicts[copies[i]] {
+					conflicts[data] = true
+				}
+			}
+		}
+
+		switch {
+		case conflicts != nil:
+			log.Printf("Version conflict storing %d of %d records, cycle %v, type %v", len(conflicts), len(batch), cycle, typeKey)
+			for _, data := range batch {
+				if conflicts[data] {
+					conflicted = append(conflicted, storeFailure{data: data, err: err})
+				}
+			}
+		case err != nil:
+			log.Printf("Failed to store %d records, cycle %v, type %v: %v", len(batch), cycle, typeKey, err)
+			for _, data := range batch {
+				failed = append(failed, storeFailure{data: data, err: err})
+			}
+		}
+	}
+	return len(dirty) - len(failed) - len(conflicted), failed, conflicted
+}
+
+/*
+ * storeSnapshot 交给存储器的记录副本，以及复制时记录的修改次数
+ */
+type storeSnapshot struct {
+	copy    *PlayerData
+	changes uint64
+}
+
+/*
+ * snapshotForStore 在记录锁内复制需要持久化的字段，MiscData 递归复制
+ */
+func snapshotForStore(data *PlayerData) storeSnapshot {
+	data.mu.RLock()
+	defer data.mu.RUnlock()
+	snap := storeSnapshot{
+		copy: &PlayerData{
+			UserID:     data.UserID,
+			UpdateTime: data.UpdateTime,
+			ExpireTime: data.ExpireTime,
+			Loop:       data.Loop,
+			Version:    data.Version,
+		},
+		changes: data.changes,
+	}
+	if data.MiscData != nil {
+		snap.copy.MiscData = cloneMiscData(data.MiscData)
+	}
+	return snap
+}
+
+/*
+ * storedLocked 副本写入成功后更新原记录（调用方需持有 pd.mu 写锁）
+ * 版本号以写入时为准加 1；写入期间被再次修改的记录保持为脏，留给下一次写入
+ */
+func (pd *PlayerData) storedLocked(snap storeSnapshot) {
+	if pd.Version == snap.copy.Version {
+		pd.Version++
+	}
+	if pd.changes == snap.changes {
+		pd.markCleanLocked()
+	}
+}
@@ -0,0 +1,173 @@
+/*
+ * 日/周/月周期自动轮换
+ *
+ * 模块用途：
+ *   DailyCycle、WeeklyCycle、MonthlyCycle 的数据与 timestate 的跨天/跨周/跨月边界自动关联：
+ *   - 加载器/创建器返回的记录未设置 ExpireTime 时，自动填充为
+ *     timestate.GetNextDayTimestamp / GetNextWeekTimestamp / GetNextMonthTimestamp
+ *   - 包初始化时订阅 timestate 的日/周/月回调，到达边界时对所有已启动的 Store 执行过期清理：
+ *     过期记录交给 RegisterCleanExpired 注册的函数，写入存储器后移出内存
+ *   - 下次访问时重新加载；加载器返回的已过期记录会被忽略，由创建器构造新周期的记录
+ *
+ *   timestate 未初始化（未调用 InitTimezoneTimer）时按本地时区计算边界，但不会触发回调，
+ *   需要自行调用 CleanExpiredDataByType。
+ */
+package cycledata
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cnbbin/go-cachedb/timestate"
+)
+
+// rolloverBoundaries 自动轮换的周期及其下一个边界（Unix 秒）
+var rolloverBoundaries = map[CycleType]func() int64{
+	DailyCycle:   timestate.GetNextDayTimestamp,
+	WeeklyCycle:  timestate.GetNextWeekTimestamp,
+	MonthlyCycle: timestate.GetNextMonthTimestamp,
+}
+
+var (
+	// runningStores 已启动的存储实例，跨周期边界时统一轮换
+	runningStores = make(map[*Store]struct{})
+
+	// runningMu 保护 runningStores 的并发访问
+	runningMu sync.Mutex
+)
+
+func init() {
+	timestate.RegisterDayCallback(func(t time.Time) { rollover(DailyCycle, t) })
+	timestate.RegisterWeekCallback(func(t time.Time) { rollover(WeeklyCycle, t) })
+	timestate.RegisterMonthCallback(func(t time.Time) { rollover(MonthlyCycle, t) })
+}
+
+/*
+ * rollover 对所有已启动的存储实例清理指定周期的过期数据
+ */
+func rollover(cycle CycleType, t time.Time) {
+	for _, s := range running() {
+		s.h.cleanExpiredAt(cycle, t.Unix())
+	}
+}
+
+/*
+ * rolloverType 对所有已启动的存储实例清理指定周期和类型的过期数据
+ */
+func rolloverType(cycle CycleType, typeKey TypeKey, t time.Time) {
+	for _, s := range running() {
+		if col := s.h.findCollection(cycle, typeKey); col != nil {
+			col.cleanExpired(t.Unix(), cycle, typeKey)
+		}
+	}
+}
+
+/*
+ * running 复制已启动的存储实例列表
+ */
+func running() []*Store {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+
+	stores := make([]*Store, 0, len(runningStores))
+	for s := range runningStores {
+		stores = append(stores, s)
+	}
+	return stores
+}
+
+/*
+ * setRunning 登记/注销已启动的存储实例
+ */
+func setRunning(s *Store, running bool) {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+
+	if running {
+		runningStores[s] = struct{}{}
+	} else {
+		delete(runningStores, s)
+	}
+}
+
+/*
+ * fillExpireTime 为自动轮换周期的记录填充过期时间（已设置的保持不变），
+ * LoopTime 同时填充循环序号，Newbie 按玩家注册时间计算，LimitTime 按活动窗口计算
+ */
+func fillExpireTime(cycle CycleType, typeKey TypeKey, data *PlayerData, now time.Time) {
+	switch cycle {
+	case LoopTime:
+		fillLoop(typeKey, data, now)
+		return
+	case Newbie:
+		fillNewbie(typeKey, data)
+		return
+	case LimitTime:
+		fillActivity(typeKey, data, now)
+		return
+	}
+	if data.ExpireTime != 0 {
+		return
+	}
+	if next, ok := nextBoundary(cycle, now); ok {
+		data.ExpireTime = next
+	}
+}
+
+/*
+ * nextBoundary 获取周期的下一个边界，优先使用 timestate，未初始化或已过时时按本地时区计算
+ */
+func nextBoundary(cycle CycleType, now time.Time) (int64, bool) {
+	fn, ok := rolloverBoundaries[cycle]
+	if !ok {
+		return 0, false
+	}
+	if next := fn(); next > now.Unix() {
+		return next, true
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch cycle {
+	case DailyCycle:
+		return today.AddDate(0, 0, 1).Unix(), true
+	case WeeklyCycle:
+		// 下一个周一
+		offset := (8 - int(today.Weekday())) % 7
+		if offset == 0 {
+			offset = 7
+		}
+		return today.AddDate(0, 0, offset).Unix(), true
+	default:
+		return time.Date(today.Year(), today.Month()+1, 1, 0, 0, 0, 0, today.Location()).Unix(), true
+	}
+}
+
+/*
+ * windowClosed 玩家当前不在数据周期内时返回对应错误（新手期已结束、活动未开放），此时不加载/创建数据
+ */
+func windowClosed(cycle CycleType, typeKey TypeKey, userID UserID, now time.Time) error {
+	switch cycle {
+	case Newbie:
+		return newbieEnded(typeKey, userID, now)
+	case LimitTime:
+		return activityInactive(typeKey, now)
+	}
+	return nil
+}
+
+/*
+ * isExpired 记录是否已过期（ExpireTime 为 0 表示永不过期）
+ */
+func (pd *PlayerData) isExpired(now int64) bool {
+	return pd.ExpireTime != 0 && pd.ExpireTime <= now
+}
+
+/*
+ * isStale 记录是否需要按过期处理：已过期，或属于 LoopTime 的上一轮
+ */
+func isStale(cycle CycleType, typeKey TypeKey, data *PlayerData, now int64) bool {
+	if data.isExpired(now) {
+		return true
+	}
+	return cycle == LoopTime && loopStale(typeKey, data, now)
+}
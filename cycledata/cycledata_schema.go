@@ -0,0 +1,315 @@
+/*
+ * MiscData 结构约束（Schema）
+ *
+ * 模块用途：
+ *   为 (CycleType, TypeKey) 声明 MiscData 允许的键、对应 Go 类型、默认值与取值范围，
+ *   SetData / UpdateIf / SetMiscDataMapCond 及 cond_* 系列写入前统一校验，
+ *   Creator 创建的新记录自动填充默认值。
+ *
+ * 特性：
+ *   - 未注册 Schema 的类型不做任何校验，保持原有行为
+ *   - 数值类型之间自动转换为声明类型（如 int 写入 int64 字段）
+ *   - 校验失败返回 *SchemaError（errors.Is(err, ErrSchemaViolation) 为 true）
+ *   - 按 (CycleType, TypeKey) 统计违规次数，便于监控
+ *
+ * 示例：
+ *   RegisterSchema(DailyCycle, TypeKey(1), Schema{
+ *       "coins":        SpecOf[int64](0).WithRange(0, 1e9),
+ *       "achievements": SpecOf[[]int32](nil),
+ *   })
+ */
+package cycledata
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrSchemaViolation 写入的数据不符合注册的 Schema
+var ErrSchemaViolation = errors.New("cycledata: schema violation")
+
+/*
+ * FieldSpec 单个字段的约束
+ */
+type FieldSpec struct {
+	Type     reflect.Type // 字段的 Go 类型
+	Default  interface{}  // 默认值，nil 表示不自动填充
+	Min, Max float64      // 数值范围（仅 HasRange 为 true 时生效）
+	HasRange bool
+}
+
+/*
+ * SpecOf 以默认值的类型声明字段
+ */
+func SpecOf[T any](def T) FieldSpec {
+	spec := FieldSpec{Type: reflect.TypeOf((*T)(nil)).Elem()}
+	rv := reflect.ValueOf(&def).Elem()
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return spec
+		}
+	}
+	spec.Default = def
+	return spec
+}
+
+/*
+ * WithRange 为数值字段附加闭区间 [min, max] 约束
+ */
+func (s FieldSpec) WithRange(min, max float64) FieldSpec {
+	s.Min, s.Max, s.HasRange = min, max, true
+	return s
+}
+
+/*
+ * Schema 键名 -> 字段约束，未声明的键不允许写入
+ */
+type Schema map[string]FieldSpec
+
+/*
+ * SchemaError 校验失败详情
+ */
+type SchemaError struct {
+	Cycle   CycleType
+	TypeKey TypeKey
+	Key     string
+	Value   interface{}
+	Reason  string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("cycledata: schema violation %s/%d key %q (%T): %s",
+		e.Cycle, e.TypeKey, e.Key, e.Value, e.Reason)
+}
+
+func (e *SchemaError) Unwrap() error { return ErrSchemaViolation }
+
+/*
+ * schemaEntry 注册的 Schema 及其违规计数
+ */
+type schemaEntry struct {
+	schema     Schema
+	violations atomic.Uint64
+}
+
+var (
+	// schemaRegistry 周期 -> 类型 -> Schema
+	schemaRegistry = make(map[CycleType]map[TypeKey]*schemaEntry)
+
+	// schemaMu 保护 schemaRegistry 的并发访问
+	schemaMu sync.RWMutex
+)
+
+/*
+ * RegisterSchema 注册 (cycle, typeKey) 的 MiscData 结构约束
+ * 重复注册会覆盖旧 Schema 并清零违规计数
+ */
+func RegisterSchema(cycle CycleType, typeKey TypeKey, schema Schema) {
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+
+	if _, ok := schemaRegistry[cycle]; !ok {
+		schemaRegistry[cycle] = make(map[TypeKey]*schemaEntry)
+	}
+	// 复制一份，注册后调用方再修改 schema 不影响校验
+	copied := make(Schema, len(schema))
+	for key, spec := range schema {
+		copied[key] = spec
+	}
+	schemaRegistry[cycle][typeKey] = &schemaEntry{schema: copied}
+}
+
+/*
+ * SchemaViolations 获取 (cycle, typeKey) 累计的校验失败次数
+ */
+func SchemaViolations(cycle CycleType, typeKey TypeKey) uint64 {
+	if entry := getSchema(cycle, typeKey); entry != nil {
+		return entry.violations.Load()
+	}
+	return 0
+}
+
+/*
+ * getSchema 获取已注册的 Schema，未注册返回 nil
+ */
+func getSchema(cycle CycleType, typeKey TypeKey) *schemaEntry {
+	schemaMu.RLock()
+	defer schemaMu.RUnlock()
+
+	if m, ok := schemaRegistry[cycle]; ok {
+		return m[typeKey]
+	}
+	return nil
+}
+
+/*
+ * validateField 校验单个字段，返回按声明类型转换后的值
+ */
+func validateField(cycle CycleType, typeKey TypeKey, key string, value interface{}) (interface{}, error) {
+	entry := getSchema(cycle, typeKey)
+	if entry == nil {
+		return value, nil
+	}
+	normalized, reason := entry.check(key, value)
+	if reason != "" {
+		return value, entry.violation(cycle, typeKey, key, value, reason)
+	}
+	return normalized, nil
+}
+
+/*
+ * validateMiscData 校验整份 MiscData，返回写入转换后的值并填充缺失字段默认值的新 map，m 本身不被修改
+ * m 为 nil 时返回 nil
+ */
+func validateMiscData(cycle CycleType, typeKey TypeKey, m map[string]interface{}) (map[string]interface{}, error) {
+	if m == nil {
+		return nil, nil
+	}
+	out := make(map[string]interface{}, len(m))
+	entry := getSchema(cycle, typeKey)
+	for key, value := range m {
+		if entry != nil {
+			normalized, reason := entry.check(key, value)
+			if reason != "" {
+				return nil, entry.violation(cycle, typeKey, key, value, reason)
+			}
+			value = normalized
+		}
+		out[key] = value
+	}
+	if entry != nil {
+		entry.fillDefaults(out)
+	}
+	return out, nil
+}
+
+/*
+ * applySchemaDefaults 为新创建的记录填充默认值
+ */
+func applySchemaDefaults(cycle CycleType, typeKey TypeKey, pd *PlayerData) {
+	entry := getSchema(cycle, typeKey)
+	if entry == nil || pd == nil {
+		return
+	}
+	if pd.MiscData == nil {
+		pd.MiscData = make(map[string]interface{})
+	}
+	entry.fillDefaults(pd.MiscData)
+}
+
+/*
+ * check 校验字段，返回转换后的值；reason 非空表示不合法
+ */
+func (e *schemaEntry) check(key string, value interface{}) (interface{}, string) {
+	spec, ok := e.schema[key]
+	if !ok {
+		return value, "undeclared key"
+	}
+	if value == nil || spec.Type == nil {
+		return value, ""
+	}
+
+	rv := reflect.ValueOf(value)
+	if spec.HasRange && isNumericKind(rv.Kind()) {
+		// 按原值检查范围，避免转换后的截断值恰好落在范围内
+		f := rv.Convert(reflect.TypeOf(float64(0))).Float()
+		if f < spec.Min || f > spec.Max {
+			return value, fmt.Sprintf("out of range [%v, %v]", spec.Min, spec.Max)
+		}
+	}
+
+	if rv.Type() != spec.Type {
+		if !isNumericKind(rv.Kind()) || !isNumericKind(spec.Type.Kind()) {
+			return value, fmt.Sprintf("want %s", spec.Type)
+		}
+		converted, ok := convertLossless(rv, spec.Type)
+		if !ok {
+			return value, fmt.Sprintf("%v does not fit in %s", value, spec.Type)
+		}
+		rv = converted
+	}
+	return rv.Interface(), ""
+}
+
+/*
+ * convertLossless 数值类型转换，溢出、截断小数或改变符号时返回 false
+ * 转换后再转回原类型与原值比较，不相等即有损
+ */
+func convertLossless(rv reflect.Value, t reflect.Type) (reflect.Value, bool) {
+	out := rv.Convert(t)
+	if out.Convert(rv.Type()).Interface() != rv.Interface() {
+		return reflect.Value{}, false
+	}
+	// -1 转为 uint64 再转回仍为 -1，符号需要单独检查
+	if isSignedKind(rv.Kind()) && isUnsignedKind(t.Kind()) && rv.Int() < 0 {
+		return reflect.Value{}, false
+	}
+	if isUnsignedKind(rv.Kind()) && isSignedKind(t.Kind()) && out.Int() < 0 {
+		return reflect.Value{}, false
+	}
+	return out, true
+}
+
+/*
+ * fillDefaults 为缺失字段填充默认值（引用类型会复制一份）
+ */
+func (e *schemaEntry) fillDefaults(m map[string]interface{}) {
+	for key, spec := range e.schema {
+		if spec.Default == nil {
+			continue
+		}
+		if _, ok := m[key]; !ok {
+			m[key] = cloneValue(spec.Default)
+		}
+	}
+}
+
+/*
+ * violation 记录一次违规并构造错误
+ */
+func (e *schemaEntry) violation(cycle CycleType, typeKey TypeKey, key string, value interface{}, reason string) error {
+	e.violations.Add(1)
+	err := &SchemaError{Cycle: cycle, TypeKey: typeKey, Key: key, Value: value, Reason: reason}
+	log.Printf("%v", err)
+	return err
+}
+
+/*
+ * isNumericKind 是否为数值类型
+ */
+func isNumericKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+/*
+ * isSignedKind 是否为有符号整数类型
+ */
+func isSignedKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+/*
+ * isUnsignedKind 是否为无符号整数类型
+ */
+func isUnsignedKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
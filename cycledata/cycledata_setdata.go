@@ -6,10 +6,38 @@ package cycledata
 import "time"
 
 func SetData(cycle CycleType, typeKey TypeKey, userID UserID, miscData map[string]interface{}) bool {
-	return globalHandler.
+	return defaultStore.SetData(cycle, typeKey, userID, miscData)
+}
+
+/*
+ * SetData 同 Store.SetDataErr，只返回是否成功
+ */
+func (s *Store) SetData(cycle CycleType, typeKey TypeKey, userID UserID, miscData map[string]interface{}) bool {
+	return s.SetDataErr(cycle, typeKey, userID, miscData) == nil
+}
+
+/*
+ * SetDataErr 同 SetData，失败时返回具体原因
+ *   - ErrSchemaViolation: 不符合注册的 Schema
+ *   - ErrNoCreator / ErrNilData: 数据不存在且无法通过创建器构造
+ */
+func SetDataErr(cycle CycleType, typeKey TypeKey, userID UserID, miscData map[string]interface{}) error {
+	return defaultStore.SetDataErr(cycle, typeKey, userID, miscData)
+}
+
+/*
+ * SetDataErr 覆盖实例中的玩家数据，失败原因同包级 SetDataErr
+ */
+func (s *Store) SetDataErr(cycle CycleType, typeKey TypeKey, userID UserID, miscData map[string]interface{}) error {
+	pending, err := s.h.
 		getService(cycle, DefaultExpireFor(cycle, typeKey)).
 		getCollection(typeKey).
-		set(cycle, typeKey, userID, miscData)
+		set(s.h, cycle, typeKey, userID, miscData)
+	if err != nil {
+		return err
+	}
+	pending.deliver()
+	return nil
 }
 
 /*
@@ -21,31 +49,41 @@ func SetData(cycle CycleType, typeKey TypeKey, userID UserID, miscData map[strin
  */
 func SetWithAllMiscData(cycle CycleType, typeKey TypeKey, userID UserID,
 	cond func(time.Time, map[string]interface{}) (bool, map[string]interface{}, bool)) bool {
+	return defaultStore.SetWithAllMiscData(cycle, typeKey, userID, cond)
+}
 
-	// 获取数据指针
-	pd := GetData(cycle, typeKey, userID)
-	if pd == nil {
-		return false
-	}
-
-	pd.mu.Lock()
-	defer pd.mu.Unlock()
-
-	// 直接使用原始数据，但通过闭包限制修改
-	success, newMiscData, changeTimeBool := cond(pd.UpdateTime, pd.MiscData)
-	if !success {
-		return false
-	}
+/*
+ * SetWithAllMiscData 在实例中按 cond 整体修改 MiscData，cond 决定是否刷新更新时间
+ */
+func (s *Store) SetWithAllMiscData(cycle CycleType, typeKey TypeKey, userID UserID,
+	cond func(time.Time, map[string]interface{}) (bool, map[string]interface{}, bool)) bool {
+	return s.SetWithAllMiscDataErr(cycle, typeKey, userID, cond) == nil
+}
 
-	// 检查新数据是否真的被修改了
-	if newMiscData != nil && &newMiscData != &pd.MiscData {
-		pd.MiscData = newMiscData
-	}
+/*
+ * SetWithAllMiscDataErr 同 SetWithAllMiscData，失败时返回具体原因
+ *   - ErrConditionFailed: cond 返回 false
+ *   - ErrSchemaViolation: 修改后的 MiscData 不符合注册的 Schema
+ * cond 收到的是 MiscData 的副本，失败时内存中的数据保持不变
+ */
+func SetWithAllMiscDataErr(cycle CycleType, typeKey TypeKey, userID UserID,
+	cond func(time.Time, map[string]interface{}) (bool, map[string]interface{}, bool)) error {
+	return defaultStore.SetWithAllMiscDataErr(cycle, typeKey, userID, cond)
+}
 
-	if changeTimeBool {
-		pd.UpdateTime = time.Now()
-	}
-	return true
+/*
+ * SetWithAllMiscDataErr 同 Store.SetWithAllMiscData，失败时返回具体原因
+ */
+func (s *Store) SetWithAllMiscDataErr(cycle CycleType, typeKey TypeKey, userID UserID,
+	cond func(time.Time, map[string]interface{}) (bool, map[string]interface{}, bool)) error {
+
+	return s.mutateMiscData(cycle, typeKey, userID, func(pd *PlayerData, misc map[string]interface{}) (map[string]interface{}, bool, error) {
+		success, newMiscData, changeTimeBool := cond(pd.UpdateTime, misc)
+		if !success {
+			return nil, false, ErrConditionFailed
+		}
+		return newMiscData, changeTimeBool, nil
+	})
 }
 
 /*
@@ -57,57 +95,131 @@ func SetWithAllMiscData(cycle CycleType, typeKey TypeKey, userID UserID,
  */
 func SetMiscDataMapCond(cycle CycleType, typeKey TypeKey, userID UserID,
 	cond func(map[string]interface{}) (bool, map[string]interface{})) bool {
+	return defaultStore.SetMiscDataMapCond(cycle, typeKey, userID, cond)
+}
 
-	// 获取数据指针
-	pd := GetData(cycle, typeKey, userID)
-	if pd == nil {
-		return false
-	}
-
-	pd.mu.Lock()
-	defer pd.mu.Unlock()
-
-	// 直接使用原始数据，但通过闭包限制修改
-	success, newMiscData := cond(pd.MiscData)
-	if !success {
-		return false
-	}
+/*
+ * SetMiscDataMapCond 在实例中按 cond 整体修改 MiscData 并刷新更新时间
+ */
+func (s *Store) SetMiscDataMapCond(cycle CycleType, typeKey TypeKey, userID UserID,
+	cond func(map[string]interface{}) (bool, map[string]interface{})) bool {
+	return s.SetMiscDataMapCondErr(cycle, typeKey, userID, cond) == nil
+}
 
-	// 检查新数据是否真的被修改了
-	if newMiscData != nil && &newMiscData != &pd.MiscData {
-		pd.MiscData = newMiscData
-	}
+/*
+ * SetMiscDataMapCondErr 同 SetMiscDataMapCond，失败原因同 SetWithAllMiscDataErr
+ */
+func SetMiscDataMapCondErr(cycle CycleType, typeKey TypeKey, userID UserID,
+	cond func(map[string]interface{}) (bool, map[string]interface{})) error {
+	return defaultStore.SetMiscDataMapCondErr(cycle, typeKey, userID, cond)
+}
 
-	pd.UpdateTime = time.Now()
-	return true
+/*
+ * SetMiscDataMapCondErr 同 Store.SetMiscDataMapCond，失败原因同 SetWithAllMiscDataErr
+ */
+func (s *Store) SetMiscDataMapCondErr(cycle CycleType, typeKey TypeKey, userID UserID,
+	cond func(map[string]interface{}) (bool, map[string]interface{})) error {
+
+	return s.mutateMiscData(cycle, typeKey, userID, func(_ *PlayerData, misc map[string]interface{}) (map[string]interface{}, bool, error) {
+		success, newMiscData := cond(misc)
+		if !success {
+			return nil, false, ErrConditionFailed
+		}
+		return newMiscData, true, nil
+	})
 }
 
 func SetMiscDataMapCondMapString(cycle CycleType, typeKey TypeKey, userID UserID, resultMap map[string]interface{},
 	cond func(map[string]interface{}, map[string]interface{}) (bool, map[string]interface{}, map[string]interface{})) (bool, map[string]interface{}) {
+	return defaultStore.SetMiscDataMapCondMapString(cycle, typeKey, userID, resultMap, cond)
+}
 
-	// 获取数据指针
-	pd := GetData(cycle, typeKey, userID)
-	if pd == nil {
-		return false, resultMap
-	}
+/*
+ * SetMiscDataMapCondMapString 同 Store.SetMiscDataMapCond，cond 可以通过 resultMap 带回自定义数据
+ */
+func (s *Store) SetMiscDataMapCondMapString(cycle CycleType, typeKey TypeKey, userID UserID, resultMap map[string]interface{},
+	cond func(map[string]interface{}, map[string]interface{}) (bool, map[string]interface{}, map[string]interface{})) (bool, map[string]interface{}) {
 
-	pd.mu.Lock()
-	defer pd.mu.Unlock()
+	resultMap, err := s.SetMiscDataMapCondMapStringErr(cycle, typeKey, userID, resultMap, cond)
+	return err == nil, resultMap
+}
+
+/*
+ * SetMiscDataMapCondMapStringErr 同 SetMiscDataMapCondMapString，失败原因同 SetWithAllMiscDataErr
+ * 失败时仍返回 cond 给出的 resultMap
+ */
+func SetMiscDataMapCondMapStringErr(cycle CycleType, typeKey TypeKey, userID UserID, resultMap map[string]interface{},
+	cond func(map[string]interface{}, map[string]interface{}) (bool, map[string]interface{}, map[string]interface{})) (map[string]interface{}, error) {
+	return defaultStore.SetMiscDataMapCondMapStringErr(cycle, typeKey, userID, resultMap, cond)
+}
 
-	// 直接使用原始数据，但通过闭包限制修改 通过resultMap带自己想要的数据
-	success, newMiscData, newResultMap := cond(pd.MiscData, resultMap)
-	if &newResultMap != &resultMap {
+/*
+ * SetMiscDataMapCondMapStringErr 同 Store.SetMiscDataMapCondMapString，失败原因同 SetWithAllMiscDataErr
+ */
+func (s *Store) SetMiscDataMapCondMapStringErr(cycle CycleType, typeKey TypeKey, userID UserID, resultMap map[string]interface{},
+	cond func(map[string]interface{}, map[string]interface{}) (bool, map[string]interface{}, map[string]interface{})) (map[string]interface{}, error) {
+
+	err := s.mutateMiscData(cycle, typeKey, userID, func(_ *PlayerData, misc map[string]interface{}) (map[string]interface{}, bool, error) {
+		// 通过resultMap带自己想要的数据
+		success, newMiscData, newResultMap := cond(misc, resultMap)
 		resultMap = newResultMap
+		if !success {
+			return nil, false, ErrConditionFailed
+		}
+		return newMiscData, true, nil
+	})
+	return resultMap, err
+}
+
+/*
+ * mutateMiscData 整份 MiscData 修改的统一入口
+ * 持有 PlayerData 写锁，把 MiscData 的副本交给 fn，fn 可以原地修改副本或返回新的 map（返回 nil 表示使用副本）；
+ * 结果经 Schema 校验后整体替换 MiscData 并标记为脏，touch 为 true 时刷新 UpdateTime。
+ * fn 返回错误或校验失败时不做任何修改
+ */
+func (s *Store) mutateMiscData(cycle CycleType, typeKey TypeKey, userID UserID,
+	fn func(pd *PlayerData, misc map[string]interface{}) (newMiscData map[string]interface{}, touch bool, err error)) error {
+
+	h := s.h
+	var pending pendingEvents
+	defer func() { pending.deliver() }()
+
+	pd, err := s.lockResident(cycle, typeKey, userID)
+	if err != nil {
+		return err
 	}
-	if !success {
-		return false, resultMap
+	defer pd.mu.Unlock()
+
+	working := cloneMiscData(pd.MiscData)
+	newMiscData, touch, err := fn(pd, working)
+	if err != nil {
+		return err
+	}
+	newMiscData, err = validateMiscData(cycle, typeKey, pickMiscData(newMiscData, working))
+	if err != nil {
+		return err
 	}
 
-	// 检查新数据是否真的被修改了
-	if newMiscData != nil && &newMiscData != &pd.MiscData {
-		pd.MiscData = newMiscData
+	var events []Event
+	if h.events.watched(cycle, typeKey) {
+		events = diffEvents(cycle, typeKey, userID, OpSetMiscData, pd.MiscData, newMiscData)
+	}
+	pd.MiscData = newMiscData
+	if touch {
+		pd.UpdateTime = time.Now()
 	}
+	pd.markDirtyLocked()
+	h.logMutationLocked(cycle, typeKey, pd)
+	pending = h.events.publishLocked(events)
+	return nil
+}
 
-	pd.UpdateTime = time.Now()
-	return true, resultMap
+/*
+ * pickMiscData 条件函数返回 nil 时表示原地修改，使用传给它的副本
+ */
+func pickMiscData(newMiscData, current map[string]interface{}) map[string]interface{} {
+	if newMiscData != nil {
+		return newMiscData
+	}
+	return current
 }
@@ -0,0 +1,248 @@
+/*
+ * 常驻数据快照（热启动）
+ *
+ * 模块用途：
+ *   发布重启后所有玩家的首次请求都会打到加载器，容易压垮数据库。
+ *   停服前调用 Snapshot 将常驻内存的全部 PlayerData 导出，启动后调用 Restore 预热：
+ *   - 格式为 JSON Lines：首行为带版本号的文件头，之后每行一条记录
+ *   - MiscData 的每个值都带类型标签（如 int32、[]int32、map[int32]int32），恢复后类型不变；
+ *     未登记的类型按 JSON 原样保存，恢复后为 json.Unmarshal 的默认类型
+ *   - 快照前先将脏数据写入存储器（不移出内存），快照中记录的是写入后的版本号，
+ *     避免恢复后以旧版本号重复写入而触发版本冲突；没有存储器或写入失败的记录仍记为脏数据，
+ *     恢复后由 Flush / 写回写入存储器
+ *   - 恢复时跳过已过期的记录，已常驻内存的玩家以内存中的为准
+ *
+ *   Snapshot 必须在 Stop 之前调用：Stop 刷新时会把全部记录移出内存，之后的快照为空。
+ *   快照与 Stop 之间不应再修改数据，否则这些修改会以更高的版本号写入存储器，恢复后的记录落后于存储器。
+ *
+ * 示例：
+ *   // 停服：先快照再 Stop
+ *   f, _ := os.Create("cycledata.snap")
+ *   _ = cycledata.Snapshot(f)
+ *   f.Close()
+ *   _ = cycledata.Default().Stop(ctx)
+ *
+ *   // 启动
+ *   if f, err := os.Open("cycledata.snap"); err == nil {
+ *       _ = cycledata.Restore(f)
+ *       f.Close()
+ *   }
+ */
+package cycledata
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+const (
+	// snapshotFormat 快照文件头中的格式标识
+	snapshotFormat = "cycledata-snapshot"
+
+	// snapshotVersion 当前快照格式版本，Restore 只接受不高于它的版本
+	snapshotVersion = 1
+)
+
+/*
+ * snapshotHeader 快照文件头
+ */
+type snapshotHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Created int64  `json:"created"`
+}
+
+/*
+ * snapshotRecord 快照中的一条记录
+ */
+type snapshotRecord struct {
+	Cycle      CycleType              `json:"cycle"`
+	TypeKey    TypeKey                `json:"type"`
+	UserID     UserID                 `json:"uid"`
+	UpdateTime time.Time              `json:"update"`
+	ExpireTime int64                  `json:"expire,omitempty"`
+	Loop       int64                  `json:"loop,omitempty"`
+	Version    int64                  `json:"version,omitempty"`
+	Dirty      bool                   `json:"dirty,omitempty"` // 尚未写入存储器
+	MiscData   map[string]taggedValue `json:"misc"`
+}
+
+/*
+ * Snapshot 将默认实例常驻内存的全部数据写入 w
+ */
+func Snapshot(w io.Writer) error {
+	return defaultStore.Snapshot(w)
+}
+
+/*
+ * Restore 从 r 读取快照并预热默认实例
+ */
+func Restore(r io.Reader) error {
+	return defaultStore.Restore(r)
+}
+
+/*
+ * Snapshot 将常驻内存的全部数据写入 w，需在 Stop 之前调用（Stop 后内存中已没有记录）
+ * 逐个集合复制记录列表，先将其中的脏数据写入存储器（写入失败的进入重试队列），再逐条编码；
+ * 编码单条记录时只持有该记录的读锁
+ */
+func (s *Store) Snapshot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(snapshotHeader{Format: snapshotFormat, Version: snapshotVersion, Created: time.Now().Unix()}); err != nil {
+		return err
+	}
+
+	var (
+		count int
+		err   error
+	)
+	s.h.eachCollection(func(cycle CycleType, typeKey TypeKey, col *dataCollection) {
+		if err != nil {
+			return
+		}
+		col.mu.RLock()
+		records := make([]*PlayerData, 0, len(col.data))
+		for _, data := range col.data {
+			records = append(records, data)
+		}
+		col.mu.RUnlock()
+
+		_, failed := persist(context.Background(), s.h, cycle, typeKey, records)
+		col.retry.enqueue(cycle, typeKey, failed)
+
+		for _, data := range records {
+			rec, encErr := newSnapshotRecord(cycle, typeKey, data)
+			if encErr == nil {
+				encErr = enc.Encode(rec)
+			}
+			if encErr != nil {
+				err = fmt.Errorf("snapshot uid %d, cycle %v, type %v: %w", data.UserID, cycle, typeKey, encErr)
+				return
+			}
+			count++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	log.Printf("Snapshot wrote %d records", count)
+	return nil
+}
+
+/*
+ * newSnapshotRecord 在记录读锁下复制记录内容
+ */
+func newSnapshotRecord(cycle CycleType, typeKey TypeKey, data *PlayerData) (*snapshotRecord, error) {
+	data.mu.RLock()
+	defer data.mu.RUnlock()
+	return snapshotRecordLocked(cycle, typeKey, data)
+}
+
+/*
+ * snapshotRecordLocked 复制记录内容（调用方需持有 data.mu）
+ */
+func snapshotRecordLocked(cycle CycleType, typeKey TypeKey, data *PlayerData) (*snapshotRecord, error) {
+	rec := &snapshotRecord{
+		Cycle:      cycle,
+		TypeKey:    typeKey,
+		UserID:     data.UserID,
+		UpdateTime: data.UpdateTime,
+		ExpireTime: data.ExpireTime,
+		Loop:       data.Loop,
+		Version:    data.Version,
+		Dirty:      data.dirty,
+		MiscData:   make(map[string]taggedValue, len(data.MiscData)),
+	}
+	for key, value := range data.MiscData {
+		tv, err := encodeValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", key, err)
+		}
+		rec.MiscData[key] = tv
+	}
+	return rec, nil
+}
+
+/*
+ * Restore 从 r 读取快照预热常驻数据
+ * 跳过已过期的记录和已常驻内存的玩家，快照时为脏数据的记录恢复后仍为脏数据；遇到格式错误时返回 ErrSnapshotFormat，此前恢复的记录保留
+ */
+func (s *Store) Restore(r io.Reader) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("%w: header: %w", ErrSnapshotFormat, err)
+	}
+	if header.Format != snapshotFormat || header.Version <= 0 || header.Version > snapshotVersion {
+		return fmt.Errorf("%w: format %q, version %d", ErrSnapshotFormat, header.Format, header.Version)
+	}
+
+	now := time.Now().Unix()
+	var restored, skipped int
+	for {
+		var rec snapshotRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("%w: record %d: %w", ErrSnapshotFormat, restored+skipped+1, err)
+		}
+
+		data, err := rec.playerData()
+		if err != nil {
+			return fmt.Errorf("%w: uid %d, cycle %v, type %v: %w", ErrSnapshotFormat, rec.UserID, rec.Cycle, rec.TypeKey, err)
+		}
+		if isStale(rec.Cycle, rec.TypeKey, data, now) {
+			skipped++
+			continue
+		}
+
+		col := s.h.getService(rec.Cycle, DefaultExpireFor(rec.Cycle, rec.TypeKey)).getCollection(rec.TypeKey)
+		col.mu.Lock()
+		if _, ok := col.data[data.UserID]; ok {
+			skipped++
+		} else {
+			data.touch()
+			col.putLocked(data)
+			restored++
+		}
+		col.mu.Unlock()
+	}
+
+	log.Printf("Restore loaded %d records, skipped %d", restored, skipped)
+	return nil
+}
+
+/*
+ * playerData 还原为 PlayerData，快照时为脏数据的记录保持脏标记
+ */
+func (rec *snapshotRecord) playerData() (*PlayerData, error) {
+	data := &PlayerData{
+		UserID:     rec.UserID,
+		UpdateTime: rec.UpdateTime,
+		ExpireTime: rec.ExpireTime,
+		Loop:       rec.Loop,
+		Version:    rec.Version,
+		MiscData:   make(map[string]interface{}, len(rec.MiscData)),
+	}
+	for key, tv := range rec.MiscData {
+		value, err := decodeValue(tv)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", key, err)
+		}
+		data.MiscData[key] = value
+	}
+	if rec.Dirty {
+		data.markDirtyLocked()
+	}
+	return data, nil
+}
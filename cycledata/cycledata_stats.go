@@ -0,0 +1,85 @@
+/*
+ * 数据集合统计
+ * 按 (CycleType, TypeKey) 统计常驻内存的记录数量，便于监控
+ */
+package cycledata
+
+import "time"
+
+/*
+ * CollectionStats 单个数据集合的统计信息
+ */
+type CollectionStats struct {
+	Resident int // 常驻内存的记录数
+	Dirty    int // 自上次持久化以来被修改的记录数
+	Clean    int // 未修改的记录数
+	Retrying int // 写入失败、等待重试的记录数（含已移出内存的过期记录）
+
+	DirtyLag time.Duration // 最早一条脏记录已等待写回的时长（写回延迟）
+}
+
+/*
+ * Stats 获取指定周期和类型的数据集合统计，集合不存在时返回零值
+ */
+func Stats(cycle CycleType, typeKey TypeKey) CollectionStats {
+	return defaultStore.Stats(cycle, typeKey)
+}
+
+/*
+ * Stats 获取实例中指定周期和类型的数据集合统计
+ */
+func (s *Store) Stats(cycle CycleType, typeKey TypeKey) CollectionStats {
+	col := s.h.findCollection(cycle, typeKey)
+	if col == nil {
+		return CollectionStats{}
+	}
+	st := col.stats()
+	st.Retrying = s.h.retry.count(cycle, typeKey)
+	return st
+}
+
+/*
+ * AllStats 获取所有数据集合的统计：周期 -> 类型 -> 统计
+ */
+func AllStats() map[CycleType]map[TypeKey]CollectionStats {
+	return defaultStore.AllStats()
+}
+
+/*
+ * AllStats 获取实例中所有数据集合的统计
+ */
+func (s *Store) AllStats() map[CycleType]map[TypeKey]CollectionStats {
+	result := make(map[CycleType]map[TypeKey]CollectionStats)
+	s.h.eachCollection(func(cycle CycleType, typeKey TypeKey, col *dataCollection) {
+		if _, ok := result[cycle]; !ok {
+			result[cycle] = make(map[TypeKey]CollectionStats)
+		}
+		st := col.stats()
+		st.Retrying = s.h.retry.count(cycle, typeKey)
+		result[cycle][typeKey] = st
+	})
+	return result
+}
+
+/*
+ * stats 统计集合内的脏/干净记录数
+ */
+func (dc *dataCollection) stats() CollectionStats {
+	dc.mu.RLock()
+	defer dc.mu.RUnlock()
+
+	now := time.Now()
+	st := CollectionStats{Resident: len(dc.data)}
+	for _, data := range dc.data {
+		since, dirty := data.dirtySince()
+		if !dirty {
+			st.Clean++
+			continue
+		}
+		st.Dirty++
+		if lag := now.Sub(since); lag > st.DirtyLag {
+			st.DirtyLag = lag
+		}
+	}
+	return st
+}
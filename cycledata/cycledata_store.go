@@ -0,0 +1,172 @@
+/*
+ * 周期数据存储实例
+ *
+ * 模块用途：
+ *   Store 持有一组独立的常驻数据和后台任务（冷数据淘汰、存储失败重试、后台写回），
+ *   生命周期由调用方通过 Start / Stop 显式控制，便于测试和在同一进程中嵌入多个实例。
+ *   加载器、创建器、存储器、Schema、各类策略等注册信息按 (CycleType, TypeKey) 在进程内共享。
+ *
+ *   包级函数（GetData、Flush、Txn、cond_* 等）作用于默认实例 Default()，同名的 Store 方法作用于指定实例，
+ *   Field 通过 In(store) 绑定实例。默认实例在包初始化时创建，但后台任务在首次访问数据时才启动，
+ *   只引用本包而不使用默认实例的进程不会多出后台协程；也可以调用 Default().Start / Stop 显式控制。
+ *
+ * 示例：
+ *   store := cycledata.New()
+ *   if err := store.Start(ctx); err != nil {
+ *       return err
+ *   }
+ *   defer store.Stop(shutdownCtx)
+ *   pd, err := store.GetDataErr(cycledata.DailyCycle, TypeKey(1), userID)
+ */
+package cycledata
+
+import (
+	"context"
+	"sync"
+)
+
+/*
+ * Store 周期数据存储实例
+ */
+type Store struct {
+	h *cycleHandler
+
+	mu        sync.Mutex
+	running   bool
+	stopping  chan struct{} // ctx 结束而提前返回的 Stop 仍在刷新时非 nil，刷新完成后关闭
+	retryStop chan struct{}
+	retryDone chan struct{}
+}
+
+/*
+ * New 创建存储实例，需调用 Start 启动后台任务
+ */
+func New() *Store {
+	return &Store{h: newCycleHandler()}
+}
+
+/*
+ * 默认存储实例，包级函数均作用于它
+ */
+var defaultStore = newDefaultStore()
+
+/*
+ * newDefaultStore 创建默认实例，首次访问数据时自动启动
+ */
+func newDefaultStore() *Store {
+	s := New()
+	s.h.autoStart = func() { _ = s.Start(context.Background()) }
+	return s
+}
+
+/*
+ * Default 获取默认存储实例
+ */
+func Default() *Store {
+	return defaultStore
+}
+
+/*
+ * Start 启动后台任务：冷数据淘汰调度器（默认随机周期，已通过 StartEviction / StopEviction 配置的按配置处理）、存储失败重试
+ * 和此前注册过的后台写回，并参与日/周/月周期的自动轮换；已启动时直接返回。
+ * 之前的 Stop 因 ctx 结束提前返回、仍在后台刷新时，先等待其完成，ctx 先结束则返回 ctx.Err()
+ */
+func (s *Store) Start(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.h.cancelAutoStart()
+	if err := s.waitStoppedLocked(ctx); err != nil {
+		return err
+	}
+	if s.running {
+		return nil
+	}
+	s.h.resumeEviction()
+	s.h.resumeWriteBehind()
+	s.retryStop = make(chan struct{})
+	s.retryDone = make(chan struct{})
+	go s.h.retryLoop(s.retryStop, s.retryDone)
+	s.running = true
+	setRunning(s, true)
+	return nil
+}
+
+/*
+ * Stop 停止全部后台任务并将脏数据写入存储器
+ *
+ * 1. 停止淘汰调度器，等待正在进行的淘汰完成
+ * 2. 停止后台写回，各集合最后写回一次（已注册的策略保留，再次 Start 时恢复）
+ * 3. 停止重试协程，等待正在进行的重试完成
+ * 4. 刷新全部集合（返回其中的写入错误），并立即重试队列中剩余的记录
+ * 5. 关闭 WAL（已开启时），仍未写入的记录保留在段文件中
+ *
+ * ctx 传递给存储器，ctx 结束时立即返回 ctx.Err()，
+ * 尚未开始的写入不再执行，对应记录保持脏状态留在内存中；
+ * 此时刷新仍在后台进行，之后的 Start / Stop 会先等待它完成，WAL 只关闭 Stop 调用时已开启的那一个
+ */
+func (s *Store) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.h.cancelAutoStart()
+	if err := s.waitStoppedLocked(ctx); err != nil {
+		return err
+	}
+	var err error
+	done := make(chan struct{})
+	wal := s.h.wal.Load()
+	retryStop, retryDone := s.retryStop, s.retryDone
+	s.retryStop, s.retryDone = nil, nil
+	s.running = false
+	setRunning(s, false)
+
+	go func() {
+		defer close(done)
+		s.h.haltEviction()
+		s.h.haltWriteBehind(false)
+		if retryStop != nil {
+			close(retryStop)
+			<-retryDone
+		}
+		err = s.h.flushAll(ctx)
+		s.h.retry.drain(ctx)
+		if walErr := s.h.closeWALOf(wal); err == nil {
+			err = walErr
+		}
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.stopping = done
+		return ctx.Err()
+	}
+}
+
+/*
+ * waitStoppedLocked 等待提前返回的 Stop 完成后台刷新（调用方需持有 s.mu，等待期间释放）
+ * ctx 先结束时返回 ctx.Err()
+ */
+func (s *Store) waitStoppedLocked(ctx context.Context) error {
+	for s.stopping != nil {
+		stopping := s.stopping
+		s.mu.Unlock()
+		select {
+		case <-stopping:
+		case <-ctx.Done():
+			s.mu.Lock()
+			return ctx.Err()
+		}
+		s.mu.Lock()
+		if s.stopping == stopping {
+			s.stopping = nil
+		}
+	}
+	return nil
+}
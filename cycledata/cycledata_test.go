@@ -1,7 +1,15 @@
 package cycledata
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"math"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -92,13 +100,15 @@ func TestDataCollectionGetAndUpdate(t *testing.T) {
 func TestDataCollectionCleanExpired(t *testing.T) {
 	col := newCollection()
 
-	now := int32(time.Now().Unix())
+	now := time.Now().Unix()
 
 	// 添加三条数据，一条无过期时间，一条过期，一条未过期
 	col.data[1] = &PlayerData{UserID: 1, ExpireTime: 0, MiscData: make(map[string]interface{})}
 	col.data[2] = &PlayerData{UserID: 2, ExpireTime: now - 10, MiscData: make(map[string]interface{})}  // 过期
 	col.data[3] = &PlayerData{UserID: 3, ExpireTime: now + 100, MiscData: make(map[string]interface{})} // 未过期
 
+	// 注册清理回调后过期数据才会被删除
+	RegisterCleanExpired(DailyCycle, 1, func(CycleType, TypeKey, *PlayerData) {})
 	col.cleanExpired(now, DailyCycle, 1)
 
 	if _, ok := col.data[2]; ok {
@@ -121,15 +131,17 @@ func TestCycleServiceGetCollectionAndFlush(t *testing.T) {
 		t.Fatal("expected dataCollection")
 	}
 
-	// 添加数据
+	// 添加数据（一条已修改，一条未修改）
 	col.data[1] = &PlayerData{UserID: 1, MiscData: map[string]interface{}{"key": "value"}}
+	col.data[1].MarkDirty()
+	col.data[2] = &PlayerData{UserID: 2, MiscData: map[string]interface{}{"key": "value"}}
 
 	// 设置全局存储函数，记录调用次数
 	var storeCalled int32
-	storeData = func(cycle CycleType, typeKey TypeKey, data *PlayerData) error {
+	RegisterStorer(DailyCycle, 1, func(cycle CycleType, typeKey TypeKey, data *PlayerData) error {
 		atomic.AddInt32(&storeCalled, 1)
 		return nil
-	}
+	})
 
 	cs.flush(1, DailyCycle)
 
@@ -144,12 +156,13 @@ func TestCycleHandlerCleanExpiredData(t *testing.T) {
 	handler.services[DailyCycle] = service
 
 	col := newCollection()
-	now := int32(time.Now().Unix())
+	now := time.Now().Unix()
 	col.data[1] = &PlayerData{UserID: 1, ExpireTime: now - 1, MiscData: make(map[string]interface{})}    // 过期
 	col.data[2] = &PlayerData{UserID: 2, ExpireTime: now + 1000, MiscData: make(map[string]interface{})} // 未过期
 
 	service.collections[1] = col
 
+	RegisterCleanExpired(DailyCycle, 1, func(CycleType, TypeKey, *PlayerData) {})
 	handler.cleanExpiredData(DailyCycle)
 
 	// 等待清理协程可能完成
@@ -164,7 +177,8 @@ func TestCycleHandlerCleanExpiredData(t *testing.T) {
 }
 
 func TestFlushAll(t *testing.T) {
-	handler := newCycleHandler()
+	store := New()
+	handler := store.h
 
 	// 创建两个周期服务，分别添加数据
 	s1 := newService(3600)
@@ -172,25 +186,34 @@ func TestFlushAll(t *testing.T) {
 
 	col1 := newCollection()
 	col1.data[1] = &PlayerData{UserID: 1, MiscData: make(map[string]interface{})}
+	col1.data[1].MarkDirty()
+	col1.data[3] = &PlayerData{UserID: 3, MiscData: make(map[string]interface{})}
 	s1.collections[1] = col1
 
 	col2 := newCollection()
 	col2.data[2] = &PlayerData{UserID: 2, MiscData: make(map[string]interface{})}
+	col2.data[2].MarkDirty()
 	s2.collections[2] = col2
 
 	handler.services[DailyCycle] = s1
 	handler.services[WeeklyCycle] = s2
 
-	globalHandler = handler
+	defaultStore = store
+
+	if st := Stats(DailyCycle, 1); st.Dirty != 1 || st.Clean != 1 {
+		t.Fatalf("expected 1 dirty and 1 clean record, got %+v", st)
+	}
 
 	var count int32
-	storeData = func(cycle CycleType, typeKey TypeKey, data *PlayerData) error {
+	countingStore := func(cycle CycleType, typeKey TypeKey, data *PlayerData) error {
 		atomic.AddInt32(&count, 1)
 		if data.UserID == 2 {
 			return errors.New("mock store error")
 		}
 		return nil
 	}
+	RegisterStorer(DailyCycle, 1, countingStore)
+	RegisterStorer(WeeklyCycle, 2, countingStore)
 
 	FlushAll()
 
@@ -494,3 +517,2398 @@ func TestAppendToInt32SliceIf(t *testing.T) {
 		t.Errorf("expected append fail due to wrong type")
 	}
 }
+
+func TestFieldCoercionAndTypeMismatch(t *testing.T) {
+	cycle := DailyCycle
+	typeKey := TypeKey(11)
+	userID := UserID(6006)
+
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{
+			UserID:   uid,
+			MiscData: make(map[string]interface{}),
+		}
+	})
+
+	pd := GetData(cycle, typeKey, userID)
+	if pd == nil {
+		t.Fatalf("GetData failed")
+	}
+
+	// int64 存储的值可以被 int 字段读取和累加
+	pd.MiscData["stars"] = int64(5)
+	stars := NewField[int](cycle, typeKey, "stars")
+	if err := IncreaseIf(stars, userID, 3, func(current int) bool { return current < 10 }); err != nil {
+		t.Fatalf("expected increase success, got %v", err)
+	}
+	if val, err := stars.Get(userID); err != nil || val != 8 {
+		t.Fatalf("expected 8, got %v (err=%v)", val, err)
+	}
+	if _, isInt := pd.MiscData["stars"].(int); !isInt {
+		t.Fatalf("expected value written back as int, got %T", pd.MiscData["stars"])
+	}
+
+	// CompareAndSwap
+	if err := stars.CompareAndSwap(userID, 7, 100); !errors.Is(err, ErrConditionFailed) {
+		t.Errorf("expected CAS fail for stale old value, got %v", err)
+	}
+	if err := stars.CompareAndSwap(userID, 8, 100); err != nil {
+		t.Errorf("expected CAS success, got %v", err)
+	}
+
+	// 类型不匹配返回错误
+	pd.MiscData["name"] = "hero"
+	_, err := NewField[int32](cycle, typeKey, "name").Get(userID)
+	if !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected ErrTypeMismatch, got %v", err)
+	}
+	if err := DecreaseIfEnough(NewField[float64](cycle, typeKey, "name"), userID, 1); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected ErrTypeMismatch on decrease, got %v", err)
+	}
+
+	// 有损的数值转换返回错误，原值不被改写
+	pd.MiscData["big"] = int64(5_000_000_000)
+	big := NewField[int32](cycle, typeKey, "big")
+	if _, err := big.Get(userID); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected ErrTypeMismatch for 5e9 as int32, got %v", err)
+	}
+	if err := IncreaseIf(big, userID, 1, func(int32) bool { return true }); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected ErrTypeMismatch on increase, got %v", err)
+	}
+	if pd.MiscData["big"] != int64(5_000_000_000) {
+		t.Fatalf("expected overflowing value untouched, got %v", pd.MiscData["big"])
+	}
+	pd.MiscData["ratio"] = 3.7
+	if _, err := NewField[int](cycle, typeKey, "ratio").Get(userID); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected ErrTypeMismatch for 3.7 as int, got %v", err)
+	}
+	pd.MiscData["whole"] = 4.0
+	if val, err := NewField[int](cycle, typeKey, "whole").Get(userID); err != nil || val != 4 {
+		t.Fatalf("expected 4, got %v (err=%v)", val, err)
+	}
+
+	// cond_* 兼容接口按原有类型写回，超出原类型范围时不写入
+	pd.MiscData["level"] = int32(7)
+	if !IncreaseIfCondInt(cycle, typeKey, userID, "level", 1, func(int) bool { return true }) {
+		t.Fatal("expected increase on int32-stored value")
+	}
+	if v, isInt32 := pd.MiscData["level"].(int32); !isInt32 || v != 8 {
+		t.Fatalf("expected int32 8 kept, got %T %v", pd.MiscData["level"], pd.MiscData["level"])
+	}
+	if IncreaseIfCondInt(cycle, typeKey, userID, "level", math.MaxInt32, func(int) bool { return true }) {
+		t.Fatal("expected increase overflowing int32 to fail")
+	}
+	pd.MiscData["gold"] = 2.5
+	if IncreaseIfCondInt(cycle, typeKey, userID, "gold", 1, func(int) bool { return true }) || pd.MiscData["gold"] != 2.5 {
+		t.Fatalf("expected fractional value untouched by int helper, got %v", pd.MiscData["gold"])
+	}
+
+	// 未注册的周期类型
+	if _, err := NewField[int](WeeklyCycle, TypeKey(999), "x").Get(userID); !errors.Is(err, ErrNoData) {
+		t.Fatalf("expected ErrNoData, got %v", err)
+	}
+}
+
+func TestSchemaValidationAndDefaults(t *testing.T) {
+	cycle := WeeklyCycle
+	typeKey := TypeKey(12)
+	userID := UserID(7007)
+
+	RegisterSchema(cycle, typeKey, Schema{
+		"coins":        SpecOf[int64](100).WithRange(0, 1000),
+		"achievements": SpecOf[[]int32](nil),
+	})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid}
+	})
+
+	pd := GetData(cycle, typeKey, userID)
+	if pd == nil {
+		t.Fatalf("GetData failed")
+	}
+	if v, ok := pd.MiscData["coins"].(int64); !ok || v != 100 {
+		t.Fatalf("expected default coins=int64(100), got %T %v", pd.MiscData["coins"], pd.MiscData["coins"])
+	}
+
+	// int 写入 int64 字段时按声明类型存储
+	if !IncreaseIfCondInt(cycle, typeKey, userID, "coins", 50, func(int) bool { return true }) {
+		t.Fatalf("expected increase success")
+	}
+	if v, ok := pd.MiscData["coins"].(int64); !ok || v != 150 {
+		t.Fatalf("expected coins=int64(150), got %T %v", pd.MiscData["coins"], pd.MiscData["coins"])
+	}
+
+	// 超出范围
+	err := IncreaseIf(NewField[int64](cycle, typeKey, "coins"), userID, 2000, func(int64) bool { return true })
+	var schemaErr *SchemaError
+	if !errors.As(err, &schemaErr) || !errors.Is(err, ErrSchemaViolation) {
+		t.Fatalf("expected SchemaError, got %v", err)
+	}
+
+	// 未声明的键与错误类型
+	if UpdateIf(cycle, typeKey, userID, "unknown", 1, func(_, _ interface{}) bool { return true }) {
+		t.Errorf("expected undeclared key rejected")
+	}
+	if SetData(cycle, typeKey, userID, map[string]interface{}{"achievements": "oops"}) {
+		t.Errorf("expected wrong type rejected by SetData")
+	}
+	if got := SchemaViolations(cycle, typeKey); got != 3 {
+		t.Errorf("expected 3 violations, got %d", got)
+	}
+	if v := pd.MiscData["coins"].(int64); v != 150 {
+		t.Errorf("expected coins unchanged after violations, got %v", v)
+	}
+}
+
+func TestErrorReturningVariants(t *testing.T) {
+	cycle := MonthlyCycle
+	typeKey := TypeKey(13)
+	userID := UserID(8008)
+
+	if _, err := GetDataErr(cycle, typeKey, userID); !errors.Is(err, ErrNoCreator) || !errors.Is(err, ErrNoData) {
+		t.Fatalf("expected ErrNoCreator, got %v", err)
+	}
+
+	RegisterLoader(cycle, typeKey, func(CycleType, TypeKey, UserID) *PlayerData { return nil })
+	if _, err := GetDataErr(cycle, typeKey, userID); !errors.Is(err, ErrNilData) {
+		t.Fatalf("expected ErrNilData, got %v", err)
+	}
+
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: map[string]interface{}{"coins": int32(10), "name": "hero"}}
+	})
+
+	coins := NewField[int32](cycle, typeKey, "coins")
+	if err := DecreaseIfEnough(coins, userID, 20); !errors.Is(err, ErrInsufficient) {
+		t.Errorf("expected ErrInsufficient, got %v", err)
+	}
+	if err := UpdateIfErr(cycle, typeKey, userID, "coins", int32(1), func(_, _ interface{}) bool { return false }); !errors.Is(err, ErrConditionFailed) {
+		t.Errorf("expected ErrConditionFailed, got %v", err)
+	}
+	if err := AppendToInt32SliceIfErr(cycle, typeKey, userID, "name", 1, func([]int32) bool { return true }); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("expected ErrTypeMismatch, got %v", err)
+	}
+	if err := UpdateInInt32MapIfErr(cycle, typeKey, userID, "missing", 1, 1, func(map[int32]int32) bool { return true }); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	if err := SetInInt32MapIfErr(cycle, typeKey, userID, "m", 1, 1, func(map[int32]int32) bool { return true }); err != nil {
+		t.Errorf("expected set success, got %v", err)
+	}
+	if err := SetInInt32MapIfErr(cycle, typeKey, userID, "m", 1, 2, func(map[int32]int32) bool { return true }); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("expected ErrKeyExists, got %v", err)
+	}
+}
+
+func TestTxnCommitRollbackAndLockOrdering(t *testing.T) {
+	newRecord := func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	}
+	RegisterCreator(LiftTime, TypeKey(14), newRecord)
+	RegisterCreator(DailyCycle, TypeKey(14), newRecord)
+
+	userID := UserID(9009)
+	coins := NewField[int64](LiftTime, TypeKey(14), "coins")
+	bought := NewField[int32](DailyCycle, TypeKey(14), "bought")
+	if err := coins.Set(userID, 100); err != nil {
+		t.Fatalf("set coins: %v", err)
+	}
+
+	buy := func(price int64) error {
+		return Txn(func(tx *Tx) error {
+			if err := TxUpdate(tx, bought, userID, func(n int32) (int32, error) { return n + 1, nil }); err != nil {
+				return err
+			}
+			return TxUpdate(tx, coins, userID, func(c int64) (int64, error) {
+				if c < price {
+					return c, ErrInsufficient
+				}
+				return c - price, nil
+			})
+		})
+	}
+
+	if err := buy(30); err != nil {
+		t.Fatalf("expected purchase success, got %v", err)
+	}
+	if err := buy(500); !errors.Is(err, ErrInsufficient) {
+		t.Fatalf("expected ErrInsufficient, got %v", err)
+	}
+	if c, _ := coins.Get(userID); c != 70 {
+		t.Errorf("expected coins=70, got %d", c)
+	}
+	if n, _ := bought.Get(userID); n != 1 {
+		t.Errorf("expected bought=1 after rollback, got %d", n)
+	}
+
+	// 两组事务以相反顺序访问同一组记录，不应死锁
+	a := NewField[int](DailyCycle, TypeKey(14), "x")
+	b := NewField[int](LiftTime, TypeKey(14), "x")
+	inc := func(n int) (int, error) { return n + 1, nil }
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = Txn(func(tx *Tx) error {
+				if err := TxUpdate(tx, a, 1, inc); err != nil {
+					return err
+				}
+				return TxUpdate(tx, b, 2, inc)
+			})
+		}()
+		go func() {
+			defer wg.Done()
+			_ = Txn(func(tx *Tx) error {
+				if err := TxUpdate(tx, b, 2, inc); err != nil {
+					return err
+				}
+				return TxUpdate(tx, a, 1, inc)
+			})
+		}()
+	}
+	wg.Wait()
+	if v, _ := a.Get(1); v != 100 {
+		t.Errorf("expected a=100, got %d", v)
+	}
+	if v, _ := b.Get(2); v != 100 {
+		t.Errorf("expected b=100, got %d", v)
+	}
+}
+
+func TestBatchStorerFlush(t *testing.T) {
+	cycle := WeeklyCycle
+	typeKey := TypeKey(15)
+
+	var batches [][]UserID
+	RegisterBatchStorer(cycle, typeKey, 2, func(_ CycleType, _ TypeKey, batch []*PlayerData) error {
+		ids := make([]UserID, 0, len(batch))
+		for _, data := range batch {
+			ids = append(ids, data.UserID)
+		}
+		batches = append(batches, ids)
+		return nil
+	})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+
+	for uid := UserID(1); uid <= 6; uid++ {
+		GetData(cycle, typeKey, uid)
+	}
+	// 只修改其中 5 条，未修改的 1 条不应被写入
+	for uid := UserID(1); uid <= 5; uid++ {
+		UpdateIf(cycle, typeKey, uid, "v", int(uid), func(_, _ interface{}) bool { return true })
+	}
+
+	Flush(cycle, typeKey)
+
+	if len(batches) != 3 || len(batches[0]) != 2 || len(batches[2]) != 1 {
+		t.Fatalf("expected batches of [2 2 1], got %v", batches)
+	}
+	if batches[0][0] != 1 || batches[2][0] != 5 {
+		t.Errorf("expected records sorted by UserID, got %v", batches)
+	}
+	if st := Stats(cycle, typeKey); st.Resident != 0 {
+		t.Errorf("expected collection emptied after flush, got %+v", st)
+	}
+}
+
+func TestWriteBehindFlushesDirtyRecords(t *testing.T) {
+	cycle := MonthlyCycle
+	typeKey := TypeKey(16)
+
+	var stored int32
+	RegisterStorer(cycle, typeKey, func(CycleType, TypeKey, *PlayerData) error {
+		atomic.AddInt32(&stored, 1)
+		return nil
+	})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+	RegisterWriteBehind(cycle, typeKey, WriteBehindPolicy{
+		MaxDirty:      2,
+		CheckInterval: 5 * time.Millisecond,
+		Jitter:        time.Millisecond,
+	})
+
+	inc := func(uid UserID) {
+		IncreaseIfCondInt(cycle, typeKey, uid, "n", 1, func(int) bool { return true })
+	}
+	inc(1)
+	time.Sleep(30 * time.Millisecond)
+	if atomic.LoadInt32(&stored) != 0 {
+		t.Fatalf("expected no flush below MaxDirty")
+	}
+
+	inc(2)
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&stored) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&stored); got != 2 {
+		t.Fatalf("expected 2 records written behind, got %d", got)
+	}
+	if st := Stats(cycle, typeKey); st.Resident != 2 || st.Dirty != 0 {
+		t.Fatalf("expected records resident and clean, got %+v", st)
+	}
+	if wb, ok := WriteBehindStatsFor(cycle, typeKey); !ok || wb.Records != 2 {
+		t.Fatalf("unexpected write-behind stats %+v", wb)
+	}
+
+	// 停止时写回剩余脏数据
+	inc(3)
+	StopWriteBehind()
+	if got := atomic.LoadInt32(&stored); got != 3 {
+		t.Fatalf("expected final flush on stop, got %d", got)
+	}
+}
+
+func TestWriteBehindResumesAfterRestart(t *testing.T) {
+	cycle := MonthlyCycle
+	typeKey := TypeKey(54)
+
+	var stored int32
+	RegisterStorer(cycle, typeKey, func(CycleType, TypeKey, *PlayerData) error {
+		atomic.AddInt32(&stored, 1)
+		return nil
+	})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+
+	ctx := context.Background()
+	s := New()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterWriteBehind(cycle, typeKey, WriteBehindPolicy{MaxDirty: 1, CheckInterval: 5 * time.Millisecond})
+	if err := s.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(ctx)
+
+	// 重启后写回协程恢复，无需 Flush 即写入
+	s.IncreaseIfCondInt(cycle, typeKey, 1, "n", 1, func(int) bool { return true })
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&stored) < 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&stored); got != 1 {
+		t.Fatalf("expected write-behind to resume after restart, got %d stores", got)
+	}
+	if _, ok := s.WriteBehindStatsFor(cycle, typeKey); !ok {
+		t.Fatal("expected write-behind worker running after restart")
+	}
+}
+
+func TestStoreFailureRetryAndDeadLetter(t *testing.T) {
+	cycle := MonthlyCycle
+	typeKey := TypeKey(17)
+
+	var failing atomic.Bool
+	failing.Store(true)
+	storeErr := errors.New("db down")
+	RegisterStorer(cycle, typeKey, func(_ CycleType, _ TypeKey, data *PlayerData) error {
+		if failing.Load() || data.UserID == 2 {
+			return storeErr
+		}
+		return nil
+	})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+	// 退避足够长，避免后台重试协程干扰，由测试手动推进时间
+	RegisterRetryPolicy(cycle, typeKey, RetryPolicy{MaxAttempts: 2, BaseDelay: time.Hour, MaxDelay: 2 * time.Hour})
+
+	var dead []UserID
+	RegisterStoreFailure(cycle, typeKey, func(_ CycleType, _ TypeKey, data *PlayerData, err error) {
+		if !errors.Is(err, storeErr) {
+			t.Errorf("unexpected dead-letter error %v", err)
+		}
+		dead = append(dead, data.UserID)
+	})
+
+	for _, uid := range []UserID{1, 2} {
+		GetData(cycle, typeKey, uid).MarkDirty()
+	}
+	Flush(cycle, typeKey)
+	if st := Stats(cycle, typeKey); st.Resident != 2 || st.Dirty != 2 || st.Retrying != 2 {
+		t.Fatalf("expected failed records to stay resident and queued, got %+v", st)
+	}
+
+	// 存储恢复后 uid 1 重试成功，uid 2 继续失败
+	failing.Store(false)
+	later := time.Now().Add(24 * time.Hour)
+	defaultStore.h.retry.process(context.Background(), later)
+	if st := Stats(cycle, typeKey); st.Dirty != 1 || st.Retrying != 1 {
+		t.Fatalf("expected one record still retrying, got %+v", st)
+	}
+	if len(dead) != 0 {
+		t.Fatalf("dead-letter called before max attempts: %v", dead)
+	}
+
+	defaultStore.h.retry.process(context.Background(), later)
+	if len(dead) != 1 || dead[0] != 2 {
+		t.Fatalf("expected uid 2 dead-lettered, got %v", dead)
+	}
+	if st := Stats(cycle, typeKey); st.Dirty != 0 || st.Retrying != 0 {
+		t.Fatalf("expected queue drained after dead-letter, got %+v", st)
+	}
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	cycle := LiftTime
+	typeKey := TypeKey(18)
+
+	var stored int32
+	RegisterStorer(cycle, typeKey, func(CycleType, TypeKey, *PlayerData) error {
+		atomic.AddInt32(&stored, 1)
+		return nil
+	})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: map[string]interface{}{"items": []int32{1, 2, 3}}}
+	})
+	RegisterEvictionPolicy(cycle, typeKey, EvictionPolicy{MaxResident: 2, Strategy: EvictLFU})
+
+	// uid 1 和 3 被频繁访问，uid 2 最不常用
+	for _, uid := range []UserID{1, 2, 3, 1, 3, 1, 3} {
+		GetData(cycle, typeKey, uid)
+	}
+	GetData(cycle, typeKey, 2).MarkDirty()
+	RunEviction()
+
+	col := defaultStore.h.findCollection(cycle, typeKey)
+	if _, ok := col.data[2]; ok || len(col.data) != 2 {
+		t.Fatalf("expected LFU record 2 evicted, resident %v", len(col.data))
+	}
+	if atomic.LoadInt32(&stored) != 1 {
+		t.Fatalf("expected dirty record persisted before eviction, got %d", stored)
+	}
+
+	// 空闲超时：uid 1 闲置后被淘汰，uid 3 仍活跃
+	RegisterEvictionPolicy(cycle, typeKey, EvictionPolicy{IdleTTL: 20 * time.Millisecond})
+	time.Sleep(30 * time.Millisecond)
+	GetData(cycle, typeKey, 3)
+	RunEviction()
+	if _, ok := col.data[1]; ok {
+		t.Fatalf("expected idle record 1 evicted")
+	}
+	if _, ok := col.data[3]; !ok {
+		t.Fatalf("expected active record 3 resident")
+	}
+
+	// 内存预算：超出预算时跨集合淘汰，只作用于设置预算的实例
+	RegisterEvictionPolicy(cycle, typeKey, EvictionPolicy{})
+	other := New()
+	other.GetData(cycle, typeKey, 4)
+	SetMemoryBudget(1)
+	defer SetMemoryBudget(0)
+	RunEviction()
+	other.RunEviction()
+	if st := Stats(cycle, typeKey); st.Resident != 0 {
+		t.Fatalf("expected records evicted under memory budget, got %+v", st)
+	}
+	if st := other.Stats(cycle, typeKey); st.Resident != 1 {
+		t.Fatalf("expected memory budget scoped to its store, got %+v", st)
+	}
+
+	// 调度器可以重启和停止
+	StartEviction(time.Millisecond)
+	StopEviction()
+	StopEviction()
+}
+
+func TestStoreLifecycle(t *testing.T) {
+	cycle := WeeklyCycle
+	typeKey := TypeKey(19)
+
+	var stored int32
+	RegisterStorer(cycle, typeKey, func(CycleType, TypeKey, *PlayerData) error {
+		atomic.AddInt32(&stored, 1)
+		return nil
+	})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+
+	ctx := context.Background()
+	before := runtime.NumGoroutine()
+	a, b := New(), New()
+	if err := a.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	a.RegisterWriteBehind(cycle, typeKey, WriteBehindPolicy{Interval: time.Hour})
+
+	// 两个实例的数据相互独立
+	a.GetData(cycle, typeKey, 1).MarkDirty()
+	if st := b.Stats(cycle, typeKey); st.Resident != 0 {
+		t.Fatalf("expected independent stores, got %+v", st)
+	}
+
+	// Stop 写入脏数据并结束全部后台协程
+	if err := a.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&stored); got != 1 {
+		t.Fatalf("expected dirty record flushed on stop, got %d", got)
+	}
+	if st := a.Stats(cycle, typeKey); st.Resident != 0 {
+		t.Fatalf("expected store emptied on stop, got %+v", st)
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("goroutines leaked: before %d, after %d", before, after)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := New().Start(canceled); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestStartKeepsConfiguredEviction(t *testing.T) {
+	cycle, typeKey := WeeklyCycle, TypeKey(55)
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+	scheduler := func(s *Store) (chan struct{}, time.Duration) {
+		s.h.eviction.mu.Lock()
+		defer s.h.eviction.mu.Unlock()
+		return s.h.eviction.stopCh, s.h.eviction.interval
+	}
+
+	// 默认实例的自动启动不替换已配置的调度器
+	ctx := context.Background()
+	s := newDefaultStore()
+	s.StartEviction(5 * time.Minute)
+	configured, _ := scheduler(s)
+	s.GetData(cycle, typeKey, 1)
+	if cur, interval := scheduler(s); cur != configured || interval != 5*time.Minute {
+		t.Fatalf("expected auto start to keep the configured scheduler, got interval %v", interval)
+	}
+
+	// 显式停止后 Start 不再启动
+	s.StopEviction()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if cur, _ := scheduler(s); cur != nil {
+		t.Fatal("expected eviction to stay stopped after StopEviction")
+	}
+
+	// 重启后沿用配置的周期
+	s.StartEviction(time.Minute)
+	if err := s.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if cur, interval := scheduler(s); cur == nil || interval != time.Minute {
+		t.Fatalf("expected eviction restarted with the configured interval, got %v", interval)
+	}
+	if err := s.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSingleflightLoading(t *testing.T) {
+	cycle := DailyCycle
+	typeKey := TypeKey(20)
+
+	var loads int32
+	release := make(chan struct{})
+	RegisterLoader(cycle, typeKey, func(_ CycleType, _ TypeKey, uid UserID) *PlayerData {
+		atomic.AddInt32(&loads, 1)
+		switch uid {
+		case 1:
+			<-release
+		case 3:
+			panic("db timeout")
+		case 4:
+			return nil
+		}
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+
+	// 同一玩家的并发请求共享一次慢加载
+	const waiters = 8
+	results := make(chan *PlayerData, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() { results <- GetData(cycle, typeKey, 1) }()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// 其他玩家不受慢加载阻塞
+	done := make(chan struct{})
+	go func() {
+		GetData(cycle, typeKey, 2)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("load of uid 2 blocked by slow load of uid 1")
+	}
+
+	close(release)
+	first := <-results
+	for i := 1; i < waiters; i++ {
+		if pd := <-results; pd == nil || pd != first {
+			t.Fatalf("expected all waiters to share one record")
+		}
+	}
+	if got := atomic.LoadInt32(&loads); got != 2 {
+		t.Fatalf("expected 2 loads (uid 1 once, uid 2 once), got %d", got)
+	}
+
+	// 加载失败传递给调用方，且不会被缓存
+	if _, err := GetDataErr(cycle, typeKey, 3); !errors.Is(err, ErrLoadFailed) || !errors.Is(err, ErrNoData) {
+		t.Fatalf("expected ErrLoadFailed, got %v", err)
+	}
+	if _, err := GetDataErr(cycle, typeKey, 4); !errors.Is(err, ErrNilData) {
+		t.Fatalf("expected ErrNilData, got %v", err)
+	}
+	if _, err := GetDataErr(cycle, typeKey, 4); !errors.Is(err, ErrNilData) {
+		t.Fatalf("expected failed load to be retried, got %v", err)
+	}
+	if got := atomic.LoadInt32(&loads); got != 5 {
+		t.Fatalf("expected failed loads not cached, got %d loads", got)
+	}
+}
+
+func TestContextAwareLoadAndFlush(t *testing.T) {
+	cycle := MonthlyCycle
+	typeKey := TypeKey(21)
+
+	RegisterLoaderCtx(cycle, typeKey, func(ctx context.Context, _ CycleType, _ TypeKey, uid UserID) (*PlayerData, error) {
+		if uid == 1 {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}, nil
+	})
+	var stored int32
+	RegisterStorerCtx(cycle, typeKey, func(ctx context.Context, _ CycleType, _ TypeKey, _ *PlayerData) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		atomic.AddInt32(&stored, 1)
+		return nil
+	})
+
+	// 加载超时传递给调用方
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := GetDataCtx(ctx, cycle, typeKey, 1)
+	if !errors.Is(err, ErrLoadFailed) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected load deadline error, got %v", err)
+	}
+
+	pd, err := GetDataCtx(context.Background(), cycle, typeKey, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pd.MarkDirty()
+
+	// 已取消的 ctx 不调用存储器，记录保持常驻和脏状态
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if err := FlushCtx(canceled, cycle, typeKey); !errors.Is(err, ErrStoreFailed) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled flush error, got %v", err)
+	}
+	if st := Stats(cycle, typeKey); st.Resident != 1 || st.Dirty != 1 || atomic.LoadInt32(&stored) != 0 {
+		t.Fatalf("expected record kept dirty after canceled flush, got %+v", st)
+	}
+
+	if err := FlushCtx(context.Background(), cycle, typeKey); err != nil {
+		t.Fatal(err)
+	}
+	// 其他测试遗留的写入失败记录会体现在 FlushAllCtx 的错误中
+	if err := FlushAllCtx(context.Background()); err != nil && !errors.Is(err, ErrStoreFailed) {
+		t.Fatalf("unexpected FlushAllCtx error %v", err)
+	}
+	if st := Stats(cycle, typeKey); st.Resident != 0 || atomic.LoadInt32(&stored) != 1 {
+		t.Fatalf("expected record stored and evicted, got %+v", st)
+	}
+}
+
+func TestAutomaticCycleRollover(t *testing.T) {
+	cycle := WeeklyCycle
+	typeKey := TypeKey(22)
+
+	var stored, cleaned int32
+	RegisterStorer(cycle, typeKey, func(CycleType, TypeKey, *PlayerData) error {
+		atomic.AddInt32(&stored, 1)
+		return nil
+	})
+	RegisterCleanExpired(cycle, typeKey, func(CycleType, TypeKey, *PlayerData) {
+		atomic.AddInt32(&cleaned, 1)
+	})
+	// 加载器返回上一周期遗留的已过期记录
+	RegisterLoader(cycle, typeKey, func(_ CycleType, _ TypeKey, uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, ExpireTime: 1, MiscData: map[string]interface{}{"from": "loader"}}
+	})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: map[string]interface{}{"from": "creator"}}
+	})
+	if err := Default().Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	want, _ := nextBoundary(cycle, now)
+	pd := GetData(cycle, typeKey, 1)
+	if pd.MiscData["from"] != "creator" {
+		t.Fatalf("expected expired loaded record replaced by creator, got %v", pd.MiscData)
+	}
+	if pd.ExpireTime != want || time.Unix(want, 0).Weekday() != time.Monday {
+		t.Fatalf("expected ExpireTime at next Monday %d, got %d", want, pd.ExpireTime)
+	}
+	pd.MarkDirty()
+
+	// 跨周边界触发轮换
+	rollover(cycle, time.Unix(want, 0))
+	if atomic.LoadInt32(&cleaned) != 1 || atomic.LoadInt32(&stored) != 1 {
+		t.Fatalf("expected cleanExpired and storer called once, got %d/%d", cleaned, stored)
+	}
+	if st := Stats(cycle, typeKey); st.Resident != 0 {
+		t.Fatalf("expected expired record removed, got %+v", st)
+	}
+	if next := GetData(cycle, typeKey, 1); next == pd {
+		t.Fatalf("expected fresh record after rollover")
+	}
+}
+
+func TestLazyExpiryOnAccess(t *testing.T) {
+	cycle := LimitTime
+	typeKey := TypeKey(23)
+
+	var stored, cleaned int32
+	RegisterStorer(cycle, typeKey, func(CycleType, TypeKey, *PlayerData) error {
+		atomic.AddInt32(&stored, 1)
+		return nil
+	})
+	RegisterCleanExpired(cycle, typeKey, func(_ CycleType, _ TypeKey, data *PlayerData) {
+		atomic.AddInt32(&cleaned, 1)
+	})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+	expireNow := func(pd *PlayerData) {
+		pd.mu.Lock()
+		pd.ExpireTime = time.Now().Unix() - 1
+		pd.mu.Unlock()
+	}
+
+	cond := func(int) bool { return true }
+	if !IncreaseIfCondInt(cycle, typeKey, 1, "quest", 3, cond) {
+		t.Fatal("increase failed")
+	}
+	old := GetData(cycle, typeKey, 1)
+	expireNow(old)
+
+	// GetData 不返回过期记录
+	fresh := GetData(cycle, typeKey, 1)
+	if fresh == old || fresh.MiscData["quest"] != nil {
+		t.Fatalf("expected fresh record after expiry, got %v", fresh.MiscData)
+	}
+	if atomic.LoadInt32(&cleaned) != 1 || atomic.LoadInt32(&stored) != 1 {
+		t.Fatalf("expected expired record cleaned and stored, got %d/%d", cleaned, stored)
+	}
+
+	// cond_* 辅助函数同样作用在新记录上
+	expireNow(fresh)
+	if !IncreaseIfCondInt(cycle, typeKey, 1, "quest", 1, cond) {
+		t.Fatal("increase failed")
+	}
+	if v := GetData(cycle, typeKey, 1).MiscData["quest"]; v != 1 {
+		t.Fatalf("expected counter reset by expiry, got %v", v)
+	}
+	if atomic.LoadInt32(&cleaned) != 2 {
+		t.Fatalf("expected second expiry handled, got %d", cleaned)
+	}
+}
+
+func TestLoopCycles(t *testing.T) {
+	// 按时间循环：每 3 天一轮
+	anchor := time.Date(2025, 1, 1, 5, 0, 0, 0, time.UTC)
+	RegisterLoopCycle(TypeKey(24), anchor, 72*time.Hour)
+	index, next, err := LoopIndex(TypeKey(24), anchor.Add(100*time.Hour))
+	if err != nil || index != 1 || !next.Equal(anchor.Add(144*time.Hour)) {
+		t.Fatalf("unexpected loop index %d, next %v, err %v", index, next, err)
+	}
+	if index, _, _ := LoopIndex(TypeKey(24), anchor.Add(-time.Hour)); index != -1 {
+		t.Fatalf("expected index -1 before anchor, got %d", index)
+	}
+	RegisterCreator(LoopTime, TypeKey(24), func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+	pd := GetData(LoopTime, TypeKey(24), 1)
+	index, next, _ = LoopIndex(TypeKey(24), time.Now())
+	if pd.Loop != index || pd.ExpireTime != next.Unix() {
+		t.Fatalf("expected loop %d expiring at %d, got %d/%d", index, next.Unix(), pd.Loop, pd.ExpireTime)
+	}
+	// 加载器返回上一轮的记录（ExpireTime 未持久化）时按过期处理，由创建器构造本轮记录
+	RegisterLoader(LoopTime, TypeKey(24), func(_ CycleType, _ TypeKey, uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, Loop: index - 1, MiscData: map[string]interface{}{"old": true}}
+	})
+	if pd := GetData(LoopTime, TypeKey(24), 2); pd.Loop != index || pd.MiscData["old"] != nil {
+		t.Fatalf("expected previous-loop record replaced, got %d/%v", pd.Loop, pd.MiscData)
+	}
+
+	// 按次数循环：每 3 次一轮
+	cycle, typeKey := LoopTime, TypeKey(25)
+	RegisterLoopCounter(typeKey, 3, 2)
+	var cleaned int32
+	RegisterCleanExpired(cycle, typeKey, func(CycleType, TypeKey, *PlayerData) {
+		atomic.AddInt32(&cleaned, 1)
+	})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+	if !IncreaseIfCondInt(cycle, typeKey, 1, "wins", 1, func(int) bool { return true }) {
+		t.Fatal("increase failed")
+	}
+	if pd := GetData(cycle, typeKey, 1); pd.Loop != 0 || pd.ExpireTime != 0 {
+		t.Fatalf("expected loop 0 without expiry, got %d/%d", pd.Loop, pd.ExpireTime)
+	}
+
+	if index, err := AdvanceLoop(typeKey, 1); err != nil || index != 1 {
+		t.Fatalf("expected loop 1, got %d, %v", index, err)
+	}
+	if atomic.LoadInt32(&cleaned) != 1 {
+		t.Fatalf("expected previous loop cleaned, got %d", cleaned)
+	}
+	if s := Stats(cycle, typeKey); s.Resident != 0 {
+		t.Fatalf("expected previous loop evicted, got %d resident", s.Resident)
+	}
+	if pd := GetData(cycle, typeKey, 1); pd.Loop != 1 || pd.MiscData["wins"] != nil {
+		t.Fatalf("expected fresh record for loop 1, got %d/%v", pd.Loop, pd.MiscData)
+	}
+
+	if _, err := AdvanceLoop(TypeKey(24), 1); !errors.Is(err, ErrNoLoopCycle) {
+		t.Fatalf("expected ErrNoLoopCycle for time-based loop, got %v", err)
+	}
+}
+
+func TestNewbieWindows(t *testing.T) {
+	cycle, typeKey := Newbie, TypeKey(26)
+	now := time.Now().Truncate(time.Second)
+	registered := map[UserID]time.Time{
+		1: now.Add(-time.Hour),
+		2: now.Add(-3 * time.Hour),
+		3: now.Add(-10 * time.Minute),
+	}
+	RegisterNewbieWindow(typeKey, func(uid UserID) time.Time { return registered[uid] }, 2*time.Hour)
+
+	var cleaned sync.Map
+	RegisterCleanExpired(cycle, typeKey, func(_ CycleType, _ TypeKey, data *PlayerData) {
+		cleaned.Store(data.UserID, true)
+	})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+
+	// 每个玩家的过期时间从自己的注册时间起算
+	for _, uid := range []UserID{1, 3} {
+		pd, err := GetDataErr(cycle, typeKey, uid)
+		if err != nil {
+			t.Fatalf("uid %d: %v", uid, err)
+		}
+		if want := registered[uid].Add(2 * time.Hour).Unix(); pd.ExpireTime != want {
+			t.Fatalf("uid %d: expected expire %d, got %d", uid, want, pd.ExpireTime)
+		}
+	}
+
+	// 新手期已结束的玩家不再创建数据
+	if _, err := GetDataErr(cycle, typeKey, 2); !errors.Is(err, ErrNewbieEnded) || !errors.Is(err, ErrNoData) {
+		t.Fatalf("expected ErrNewbieEnded, got %v", err)
+	}
+	if err := SetDataErr(cycle, typeKey, 4, map[string]interface{}{}); !errors.Is(err, ErrNewbieEnded) {
+		t.Fatalf("expected ErrNewbieEnded for unknown user, got %v", err)
+	}
+
+	// 玩家 1 的新手期结束，玩家 3 不受影响
+	defaultStore.h.cleanExpiredAt(cycle, registered[1].Add(2*time.Hour).Unix())
+	if _, ok := cleaned.Load(UserID(1)); !ok {
+		t.Fatal("expected uid 1 expired through cleanExpired hook")
+	}
+	if _, ok := cleaned.Load(UserID(3)); ok {
+		t.Fatal("uid 3 should still be within newbie window")
+	}
+	if s := Stats(cycle, typeKey); s.Resident != 1 {
+		t.Fatalf("expected 1 resident record, got %d", s.Resident)
+	}
+}
+
+func TestActivityWindows(t *testing.T) {
+	// 每周重复的窗口
+	base := time.Date(2025, 1, 6, 10, 0, 0, 0, time.UTC)
+	RegisterActivity(TypeKey(27), ActivityWindow{Start: base, End: base.Add(12 * time.Hour), Repeat: 7 * 24 * time.Hour})
+	cases := []struct {
+		now    time.Time
+		start  time.Time
+		active bool
+	}{
+		{base.Add(-time.Hour), base, false},
+		{base.Add(time.Hour), base, true},
+		{base.Add(12 * time.Hour), base.AddDate(0, 0, 7), false},
+		{base.AddDate(0, 0, 14).Add(11 * time.Hour), base.AddDate(0, 0, 14), true},
+	}
+	for _, c := range cases {
+		start, end, active, ok := ActivityAt(TypeKey(27), c.now)
+		if !ok || active != c.active || !start.Equal(c.start) || !end.Equal(c.start.Add(12*time.Hour)) {
+			t.Fatalf("at %v: got %v - %v active=%v", c.now, start, end, active)
+		}
+	}
+
+	cycle, typeKey := LimitTime, TypeKey(28)
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+	var cleaned int32
+	RegisterCleanExpired(cycle, typeKey, func(CycleType, TypeKey, *PlayerData) {
+		atomic.AddInt32(&cleaned, 1)
+	})
+	events := make(chan bool, 4)
+	RegisterActivityHook(typeKey, func(_ TypeKey, open bool, _, _ time.Time) {
+		events <- open
+	})
+
+	// 未开放时不创建数据
+	now := time.Now().Truncate(time.Second)
+	RegisterActivity(typeKey, ActivityWindow{Start: now.Add(time.Second), End: now.Add(2 * time.Second)})
+	if _, err := GetDataErr(cycle, typeKey, 1); !errors.Is(err, ErrInactive) || !errors.Is(err, ErrNoData) {
+		t.Fatalf("expected ErrInactive before start, got %v", err)
+	}
+
+	// 开启后记录在窗口结束时过期
+	select {
+	case open := <-events:
+		if !open {
+			t.Fatal("expected open event first")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("open hook not fired")
+	}
+	pd, err := GetDataErr(cycle, typeKey, 1)
+	if err != nil {
+		t.Fatalf("expected data while active, got %v", err)
+	}
+	if want := now.Add(2 * time.Second).Unix(); pd.ExpireTime != want {
+		t.Fatalf("expected expire at window end %d, got %d", want, pd.ExpireTime)
+	}
+
+	select {
+	case open := <-events:
+		if open {
+			t.Fatal("expected close event")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("close hook not fired")
+	}
+	deadline := time.Now().Add(time.Second)
+	for Stats(cycle, typeKey).Resident != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := Stats(cycle, typeKey); s.Resident != 0 || atomic.LoadInt32(&cleaned) != 1 {
+		t.Fatalf("expected record expired at window end, got %d resident, %d cleaned", s.Resident, cleaned)
+	}
+	if _, err := GetDataErr(cycle, typeKey, 1); !errors.Is(err, ErrInactive) {
+		t.Fatalf("expected ErrInactive after end, got %v", err)
+	}
+
+	// 加载器设置的过期时间晚于窗口结束时截断到窗口结束，更早的保持不变
+	typeKey = TypeKey(47)
+	end := now.Add(time.Hour)
+	RegisterActivity(typeKey, ActivityWindow{Start: now.Add(-time.Hour), End: end})
+	RegisterLoader(cycle, typeKey, func(_ CycleType, _ TypeKey, uid UserID) *PlayerData {
+		expire := end.Add(24 * time.Hour).Unix()
+		if uid == 2 {
+			expire = end.Add(-time.Minute).Unix()
+		}
+		return &PlayerData{UserID: uid, ExpireTime: expire, MiscData: make(map[string]interface{})}
+	})
+	store := New()
+	if pd, err := store.GetDataErr(cycle, typeKey, 1); err != nil || pd.ExpireTime != end.Unix() {
+		t.Fatalf("expected ExpireTime clamped to window end %d, got %v (%v)", end.Unix(), pd, err)
+	}
+	if pd, err := store.GetDataErr(cycle, typeKey, 2); err != nil || pd.ExpireTime != end.Add(-time.Minute).Unix() {
+		t.Fatalf("expected earlier ExpireTime kept, got %v (%v)", pd, err)
+	}
+}
+
+func TestActivityReschedulesFromCallbackTime(t *testing.T) {
+	typeKey := TypeKey(56)
+	type call struct {
+		open     bool
+		end, now time.Time
+	}
+	calls := make(chan call, 8)
+	var opens int32
+	RegisterActivityHook(typeKey, func(_ TypeKey, open bool, _, end time.Time) {
+		select {
+		case calls <- call{open: open, end: end, now: time.Now()}:
+		default:
+		}
+		if open && atomic.AddInt32(&opens, 1) == 1 {
+			// 第一次开启回调耗时超过整个窗口
+			time.Sleep(2500 * time.Millisecond)
+		}
+	})
+
+	now := time.Now().Truncate(time.Second)
+	RegisterActivity(typeKey, ActivityWindow{Start: now.Add(time.Second), End: now.Add(2 * time.Second), Repeat: 2 * time.Second})
+	defer RegisterActivity(typeKey, ActivityWindow{Start: now, End: now})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-calls:
+			if i == 0 {
+				if !c.open {
+					t.Fatal("expected open event first")
+				}
+				continue
+			}
+			if c.open || c.now.Sub(c.end) > 500*time.Millisecond {
+				t.Fatalf("expected close of the current window, got open=%v end %v at %v", c.open, c.end, c.now)
+			}
+		case <-time.After(6 * time.Second):
+			t.Fatalf("hook %d not fired", i)
+		}
+	}
+}
+
+func TestInt64Expiry(t *testing.T) {
+	// 旧的 int32 注册方式仍然可用
+	RegisterDefaultExpireFunc(MonthlyCycle, TypeKey(29), func() int32 { return 86400 })
+	RegisterDefaultExpireFunc64(MonthlyCycle, TypeKey(30), func() int64 { return 1 << 40 })
+	if got := DefaultExpireFor(MonthlyCycle, TypeKey(29)); got != 86400 {
+		t.Fatalf("expected int32 registration to be kept, got %d", got)
+	}
+	if got := DefaultExpireFor(MonthlyCycle, TypeKey(30)); got != 1<<40 {
+		t.Fatalf("expected int64 registration without truncation, got %d", got)
+	}
+	// 传入 nil 清除注册
+	RegisterDefaultExpireFunc(MonthlyCycle, TypeKey(29), nil)
+	if got := DefaultExpireFor(MonthlyCycle, TypeKey(29)); got != 0 {
+		t.Fatalf("expected registration cleared by nil, got %d", got)
+	}
+
+	// 2038 年之后的过期时间不会溢出
+	far := time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	col := newCollection()
+	col.data[1] = &PlayerData{UserID: 1, ExpireTime: far, MiscData: make(map[string]interface{})}
+	col.cleanExpired(time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC).Unix(), MonthlyCycle, TypeKey(30))
+	if _, ok := col.data[1]; !ok {
+		t.Fatal("record expiring in 2100 should survive a 2050 cleanup")
+	}
+	col.cleanExpired(far, MonthlyCycle, TypeKey(30))
+	if _, ok := col.data[1]; ok {
+		t.Fatal("record should expire at its int64 ExpireTime")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	cycle := MonthlyCycle
+	src := New()
+	now := time.Now()
+	live := &PlayerData{UserID: 1, UpdateTime: now, ExpireTime: now.Add(time.Hour).Unix(), MiscData: map[string]interface{}{
+		"coins": int32(10),
+		"big":   int64(1 << 40),
+		"name":  "hero",
+		"items": []int32{1, 2, 3},
+		"bag":   map[int32]int32{7: 2},
+		"other": struct{ A int }{A: 1},
+	}}
+	expired := &PlayerData{UserID: 2, ExpireTime: now.Unix() - 1, MiscData: map[string]interface{}{}}
+	// 尚未写入存储器的记录恢复后仍为脏数据
+	pending := &PlayerData{UserID: 3, ExpireTime: now.Add(time.Hour).Unix(), MiscData: map[string]interface{}{"coins": int32(3)}}
+	pending.markDirtyLocked()
+	col := src.h.getService(cycle, 0).getCollection(TypeKey(31))
+	col.data[1], col.data[2], col.data[3] = live, expired, pending
+
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+
+	dst := New()
+	if err := dst.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	restored, ok := dst.h.tryPeek(cycle, TypeKey(31), 1)
+	if !ok {
+		t.Fatal("expected live record restored")
+	}
+	if restored.ExpireTime != live.ExpireTime || !restored.UpdateTime.Equal(live.UpdateTime) || restored.IsDirty() {
+		t.Fatalf("unexpected restored record %+v", restored)
+	}
+	m := restored.MiscData
+	if m["coins"] != int32(10) || m["big"] != int64(1<<40) || m["name"] != "hero" {
+		t.Fatalf("scalar types not preserved: %#v", m)
+	}
+	if items, ok := m["items"].([]int32); !ok || len(items) != 3 {
+		t.Fatalf("[]int32 not preserved: %#v", m["items"])
+	}
+	if bag, ok := m["bag"].(map[int32]int32); !ok || bag[7] != 2 {
+		t.Fatalf("map[int32]int32 not preserved: %#v", m["bag"])
+	}
+	if other, ok := m["other"].(map[string]interface{}); !ok || other["A"] != float64(1) {
+		t.Fatalf("unregistered type should fall back to JSON: %#v", m["other"])
+	}
+	if _, ok := dst.h.tryPeek(cycle, TypeKey(31), 2); ok {
+		t.Fatal("expired record should be skipped")
+	}
+	if pd, ok := dst.h.tryPeek(cycle, TypeKey(31), 3); !ok || !pd.IsDirty() || pd.MiscData["coins"] != int32(3) {
+		t.Fatalf("expected dirty record restored as dirty, got %+v", pd)
+	}
+	if n := dst.h.findCollection(cycle, TypeKey(31)).dirty.count.Load(); n != 1 {
+		t.Fatalf("expected 1 dirty record counted after restore, got %d", n)
+	}
+
+	if err := dst.Restore(strings.NewReader(`{"format":"cycledata-snapshot","version":99}`)); !errors.Is(err, ErrSnapshotFormat) {
+		t.Fatalf("expected ErrSnapshotFormat for future version, got %v", err)
+	}
+}
+
+func TestWALReplayAndTruncate(t *testing.T) {
+	cycle, typeKey := MonthlyCycle, TypeKey(32)
+	dir := t.TempDir()
+
+	var loads, stored int32
+	RegisterLoader(cycle, typeKey, func(CycleType, TypeKey, UserID) *PlayerData {
+		atomic.AddInt32(&loads, 1)
+		return nil
+	})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+	RegisterStorer(cycle, typeKey, func(CycleType, TypeKey, *PlayerData) error {
+		atomic.AddInt32(&stored, 1)
+		return nil
+	})
+
+	if err := OpenWAL(dir, WALOptions{Sync: WALSyncEveryWrite}); err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	if err := OpenWAL(dir, WALOptions{}); !errors.Is(err, ErrWALOpen) {
+		t.Fatalf("expected ErrWALOpen, got %v", err)
+	}
+	cond := func(int32) bool { return true }
+	if !IncreaseIfCondInt32(cycle, typeKey, 1, "coins", 5, cond) || !IncreaseIfCondInt32(cycle, typeKey, 1, "coins", 2, cond) {
+		t.Fatal("increase failed")
+	}
+	if err := SetDataErr(cycle, typeKey, 2, map[string]interface{}{"items": []int32{4}}); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	// 模拟崩溃：不刷新直接关闭
+	if err := CloseWAL(); err != nil {
+		t.Fatalf("close wal: %v", err)
+	}
+
+	// 重放：不调用加载器，数据为脏
+	store := New()
+	if err := store.OpenWAL(dir, WALOptions{Sync: WALSyncNone}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	loadsBefore := atomic.LoadInt32(&loads)
+	pd, err := store.GetDataErr(cycle, typeKey, 1)
+	if err != nil || pd.MiscData["coins"] != int32(7) || !pd.IsDirty() {
+		t.Fatalf("expected replayed coins 7, got %v (%v)", pd, err)
+	}
+	if items, _ := store.GetData(cycle, typeKey, 2).MiscData["items"].([]int32); len(items) != 1 || items[0] != 4 {
+		t.Fatal("expected replayed items")
+	}
+	if atomic.LoadInt32(&loads) != loadsBefore {
+		t.Fatal("loader should not be consulted for replayed records")
+	}
+
+	// 刷新成功后段文件被截断
+	if err := store.FlushCtx(context.Background(), cycle, typeKey); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if atomic.LoadInt32(&stored) != 2 {
+		t.Fatalf("expected 2 records stored, got %d", stored)
+	}
+	if err := store.CloseWAL(); err != nil {
+		t.Fatalf("close wal: %v", err)
+	}
+	var size int64
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		info, _ := e.Info()
+		size += info.Size()
+	}
+	if size != 0 {
+		t.Fatalf("expected WAL truncated after flush, %d bytes in %d files", size, len(entries))
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	stamp := time.Unix(1700000000, 42)
+	misc := map[string]interface{}{
+		"coins": int32(10),
+		"big":   int64(1 << 40),
+		"name":  "hero",
+		"items": []int32{1, 2, 3},
+		"bag":   map[int32]int32{7: 2},
+		"at":    stamp,
+	}
+	for _, codec := range []Codec{JSONCodec, GobCodec, MsgpackCodec} {
+		raw, err := codec.Marshal(misc)
+		if err != nil {
+			t.Fatalf("%s marshal: %v", codec.Name(), err)
+		}
+		m, err := codec.Unmarshal(raw)
+		if err != nil {
+			t.Fatalf("%s unmarshal: %v", codec.Name(), err)
+		}
+		if m["coins"] != int32(10) || m["big"] != int64(1<<40) || m["name"] != "hero" {
+			t.Fatalf("%s: scalar types not preserved: %#v", codec.Name(), m)
+		}
+		if items, ok := m["items"].([]int32); !ok || len(items) != 3 || items[2] != 3 {
+			t.Fatalf("%s: []int32 not preserved: %#v", codec.Name(), m["items"])
+		}
+		if bag, ok := m["bag"].(map[int32]int32); !ok || bag[7] != 2 {
+			t.Fatalf("%s: map[int32]int32 not preserved: %#v", codec.Name(), m["bag"])
+		}
+		if at, ok := m["at"].(time.Time); !ok || !at.Equal(stamp) {
+			t.Fatalf("%s: time not preserved: %#v", codec.Name(), m["at"])
+		}
+	}
+
+	// 不带类型标签的旧 JSON
+	legacy, err := UnmarshalMiscData([]byte(`{"items":[1,2],"bag":{"5":6},"ratio":0.5}`))
+	if err != nil {
+		t.Fatalf("legacy: %v", err)
+	}
+	if items, ok := legacy["items"].([]int32); !ok || len(items) != 2 {
+		t.Fatalf("legacy slice not normalized: %#v", legacy["items"])
+	}
+	if bag, ok := legacy["bag"].(map[int32]int32); !ok || bag[5] != 6 {
+		t.Fatalf("legacy map not normalized: %#v", legacy["bag"])
+	}
+	if legacy["ratio"] != 0.5 {
+		t.Fatalf("non-integer values should be kept: %#v", legacy["ratio"])
+	}
+
+	// 加载器返回旧格式数据，cond 辅助函数仍然可用
+	cycle, typeKey := MonthlyCycle, TypeKey(33)
+	RegisterLoader(cycle, typeKey, func(_ CycleType, _ TypeKey, uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: map[string]interface{}{
+			"items": []interface{}{float64(1), float64(2)},
+			"bag":   map[string]interface{}{"5": float64(6)},
+		}}
+	})
+	if !AppendToInt32SliceIf(cycle, typeKey, 1, "items", 3, func([]int32) bool { return true }) {
+		t.Fatal("AppendToInt32SliceIf should accept a normalized legacy slice")
+	}
+	if !SetInInt32MapIf(cycle, typeKey, 1, "bag", 8, 9, func(map[int32]int32) bool { return true }) {
+		t.Fatal("SetInInt32MapIf should accept a normalized legacy map")
+	}
+
+	// 有 Schema 时按声明的类型转换
+	RegisterSchema(cycle, TypeKey(34), Schema{"scores": SpecOf[[]int64](nil), "coins": SpecOf[int32](0)})
+	m := map[string]interface{}{"scores": []interface{}{float64(1)}, "coins": float64(3)}
+	NormalizeMiscData(cycle, TypeKey(34), m)
+	if s, ok := m["scores"].([]int64); !ok || s[0] != 1 || m["coins"] != int32(3) {
+		t.Fatalf("schema normalization failed: %#v", m)
+	}
+}
+
+func TestVersionConflictMerge(t *testing.T) {
+	cycle := MonthlyCycle
+
+	// remote 模拟存储：另一台服务器可以直接修改
+	type remoteRecord struct {
+		version int64
+		coins   int32
+	}
+	var mu sync.Mutex
+	remote := make(map[TypeKey]*remoteRecord)
+	register := func(typeKey TypeKey) {
+		RegisterLoader(cycle, typeKey, func(_ CycleType, typeKey TypeKey, uid UserID) *PlayerData {
+			mu.Lock()
+			defer mu.Unlock()
+			rec, ok := remote[typeKey]
+			if !ok {
+				return nil
+			}
+			return &PlayerData{UserID: uid, Version: rec.version, MiscData: map[string]interface{}{"coins": rec.coins}}
+		})
+		RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+			return &PlayerData{UserID: uid, MiscData: map[string]interface{}{"coins": int32(0)}}
+		})
+		RegisterStorer(cycle, typeKey, func(_ CycleType, typeKey TypeKey, data *PlayerData) error {
+			mu.Lock()
+			defer mu.Unlock()
+			var current int64
+			if rec, ok := remote[typeKey]; ok {
+				current = rec.version
+			}
+			if current != data.Version {
+				return ErrVersionConflict
+			}
+			remote[typeKey] = &remoteRecord{version: data.Version + 1, coins: data.MiscData["coins"].(int32)}
+			return nil
+		})
+	}
+	register(TypeKey(35))
+	register(TypeKey(36))
+	RegisterMergeHook(cycle, TypeKey(35), func(_ CycleType, _ TypeKey, local, remote *PlayerData) error {
+		local.MiscData["coins"] = local.MiscData["coins"].(int32) + remote.MiscData["coins"].(int32)
+		return nil
+	})
+
+	cond := func(int32) bool { return true }
+	for _, typeKey := range []TypeKey{35, 36} {
+		pd, err := GetDataErr(cycle, typeKey, 1)
+		if err != nil || pd.Version != 0 {
+			t.Fatalf("expected new record at version 0, got %v (%v)", pd, err)
+		}
+		if !IncreaseIfCondInt32(cycle, typeKey, 1, "coins", 5, cond) {
+			t.Fatal("increase failed")
+		}
+		// 另一台服务器先写入
+		mu.Lock()
+		remote[typeKey] = &remoteRecord{version: 1, coins: 100}
+		mu.Unlock()
+	}
+
+	// 有合并函数：重新加载、合并后以新版本写入
+	pd, _ := defaultStore.h.tryPeek(cycle, TypeKey(35), 1)
+	if err := FlushCtx(context.Background(), cycle, TypeKey(35)); err != nil {
+		t.Fatalf("flush with merge hook: %v", err)
+	}
+	mu.Lock()
+	merged := *remote[35]
+	mu.Unlock()
+	if pd.Version != 2 || pd.IsDirty() || merged.version != 2 || merged.coins != 105 {
+		t.Fatalf("expected merged coins 105 at version 2, got local v%d, remote %+v", pd.Version, merged)
+	}
+
+	// 无合并函数：写入失败，远端数据不被覆盖
+	err := FlushCtx(context.Background(), cycle, TypeKey(36))
+	if !errors.Is(err, ErrStoreFailed) || !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("expected version conflict store failure, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if remote[36].coins != 100 {
+		t.Fatalf("remote data clobbered: %+v", *remote[36])
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	cycle := MonthlyCycle
+	for _, typeKey := range []TypeKey{37, 38} {
+		RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+			return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+		})
+	}
+
+	// 同步订阅：回调中可以读取同一玩家的数据
+	var events []Event
+	sub := Subscribe(cycle, TypeKey(37), func(ev Event) {
+		if _, err := GetDataErr(ev.Cycle, ev.TypeKey, ev.UserID); err != nil {
+			t.Errorf("read in callback: %v", err)
+		}
+		events = append(events, ev)
+	})
+	cond := func(int32) bool { return true }
+	IncreaseIfCondInt32(cycle, TypeKey(37), 1, "coins", 5, cond)
+	IncreaseIfCondInt32(cycle, TypeKey(37), 1, "coins", 2, cond)
+	IncreaseIfCondInt32(cycle, TypeKey(37), 1, "coins", 2, func(int32) bool { return false })
+	SetInInt32MapIf(cycle, TypeKey(37), 1, "bag", 1, 10, func(map[int32]int32) bool { return true })
+	SetInInt32MapIf(cycle, TypeKey(37), 1, "bag", 2, 20, func(map[int32]int32) bool { return true })
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events, got %d: %+v", len(events), events)
+	}
+	if ev := events[0]; ev.Old != nil || ev.New != int32(5) || ev.Key != "coins" || ev.Op != OpField || ev.UserID != 1 {
+		t.Fatalf("unexpected first event %+v", ev)
+	}
+	if ev := events[1]; ev.Old != int32(5) || ev.New != int32(7) {
+		t.Fatalf("unexpected second event %+v", ev)
+	}
+	if old, _ := events[3].Old.(map[int32]int32); len(old) != 1 || len(events[3].New.(map[int32]int32)) != 2 {
+		t.Fatalf("in-place map update should report the previous map: %+v", events[3])
+	}
+
+	// 覆盖与事务按差异逐键投递
+	events = nil
+	if err := SetDataErr(cycle, TypeKey(37), 1, map[string]interface{}{"coins": int32(7), "name": "hero"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected name added and bag removed, got %+v", events)
+	}
+	for _, ev := range events {
+		if ev.Op != OpSetData || (ev.Key == "bag" && ev.New != nil) || (ev.Key == "name" && ev.New != "hero") {
+			t.Fatalf("unexpected set event %+v", ev)
+		}
+	}
+	events = nil
+	if err := Txn(func(tx *Tx) error {
+		return TxSet(tx, NewField[int32](cycle, TypeKey(37), "coins"), 1, 9)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Op != OpTxn || events[0].Old != int32(7) || events[0].New != int32(9) {
+		t.Fatalf("unexpected txn events %+v", events)
+	}
+
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	events = nil
+	IncreaseIfCondInt32(cycle, TypeKey(37), 1, "coins", 1, cond)
+	if len(events) != 0 || sub.Stats().Delivered != 7 {
+		t.Fatalf("unsubscribed callback invoked, stats %+v", sub.Stats())
+	}
+
+	// 异步订阅：队列已满时丢弃并计数，修改方不阻塞
+	release := make(chan struct{})
+	delivered := make(chan Event, 16)
+	async := SubscribeAsync(cycle, TypeKey(38), 2, func(ev Event) {
+		<-release
+		delivered <- ev
+	})
+	for i := 0; i < 10; i++ {
+		IncreaseIfCondInt32(cycle, TypeKey(38), 1, "coins", 1, cond)
+	}
+	close(release)
+	if ev := <-delivered; ev.New != int32(1) {
+		t.Fatalf("expected events delivered in order, got %+v", ev)
+	}
+	async.Unsubscribe()
+	deadline := time.Now().Add(time.Second)
+	for stats := async.Stats(); stats.Delivered+stats.Dropped < 10 && time.Now().Before(deadline); stats = async.Stats() {
+		time.Sleep(time.Millisecond)
+	}
+	stats := async.Stats()
+	if stats.Dropped == 0 || stats.Dropped+stats.Delivered != 10 || stats.Queued != 0 {
+		t.Fatalf("unexpected async stats %+v", stats)
+	}
+}
+
+func TestIterateResidents(t *testing.T) {
+	cycle, typeKey := MonthlyCycle, TypeKey(39)
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: map[string]interface{}{"level": int32(uid)}}
+	})
+
+	store := New()
+	if store.Count(cycle, typeKey) != 0 || store.Keys(cycle, typeKey) != nil {
+		t.Fatal("expected empty collection")
+	}
+	for _, uid := range []UserID{5, 3, 1, 4, 2} {
+		if _, err := store.GetDataErr(cycle, typeKey, uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 已过期的记录不出现在结果中
+	col := store.h.findCollection(cycle, typeKey)
+	col.data[9] = &PlayerData{UserID: 9, ExpireTime: time.Now().Unix() - 1, MiscData: map[string]interface{}{}}
+
+	keys := store.Keys(cycle, typeKey)
+	if len(keys) != 5 || keys[0] != 1 || keys[4] != 5 {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	// Count 只读取集合大小，尚未清理的过期记录也计入
+	if n := store.Count(cycle, typeKey); n != 6 {
+		t.Fatalf("expected Count to include the uncleaned expired record, got %d", n)
+	}
+
+	var high []UserID
+	store.ForEachWhere(cycle, typeKey, func(misc map[string]interface{}) bool {
+		return misc["level"].(int32) >= 3
+	}, func(data *PlayerData) bool {
+		high = append(high, data.UserID)
+		return true
+	})
+	if len(high) != 3 {
+		t.Fatalf("expected 3 records with level >= 3, got %v", high)
+	}
+
+	visited := 0
+	store.ForEach(cycle, typeKey, func(*PlayerData) bool {
+		visited++
+		return visited < 2
+	})
+	if visited != 2 {
+		t.Fatalf("expected iteration to stop after 2 records, visited %d", visited)
+	}
+
+	// 遍历期间不持有集合锁：回调中可以加载新玩家
+	store.ForEach(cycle, typeKey, func(data *PlayerData) bool {
+		if _, err := store.GetDataErr(cycle, typeKey, data.UserID+100); err != nil {
+			t.Errorf("load during iteration: %v", err)
+		}
+		return true
+	})
+	if store.Count(cycle, typeKey) != 11 {
+		t.Fatalf("expected 11 residents after loading during iteration, got %d", store.Count(cycle, typeKey))
+	}
+}
+
+func TestSchemaRejectsLossyConversion(t *testing.T) {
+	cycle := DailyCycle
+	typeKey := TypeKey(40)
+	userID := UserID(40040)
+
+	schema := Schema{
+		"level": SpecOf[int32](0).WithRange(0, 100),
+		"count": SpecOf[uint32](0),
+	}
+	RegisterSchema(cycle, typeKey, schema)
+	// 注册后修改调用方的 map 不影响已注册的 Schema
+	delete(schema, "level")
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid}
+	})
+
+	pd := GetData(cycle, typeKey, userID)
+	if pd == nil {
+		t.Fatalf("GetData failed")
+	}
+
+	// 1<<32 + 5 转为 int32 会回绕成 5，必须按原值拒绝
+	lossy := []struct {
+		key   string
+		value interface{}
+	}{
+		{"level", int64(1<<32 + 5)},
+		{"level", 1.5},
+		{"count", -1},
+	}
+	for _, c := range lossy {
+		if err := SetDataErr(cycle, typeKey, userID, map[string]interface{}{c.key: c.value}); !errors.Is(err, ErrSchemaViolation) {
+			t.Errorf("expected %v (%T) rejected for %q, got %v", c.value, c.value, c.key, err)
+		}
+	}
+
+	if err := SetDataErr(cycle, typeKey, userID, map[string]interface{}{"level": int64(42), "count": 7}); err != nil {
+		t.Fatalf("expected lossless conversion accepted, got %v", err)
+	}
+	if v, ok := GetData(cycle, typeKey, userID).MiscData["level"].(int32); !ok || v != 42 {
+		t.Errorf("expected level=int32(42), got %v", GetData(cycle, typeKey, userID).MiscData["level"])
+	}
+}
+
+func TestSetMiscDataCondRunsOnCopy(t *testing.T) {
+	cycle := DailyCycle
+	typeKey := TypeKey(41)
+	userID := UserID(41041)
+
+	RegisterSchema(cycle, typeKey, Schema{
+		"coins": SpecOf[int64](0).WithRange(0, 100),
+	})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid}
+	})
+	pd := GetData(cycle, typeKey, userID)
+	pd.mu.Lock()
+	pd.markCleanLocked()
+	pd.mu.Unlock()
+
+	// 原地修改后校验失败：返回 Schema 错误，内存中的数据不变
+	err := SetMiscDataMapCondErr(cycle, typeKey, userID, func(m map[string]interface{}) (bool, map[string]interface{}) {
+		m["coins"] = int64(500)
+		return true, nil
+	})
+	if !errors.Is(err, ErrSchemaViolation) {
+		t.Fatalf("expected schema violation, got %v", err)
+	}
+	if v := pd.MiscData["coins"]; v != int64(0) || pd.IsDirty() {
+		t.Fatalf("expected coins unchanged and record clean, got %v dirty=%v", v, pd.IsDirty())
+	}
+
+	// cond 拒绝时同样不生效
+	err = SetWithAllMiscDataErr(cycle, typeKey, userID, func(_ time.Time, m map[string]interface{}) (bool, map[string]interface{}, bool) {
+		m["coins"] = int64(50)
+		return false, nil, true
+	})
+	if !errors.Is(err, ErrConditionFailed) || pd.MiscData["coins"] != int64(0) {
+		t.Fatalf("expected ErrConditionFailed and coins unchanged, got %v %v", err, pd.MiscData["coins"])
+	}
+
+	result, err := SetMiscDataMapCondMapStringErr(cycle, typeKey, userID, nil,
+		func(m, r map[string]interface{}) (bool, map[string]interface{}, map[string]interface{}) {
+			m["coins"] = 60
+			return true, nil, map[string]interface{}{"ok": true}
+		})
+	if err != nil || result["ok"] != true {
+		t.Fatalf("expected success with result map, got %v %v", err, result)
+	}
+	if v := pd.MiscData["coins"]; v != int64(60) || !pd.IsDirty() {
+		t.Errorf("expected coins=int64(60) and record dirty, got %T %v dirty=%v", v, v, pd.IsDirty())
+	}
+}
+
+func TestFlushOutsideCollectionLock(t *testing.T) {
+	cycle := DailyCycle
+	typeKey := TypeKey(42)
+
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+	// 存储器写入时访问同一集合的其他玩家，持有集合锁写入会死锁
+	RegisterStorer(cycle, typeKey, func(_ CycleType, _ TypeKey, data *PlayerData) error {
+		if data.UserID == 1 {
+			UpdateIf(cycle, typeKey, 2, "touched", true, func(_, _ interface{}) bool { return true })
+		}
+		return nil
+	})
+
+	GetData(cycle, typeKey, 1).MarkDirty()
+	GetData(cycle, typeKey, 2)
+	col := defaultStore.h.findCollection(cycle, typeKey)
+	if n := col.dirty.count.Load(); n != 1 {
+		t.Fatalf("expected dirty counter 1, got %d", n)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Flush(cycle, typeKey)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("flush blocked on the collection lock")
+	}
+
+	// 写入期间被修改的玩家 2 继续常驻，未修改的玩家 1 已移出
+	if keys := Keys(cycle, typeKey); len(keys) != 1 || keys[0] != 2 {
+		t.Fatalf("expected only the re-dirtied record resident, got %v", keys)
+	}
+	if n := col.dirty.count.Load(); n != 1 {
+		t.Errorf("expected dirty counter 1 after flush, got %d", n)
+	}
+	Flush(cycle, typeKey)
+	if n := col.dirty.count.Load(); n != 0 || Count(cycle, typeKey) != 0 {
+		t.Errorf("expected collection empty and counter 0, got %d/%d", n, Count(cycle, typeKey))
+	}
+}
+
+func TestMutationsSurviveConcurrentFlush(t *testing.T) {
+	cycle := DailyCycle
+	typeKey := TypeKey(53)
+
+	var (
+		mu     sync.Mutex
+		stored = make(map[UserID]int)
+	)
+	RegisterLoader(cycle, typeKey, func(_ CycleType, _ TypeKey, uid UserID) *PlayerData {
+		mu.Lock()
+		defer mu.Unlock()
+		n, ok := stored[uid]
+		if !ok {
+			return nil
+		}
+		return &PlayerData{UserID: uid, MiscData: map[string]interface{}{"n": n}}
+	})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+	RegisterStorer(cycle, typeKey, func(_ CycleType, _ TypeKey, data *PlayerData) error {
+		mu.Lock()
+		defer mu.Unlock()
+		stored[data.UserID], _ = data.MiscData["n"].(int)
+		return nil
+	})
+
+	s := New()
+	stop := make(chan struct{})
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = s.FlushCtx(context.Background(), cycle, typeKey)
+			}
+		}
+	}()
+
+	const workers, rounds = 20, 1000
+	always := func(int) bool { return true }
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				if !s.IncreaseIfCondInt(cycle, typeKey, 1, "n", 1, always) {
+					t.Error("increase failed")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-flushed
+
+	if err := s.FlushCtx(context.Background(), cycle, typeKey); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := stored[1]; got != workers*rounds {
+		t.Fatalf("expected %d increments persisted, got %d", workers*rounds, got)
+	}
+}
+
+func TestRetryWithoutDeadLetterKeepsRecord(t *testing.T) {
+	cycle := MonthlyCycle
+	typeKey := TypeKey(43)
+
+	var failing atomic.Bool
+	failing.Store(true)
+	RegisterStorer(cycle, typeKey, func(CycleType, TypeKey, *PlayerData) error {
+		if failing.Load() {
+			return errors.New("db down")
+		}
+		return nil
+	})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+	RegisterRetryPolicy(cycle, typeKey, RetryPolicy{MaxAttempts: 1, BaseDelay: time.Hour, MaxDelay: 2 * time.Hour})
+
+	data := GetData(cycle, typeKey, 1)
+	data.MarkDirty()
+	data.mu.Lock()
+	data.ExpireTime = time.Now().Unix() - 1
+	data.mu.Unlock()
+	// 过期记录写入失败后已不在内存中，只有重试队列持有它
+	CleanExpiredDataByType(cycle, typeKey)
+
+	q := defaultStore.h.retry
+	later := time.Now().Add(24 * time.Hour)
+	for i := 0; i < 3; i++ {
+		q.process(context.Background(), later)
+		later = later.Add(24 * time.Hour)
+	}
+	if n := q.count(cycle, typeKey); n != 1 || !data.IsDirty() {
+		t.Fatalf("expected record kept queued without dead-letter handler, got %d dirty=%v", n, data.IsDirty())
+	}
+
+	failing.Store(false)
+	q.process(context.Background(), later)
+	if n := q.count(cycle, typeKey); n != 0 || data.IsDirty() {
+		t.Errorf("expected record stored after recovery, got %d dirty=%v", n, data.IsDirty())
+	}
+}
+
+func TestStoreScopedMutations(t *testing.T) {
+	cycle := WeeklyCycle
+	typeKey := TypeKey(44)
+	userID := UserID(44044)
+
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+
+	// 默认实例风格的实例在首次访问数据前不启动后台任务
+	s := newDefaultStore()
+	if s.running {
+		t.Fatalf("expected store not started before first access")
+	}
+
+	coins := NewField[int64](cycle, typeKey, "coins")
+	if err := coins.In(s).Set(userID, 10); err != nil {
+		t.Fatalf("Field.In Set failed: %v", err)
+	}
+	if !s.running {
+		t.Fatalf("expected store started lazily on first access")
+	}
+	defer s.Stop(context.Background())
+
+	if !s.IncreaseIfCondInt64(cycle, typeKey, userID, "coins", 5, func(int64) bool { return true }) ||
+		!s.AppendToInt32SliceIf(cycle, typeKey, userID, "items", 7, func([]int32) bool { return true }) ||
+		!s.SetMiscDataMapCond(cycle, typeKey, userID, func(m map[string]interface{}) (bool, map[string]interface{}) {
+			m["flag"] = true
+			return true, nil
+		}) {
+		t.Fatalf("expected store mutations to succeed")
+	}
+
+	misc := s.GetDataValue(cycle, typeKey, userID)
+	if misc["coins"] != int64(15) || misc["flag"] != true || len(misc["items"].([]int32)) != 1 {
+		t.Fatalf("unexpected store data %v", misc)
+	}
+	if v, err := coins.Get(userID); err != nil || v != 0 {
+		t.Errorf("expected default store untouched, got %v %v", v, err)
+	}
+}
+
+func TestSetDataWALUnderContention(t *testing.T) {
+	cycle, typeKey := MonthlyCycle, TypeKey(45)
+	dir := t.TempDir()
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+
+	src := New()
+	if err := src.OpenWAL(dir, WALOptions{Sync: WALSyncNone}); err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+
+	// 读请求持续占用集合读锁，SetData 仍然必须写入 WAL
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					src.Count(cycle, typeKey)
+					src.GetData(cycle, typeKey, 1)
+				}
+			}
+		}()
+	}
+	var writers sync.WaitGroup
+	for uid := UserID(1); uid <= 50; uid++ {
+		writers.Add(1)
+		go func(uid UserID) {
+			defer writers.Done()
+			for round := int32(1); round <= 2; round++ {
+				if err := src.SetDataErr(cycle, typeKey, uid, map[string]interface{}{"round": round}); err != nil {
+					t.Errorf("set uid %d: %v", uid, err)
+				}
+			}
+		}(uid)
+	}
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+	if err := src.CloseWAL(); err != nil {
+		t.Fatalf("close wal: %v", err)
+	}
+
+	dst := New()
+	if err := dst.OpenWAL(dir, WALOptions{Sync: WALSyncNone}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	defer dst.CloseWAL()
+	for uid := UserID(1); uid <= 50; uid++ {
+		pd, ok := dst.h.tryPeek(cycle, typeKey, uid)
+		if !ok || pd.MiscData["round"] != int32(2) {
+			t.Fatalf("expected uid %d replayed with round 2, got %v", uid, pd)
+		}
+	}
+}
+
+func TestNormalizeKeepsOutOfRangeIntegers(t *testing.T) {
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(`{"small":[1,-2,3],"big":[1,3000000000],"frac":[1,2.5],"bigMap":{"1":3000000000}}`), &m); err != nil {
+		t.Fatal(err)
+	}
+	NormalizeMiscData(DailyCycle, TypeKey(46), m)
+
+	if s, ok := m["small"].([]int32); !ok || len(s) != 3 || s[1] != -2 {
+		t.Fatalf("expected small to narrow to []int32, got %#v", m["small"])
+	}
+	// 超出 int32 范围或含小数的不能截断，保持原样
+	if s, ok := m["big"].([]interface{}); !ok || s[1] != float64(3000000000) {
+		t.Fatalf("expected big to stay []interface{} with 3000000000, got %#v", m["big"])
+	}
+	if _, ok := m["frac"].([]interface{}); !ok {
+		t.Fatalf("expected frac to stay []interface{}, got %#v", m["frac"])
+	}
+	if mm, ok := m["bigMap"].(map[string]interface{}); !ok || mm["1"] != float64(3000000000) {
+		t.Fatalf("expected bigMap to stay untouched, got %#v", m["bigMap"])
+	}
+
+	if _, ok := coerce[[]int32](m["big"]); ok {
+		t.Fatal("an out-of-range slice should not be read as []int32")
+	}
+}
+
+func TestSnapshotBeforeStopKeepsVersion(t *testing.T) {
+	cycle, typeKey := MonthlyCycle, TypeKey(48)
+	var (
+		mu      sync.Mutex
+		version int64
+	)
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: map[string]interface{}{}}
+	})
+	RegisterStorer(cycle, typeKey, func(_ CycleType, _ TypeKey, data *PlayerData) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if data.Version != version {
+			return ErrVersionConflict
+		}
+		version++
+		return nil
+	})
+
+	src := New()
+	coins := NewField[int32](cycle, typeKey, "coins").In(src)
+	if err := coins.Set(1, 5); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	// 按文档顺序：先快照再 Stop
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if err := src.Stop(context.Background()); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	dst := New()
+	if err := dst.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	pd, ok := dst.h.tryPeek(cycle, typeKey, 1)
+	if !ok || pd.IsDirty() || pd.Version != 1 {
+		t.Fatalf("expected clean record at the stored version 1, got %+v", pd)
+	}
+	if err := coins.In(dst).Set(1, 6); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := dst.FlushCtx(context.Background(), cycle, typeKey); err != nil {
+		t.Fatalf("expected flush after restore without version conflict, got %v", err)
+	}
+}
+
+func TestWALReplayReplacesResidentAndSkipsStale(t *testing.T) {
+	cycle, typeKey := MonthlyCycle, TypeKey(49)
+	dir := t.TempDir()
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+	RegisterStorer(cycle, typeKey, func(CycleType, TypeKey, *PlayerData) error { return nil })
+
+	src := New()
+	if err := src.OpenWAL(dir, WALOptions{Sync: WALSyncNone}); err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	coins := NewField[int32](cycle, typeKey, "coins").In(src)
+	if err := coins.Set(1, 7); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := coins.Set(2, 1); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	// uid 2 的最后一条日志已过期
+	stale, _ := src.h.tryPeek(cycle, typeKey, 2)
+	stale.mu.Lock()
+	stale.ExpireTime = time.Now().Unix() - 1
+	src.h.logMutationLocked(cycle, typeKey, stale)
+	stale.mu.Unlock()
+	if err := src.CloseWAL(); err != nil {
+		t.Fatalf("close wal: %v", err)
+	}
+
+	// 启动前 Restore 放入的脏记录被日志替换
+	dst := New()
+	col := dst.h.getService(cycle, 0).getCollection(typeKey)
+	resident := &PlayerData{UserID: 1, MiscData: map[string]interface{}{"coins": int32(3)}}
+	resident.markDirtyLocked()
+	col.mu.Lock()
+	col.putLocked(resident)
+	col.mu.Unlock()
+
+	if err := dst.OpenWAL(dir, WALOptions{Sync: WALSyncNone}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	defer dst.CloseWAL()
+	if pd, ok := dst.h.tryPeek(cycle, typeKey, 1); !ok || pd == resident || pd.MiscData["coins"] != int32(7) {
+		t.Fatalf("expected uid 1 replaced by the WAL record, got %+v", pd)
+	}
+	if _, ok := dst.h.tryPeek(cycle, typeKey, 2); ok {
+		t.Fatal("stale record should not be replayed")
+	}
+	if n := col.dirty.count.Load(); n != 1 {
+		t.Fatalf("expected 1 dirty record after replay, got %d", n)
+	}
+
+	if err := dst.FlushCtx(context.Background(), cycle, typeKey); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if n := col.dirty.count.Load(); n != 0 {
+		t.Fatalf("expected no dirty records after flush, got %d", n)
+	}
+	var size int64
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		info, _ := e.Info()
+		size += info.Size()
+	}
+	if size != 0 {
+		t.Fatalf("expected WAL truncated after flush, %d bytes in %d files", size, len(entries))
+	}
+}
+
+func TestMergeValidatedLoggedAndPublished(t *testing.T) {
+	cycle, typeKey := MonthlyCycle, TypeKey(50)
+	var (
+		mu           sync.Mutex
+		remoteVer    int64
+		remoteCoins  int32
+		remoteExists bool
+	)
+	RegisterSchema(cycle, typeKey, Schema{"coins": SpecOf[int32](0).WithRange(0, 1000)})
+	RegisterLoader(cycle, typeKey, func(_ CycleType, _ TypeKey, uid UserID) *PlayerData {
+		mu.Lock()
+		defer mu.Unlock()
+		if !remoteExists {
+			return nil
+		}
+		return &PlayerData{UserID: uid, Version: remoteVer, MiscData: map[string]interface{}{"coins": remoteCoins}}
+	})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: map[string]interface{}{}}
+	})
+	RegisterStorer(cycle, typeKey, func(_ CycleType, _ TypeKey, data *PlayerData) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if data.Version != remoteVer {
+			return ErrVersionConflict
+		}
+		remoteVer, remoteCoins, remoteExists = data.Version+1, data.MiscData["coins"].(int32), true
+		return nil
+	})
+	RegisterMergeHook(cycle, typeKey, func(_ CycleType, _ TypeKey, local, remote *PlayerData) error {
+		local.MiscData["coins"] = local.MiscData["coins"].(int32) + remote.MiscData["coins"].(int32)
+		if remote.MiscData["coins"] == int32(777) {
+			panic("merge hook failed halfway")
+		}
+		return nil
+	})
+
+	s := New()
+	if err := s.OpenWAL(t.TempDir(), WALOptions{Sync: WALSyncNone}); err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	defer s.CloseWAL()
+	var events []Event
+	sub := s.Subscribe(cycle, typeKey, func(ev Event) { events = append(events, ev) })
+	defer sub.Unsubscribe()
+
+	coins := NewField[int32](cycle, typeKey, "coins").In(s)
+	if err := coins.Set(1, 5); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	pd, _ := s.h.tryPeek(cycle, typeKey, 1)
+	seqBefore := pd.walSeq
+
+	// 另一台服务器先写入，合并结果写入 WAL 并投递事件
+	mu.Lock()
+	remoteVer, remoteCoins, remoteExists = 1, 100, true
+	mu.Unlock()
+	events = nil
+	if err := s.FlushCtx(context.Background(), cycle, typeKey); err != nil {
+		t.Fatalf("flush with merge: %v", err)
+	}
+	if pd.walSeq <= seqBefore {
+		t.Fatal("expected merged data logged to the WAL")
+	}
+	if len(events) != 1 || events[0].Op != OpMerge || events[0].Old != int32(5) || events[0].New != int32(105) {
+		t.Fatalf("unexpected merge events %+v", events)
+	}
+
+	// 合并结果违反 Schema 时不写入，MiscData 恢复为合并前的内容
+	if err := coins.Set(1, 10); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	mu.Lock()
+	remoteVer, remoteCoins = 5, 995
+	mu.Unlock()
+	events = nil
+	if err := s.FlushCtx(context.Background(), cycle, typeKey); !errors.Is(err, ErrStoreFailed) {
+		t.Fatalf("expected store failure for an invalid merge, got %v", err)
+	}
+	if v, _ := coins.Get(1); v != 10 || len(events) != 0 {
+		t.Fatalf("expected coins 10 kept without events, got %v, %+v", v, events)
+	}
+
+	// 合并函数 panic 时同样恢复为合并前的内容
+	mu.Lock()
+	remoteVer, remoteCoins = 6, 777
+	mu.Unlock()
+	if err := s.FlushCtx(context.Background(), cycle, typeKey); !errors.Is(err, ErrStoreFailed) {
+		t.Fatalf("expected store failure for a panicking merge, got %v", err)
+	}
+	if v, _ := coins.Get(1); v != 10 || len(events) != 0 {
+		t.Fatalf("expected coins 10 kept after merge panic, got %v, %+v", v, events)
+	}
+}
+
+func TestStartWaitsForTimedOutStop(t *testing.T) {
+	cycle, typeKey := WeeklyCycle, TypeKey(51)
+	release := make(chan struct{})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+	RegisterStorerCtx(cycle, typeKey, func(context.Context, CycleType, TypeKey, *PlayerData) error {
+		<-release
+		return nil
+	})
+
+	s := New()
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.GetData(cycle, typeKey, 1).MarkDirty()
+
+	short, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Stop(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Stop to time out, got %v", err)
+	}
+	// 后台刷新未完成前 Start 不会启动
+	if err := s.Start(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Start to wait for the previous Stop, got %v", err)
+	}
+
+	started := make(chan error, 1)
+	go func() { started <- s.Start(context.Background()) }()
+	select {
+	case err := <-started:
+		t.Fatalf("Start returned before the previous Stop finished: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if err := <-started; err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+}
+
+func TestAsyncEventsKeepRecordOrder(t *testing.T) {
+	cycle, typeKey := MonthlyCycle, TypeKey(52)
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: map[string]interface{}{}}
+	})
+
+	const workers, rounds = 8, 200
+	s := New()
+	var (
+		mu   sync.Mutex
+		seen []int32
+	)
+	done := make(chan struct{})
+	sub := s.SubscribeAsync(cycle, typeKey, workers*rounds, func(ev Event) {
+		mu.Lock()
+		seen = append(seen, ev.New.(int32))
+		if len(seen) == workers*rounds {
+			close(done)
+		}
+		mu.Unlock()
+	})
+	defer sub.Unsubscribe()
+
+	progress := NewField[int32](cycle, typeKey, "progress").In(s)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				_ = IncreaseIf(progress, 1, 1, func(int32) bool { return true })
+			}
+		}()
+	}
+	wg.Wait()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, v := range seen {
+		if v != int32(i+1) {
+			t.Fatalf("event %d carries progress %d, events delivered out of order", i, v)
+		}
+	}
+}
+
+func TestDirtyAgeOnlyMovesEarlier(t *testing.T) {
+	col := newCollection()
+	now := time.Now()
+
+	// 登记时只会调早
+	col.dirty.add(now)
+	col.dirty.add(now.Add(time.Second))
+	if got := col.dirty.oldest.Load(); got != now.UnixNano() {
+		t.Fatalf("expected oldest %d, got %d", now.UnixNano(), got)
+	}
+	col.dirty.add(now.Add(-time.Second))
+	if got := col.dirty.oldest.Load(); got != now.Add(-time.Second).UnixNano() {
+		t.Fatalf("expected add to lower oldest, got %d", got)
+	}
+
+	// 重新计算时按常驻的脏记录取最早值
+	pd := &PlayerData{UserID: 1, MiscData: map[string]interface{}{}}
+	col.mu.Lock()
+	col.putLocked(pd)
+	col.mu.Unlock()
+	col.dirty.count.Store(0)
+	pd.mu.Lock()
+	pd.markDirtyLocked()
+	dirtyAt := pd.dirtyAt
+	pd.mu.Unlock()
+	col.refreshDirtyAge()
+	if got := col.dirty.oldest.Load(); got != dirtyAt.UnixNano() {
+		t.Fatalf("expected oldest reset to the resident dirty record, got %d want %d", got, dirtyAt.UnixNano())
+	}
+
+	// 没有漏记的脏记录时清零
+	pd.mu.Lock()
+	pd.markCleanLocked()
+	pd.mu.Unlock()
+	col.refreshDirtyAge()
+	if got := col.dirty.oldest.Load(); got != 0 {
+		t.Fatalf("expected oldest cleared, got %d", got)
+	}
+}
+
+func TestSetDataCopiesInputAndCreatesOutsideLock(t *testing.T) {
+	cycle, typeKey := WeeklyCycle, TypeKey(57)
+	RegisterSchema(cycle, typeKey, Schema{"coins": SpecOf[int32](0), "level": SpecOf[int32](5)})
+	gate := make(chan struct{})
+	entered := make(chan struct{})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		if uid == 1 {
+			close(entered)
+			<-gate
+		}
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+
+	s := New()
+	input := map[string]interface{}{"coins": 7}
+	done := make(chan error, 1)
+	go func() { done <- s.SetDataErr(cycle, typeKey, 1, input) }()
+	<-entered
+
+	// 创建器执行期间其他玩家的读取不被阻塞
+	got := make(chan error, 1)
+	go func() {
+		_, err := s.GetDataErr(cycle, typeKey, 2)
+		got <- err
+	}()
+	select {
+	case err := <-got:
+		if err != nil {
+			t.Fatalf("get uid 2: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("get of another user blocked by a slow creator in SetData")
+	}
+	close(gate)
+	if err := <-done; err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	// 调用方的 map 不被校验改写，之后的修改也不影响记录
+	if len(input) != 1 || input["coins"] != 7 {
+		t.Fatalf("caller map mutated: %#v", input)
+	}
+	input["coins"] = 99
+	pd, err := s.GetDataErr(cycle, typeKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pd.MiscData["coins"] != int32(7) || pd.MiscData["level"] != int32(5) {
+		t.Fatalf("expected validated copy with defaults, got %#v", pd.MiscData)
+	}
+}
+
+func TestStoreDoesNotHoldRecordLock(t *testing.T) {
+	cycle, typeKey := MonthlyCycle, TypeKey(58)
+	var (
+		mu     sync.Mutex
+		stored []int
+	)
+	entered := make(chan struct{}, 1)
+	gate := make(chan struct{})
+	RegisterCreator(cycle, typeKey, func(uid UserID) *PlayerData {
+		return &PlayerData{UserID: uid, MiscData: make(map[string]interface{})}
+	})
+	RegisterStorer(cycle, typeKey, func(_ CycleType, _ TypeKey, data *PlayerData) error {
+		select {
+		case entered <- struct{}{}:
+			<-gate
+		default:
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		n, _ := data.MiscData["n"].(int)
+		stored = append(stored, n)
+		return nil
+	})
+
+	s := New()
+	n := NewField[int](cycle, typeKey, "n").In(s)
+	if err := n.Set(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	flushed := make(chan error, 1)
+	go func() { flushed <- s.FlushCtx(context.Background(), cycle, typeKey) }()
+	<-entered
+
+	// 存储器执行期间记录可以继续读写
+	done := make(chan error, 1)
+	go func() { done <- n.Set(1, 2) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("mutation blocked by an in-flight store")
+	}
+	close(gate)
+	if err := <-flushed; err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	// 写入期间的修改保持为脏，下一次刷新写入新值，版本号逐次加 1
+	pd, err := s.GetDataErr(cycle, typeKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pd.IsDirty() || pd.Version != 1 {
+		t.Fatalf("expected record still dirty at version 1, got dirty=%v version %d", pd.IsDirty(), pd.Version)
+	}
+	if err := s.FlushCtx(context.Background(), cycle, typeKey); err != nil {
+		t.Fatalf("second flush: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(stored) != 2 || stored[0] != 1 || stored[1] != 2 {
+		t.Fatalf("expected stores of 1 then 2, got %v", stored)
+	}
+}
@@ -0,0 +1,326 @@
+/*
+ * 多记录原子事务
+ *
+ * 模块用途：
+ *   在一次操作中读写多个 (CycleType, TypeKey, UserID) 记录，全部成功才生效。
+ *   例如商城购买：扣除 LiftTime 记录中的金币，同时增加 DailyCycle 的购买次数。
+ *
+ * 实现要点：
+ *   - 事务内首次访问记录时复制一份 MiscData，读写都作用在副本上，提交时整体替换
+ *   - fn 返回错误时丢弃全部副本，内存数据保持不变
+ *   - 记录锁按 (CycleType, TypeKey, UserID) 全局排序获取；若需要获取的记录排在已持有记录之前，
+ *     先 TryLock，失败则释放全部锁，按已知记录集合排序后重新执行 fn，避免死锁
+ *   - 持有记录锁时不会阻塞等待集合锁（记录加入、移出集合时会在持有集合锁时锁定记录），
+ *     需要加载新记录时同样释放全部锁后重新执行
+ *   - 因此 fn 可能被执行多次，fn 内不应有除 tx 以外的副作用
+ *   - fn 内不要调用 UpdateIf / cond_* 等非事务接口操作同一记录，否则会与事务持有的锁死锁
+ *
+ * 示例：
+ *   coins := NewField[int64](LiftTime, TypeKey(1), "coins")
+ *   bought := NewField[int32](DailyCycle, TypeKey(2), "shopBought")
+ *   err := Txn(func(tx *Tx) error {
+ *       c, err := TxGet(tx, coins, userID)
+ *       if err != nil {
+ *           return err
+ *       }
+ *       if c < price {
+ *           return ErrInsufficient
+ *       }
+ *       if err := TxSet(tx, coins, userID, c-price); err != nil {
+ *           return err
+ *       }
+ *       return TxUpdate(tx, bought, userID, func(n int32) (int32, error) { return n + 1, nil })
+ *   })
+ */
+package cycledata
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// errTxnRestart 事务需要按新的加锁顺序重新执行（内部使用）
+var errTxnRestart = errors.New("cycledata: transaction restart")
+
+/*
+ * RecordKey 唯一标识一条玩家记录
+ */
+type RecordKey struct {
+	Cycle   CycleType
+	TypeKey TypeKey
+	UserID  UserID
+}
+
+/*
+ * less 全局加锁顺序
+ */
+func (k RecordKey) less(o RecordKey) bool {
+	if k.Cycle != o.Cycle {
+		return k.Cycle < o.Cycle
+	}
+	if k.TypeKey != o.TypeKey {
+		return k.TypeKey < o.TypeKey
+	}
+	return k.UserID < o.UserID
+}
+
+/*
+ * txRecord 事务中持有的记录
+ */
+type txRecord struct {
+	key     RecordKey
+	pd      *PlayerData
+	work    map[string]interface{} // MiscData 副本
+	written bool
+}
+
+/*
+ * Tx 事务上下文，仅在 Txn 的回调内有效
+ */
+type Tx struct {
+	store   *Store
+	records map[RecordKey]*txRecord
+	locked  []*txRecord // 按加锁顺序排列
+	restart bool
+}
+
+/*
+ * Txn 执行多记录原子事务
+ * fn 返回 nil 时提交全部修改，否则回滚并原样返回该错误
+ */
+func Txn(fn func(tx *Tx) error) error {
+	return defaultStore.Txn(fn)
+}
+
+/*
+ * Txn 在实例上执行多记录原子事务
+ */
+func (s *Store) Txn(fn func(tx *Tx) error) error {
+	var plan []RecordKey
+	for {
+		tx := &Tx{store: s, records: make(map[RecordKey]*txRecord)}
+
+		// 先在不持有任何记录锁的情况下加载上一轮发现的全部记录，再按顺序加锁
+		var err error
+		pds := make([]*PlayerData, len(plan))
+		for i, key := range plan {
+			if pds[i], err = s.GetDataErr(key.Cycle, key.TypeKey, key.UserID); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			for i, key := range plan {
+				if _, err = tx.lock(key, pds[i], true); err != nil {
+					break
+				}
+			}
+		}
+		if err == nil {
+			err = fn(tx)
+		}
+
+		if tx.restart {
+			plan = tx.keys()
+			tx.release()
+			continue
+		}
+		var pending pendingEvents
+		if err == nil {
+			pending = tx.commit()
+		}
+		tx.release()
+		pending.deliver()
+		return err
+	}
+}
+
+/*
+ * Value 读取事务内某记录的字段原始值
+ */
+func (tx *Tx) Value(cycle CycleType, typeKey TypeKey, userID UserID, key string) (interface{}, bool, error) {
+	rec, err := tx.record(RecordKey{Cycle: cycle, TypeKey: typeKey, UserID: userID})
+	if err != nil {
+		return nil, false, err
+	}
+	val, ok := rec.work[key]
+	return val, ok, nil
+}
+
+/*
+ * Set 在事务内写入字段原始值（经 Schema 校验）
+ */
+func (tx *Tx) Set(cycle CycleType, typeKey TypeKey, userID UserID, key string, val interface{}) error {
+	rec, err := tx.record(RecordKey{Cycle: cycle, TypeKey: typeKey, UserID: userID})
+	if err != nil {
+		return err
+	}
+	stored, err := validateField(cycle, typeKey, key, val)
+	if err != nil {
+		return err
+	}
+	rec.work[key] = stored
+	rec.written = true
+	return nil
+}
+
+/*
+ * Delete 在事务内删除字段
+ */
+func (tx *Tx) Delete(cycle CycleType, typeKey TypeKey, userID UserID, key string) error {
+	rec, err := tx.record(RecordKey{Cycle: cycle, TypeKey: typeKey, UserID: userID})
+	if err != nil {
+		return err
+	}
+	if _, ok := rec.work[key]; ok {
+		delete(rec.work, key)
+		rec.written = true
+	}
+	return nil
+}
+
+/*
+ * TxGet 在事务内读取带类型的字段，字段不存在时返回零值
+ */
+func TxGet[T any](tx *Tx, f Field[T], userID UserID) (T, error) {
+	var zero T
+	raw, ok, err := tx.Value(f.cycle, f.typeKey, userID, f.key)
+	if err != nil || !ok {
+		return zero, err
+	}
+	val, ok := coerce[T](raw)
+	if !ok {
+		return zero, typeMismatch(f.key, raw, zero)
+	}
+	return val, nil
+}
+
+/*
+ * TxSet 在事务内写入带类型的字段
+ */
+func TxSet[T any](tx *Tx, f Field[T], userID UserID, val T) error {
+	return tx.Set(f.cycle, f.typeKey, userID, f.key, val)
+}
+
+/*
+ * TxUpdate 在事务内基于旧值计算新值，fn 返回错误时不写入
+ */
+func TxUpdate[T any](tx *Tx, f Field[T], userID UserID, fn func(old T) (T, error)) error {
+	old, err := TxGet(tx, f, userID)
+	if err != nil {
+		return err
+	}
+	newVal, err := fn(old)
+	if err != nil {
+		return err
+	}
+	return TxSet(tx, f, userID, newVal)
+}
+
+/*
+ * record 获取（必要时加锁并复制）事务内的记录
+ */
+func (tx *Tx) record(key RecordKey) (*txRecord, error) {
+	if tx.restart {
+		return nil, errTxnRestart
+	}
+	if rec, ok := tx.records[key]; ok {
+		return rec, nil
+	}
+
+	if len(tx.locked) == 0 {
+		pd, err := tx.store.GetDataErr(key.Cycle, key.TypeKey, key.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return tx.lock(key, pd, true)
+	}
+
+	// 已持有记录锁时只查找常驻内存的记录，需要加载或集合锁被占用则重启
+	pd, ok := tx.store.h.tryPeek(key.Cycle, key.TypeKey, key.UserID)
+	if !ok {
+		return nil, tx.markRestart(key)
+	}
+
+	// 新记录排在所有已持有记录之后时可以安全地阻塞等待
+	inOrder := tx.locked[len(tx.locked)-1].key.less(key)
+	return tx.lock(key, pd, inOrder)
+}
+
+/*
+ * lock 锁定记录并复制 MiscData；blocking 为 false 时只尝试加锁，失败则标记重启
+ * 加锁前记录已被刷新、淘汰移出集合时同样标记重启，重启后重新获取
+ */
+func (tx *Tx) lock(key RecordKey, pd *PlayerData, blocking bool) (*txRecord, error) {
+	if blocking {
+		pd.mu.Lock()
+	} else if !pd.mu.TryLock() {
+		return nil, tx.markRestart(key)
+	}
+	if pd.owner == nil {
+		pd.mu.Unlock()
+		return nil, tx.markRestart(key)
+	}
+
+	rec := &txRecord{key: key, pd: pd, work: make(map[string]interface{}, len(pd.MiscData))}
+	for k, v := range pd.MiscData {
+		rec.work[k] = cloneValue(v)
+	}
+	tx.records[key] = rec
+	tx.locked = append(tx.locked, rec)
+	sort.Slice(tx.locked, func(i, j int) bool { return tx.locked[i].key.less(tx.locked[j].key) })
+	return rec, nil
+}
+
+/*
+ * markRestart 记录到待加锁集合，释放后按顺序重来
+ */
+func (tx *Tx) markRestart(key RecordKey) error {
+	tx.records[key] = &txRecord{key: key}
+	tx.restart = true
+	return errTxnRestart
+}
+
+/*
+ * keys 返回事务涉及的全部记录（已排序），用于重启后的预加锁
+ */
+func (tx *Tx) keys() []RecordKey {
+	keys := make([]RecordKey, 0, len(tx.records))
+	for key := range tx.records {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+	return keys
+}
+
+/*
+ * commit 将所有被写过的副本替换回记录，只有被写过的记录才会标记为脏
+ * 修改事件在持有记录锁时入队，返回的同步投递在释放记录锁后执行
+ */
+func (tx *Tx) commit() pendingEvents {
+	now := time.Now()
+	var events []Event
+	for _, rec := range tx.locked {
+		if !rec.written {
+			continue
+		}
+		if tx.store.h.events.watched(rec.key.Cycle, rec.key.TypeKey) {
+			events = append(events, diffEvents(rec.key.Cycle, rec.key.TypeKey, rec.key.UserID, OpTxn, rec.pd.MiscData, rec.work)...)
+		}
+		rec.pd.MiscData = rec.work
+		rec.pd.UpdateTime = now
+		rec.pd.markDirtyLocked()
+		tx.store.h.logMutationLocked(rec.key.Cycle, rec.key.TypeKey, rec.pd)
+	}
+	return tx.store.h.events.publishLocked(events)
+}
+
+/*
+ * release 释放事务持有的全部记录锁
+ */
+func (tx *Tx) release() {
+	for i := len(tx.locked) - 1; i >= 0; i-- {
+		tx.locked[i].pd.mu.Unlock()
+	}
+	tx.locked = nil
+}
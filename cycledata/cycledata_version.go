@@ -0,0 +1,216 @@
+/*
+ * 乐观版本控制
+ *
+ * 模块用途：
+ *   两台服务器交接同一玩家期间可能同时持有该玩家的数据，双方各自刷新时后写入的一方会静默覆盖另一方。
+ *   PlayerData.Version 记录数据在存储中的版本号，存储器据此做条件写入（compare-and-set）：
+ *   - 加载器返回存储中的版本号，新建的记录为 0
+ *   - 存储器收到的 data.Version 是期望的存储版本：存储中的版本号与之相等（或记录不存在且 Version 为 0）时
+ *     写入并把存储中的版本号置为 data.Version+1，否则不写入并返回 ErrVersionConflict
+ *   - 批量存储器只有部分记录冲突时返回 &VersionConflictError{UserIDs: ...}，未列出的记录视为写入成功；
+ *     直接返回 ErrVersionConflict 表示整批冲突
+ *   - 写入成功后内存中的 Version 加 1
+ *
+ *   发生冲突时通过加载器重新读取存储中的数据（remote），调用 RegisterMergeHook 注册的合并函数把两边的修改合并进
+ *   内存中的记录（local），之后 local 采用 remote 的版本号并立即重新写入一次；
+ *   未注册合并函数、重新加载失败、合并函数返回错误或重新写入仍然冲突时，记录按普通写入失败进入重试队列，
+ *   超过重试次数后交给死信函数（err 可用 errors.Is(err, ErrVersionConflict) 判断）。
+ *   合并结果与其他修改一样经 Schema 校验、写入 WAL，并按差异投递 OpMerge 事件，校验失败按合并失败处理。
+ *   不使用版本号的存储器忽略 Version 即可，行为与之前相同。
+ *
+ * 示例：
+ *   RegisterMergeHook(DailyCycle, TypeKey(1), func(cycle CycleType, typeKey TypeKey, local, remote *PlayerData) error {
+ *       if remote == nil {
+ *           return nil // 存储中的记录已被删除，保留本地数据
+ *       }
+ *       local.MiscData["coins"] = maxInt32(local.MiscData["coins"], remote.MiscData["coins"])
+ *       return nil
+ *   })
+ */
+package cycledata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+/*
+ * VersionConflictError 批量存储器中部分记录版本冲突
+ * errors.Is(err, ErrVersionConflict) 为 true
+ */
+type VersionConflictError struct {
+	UserIDs []UserID // 冲突的玩家，为空表示整批冲突
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("%v: %d records", ErrVersionConflict, len(e.UserIDs))
+}
+
+func (e *VersionConflictError) Is(target error) bool {
+	return target == ErrVersionConflict
+}
+
+/*
+ * MergeFunc 版本冲突时的合并函数
+ * local 为内存中的记录（调用期间已加锁，直接修改即可），remote 为存储中的最新数据，记录已被删除时为 nil；
+ * 返回错误时放弃合并，记录按写入失败处理
+ */
+type MergeFunc func(cycle CycleType, typeKey TypeKey, local, remote *PlayerData) error
+
+var (
+	// mergeHooks 周期 -> 类型 -> 合并函数
+	mergeHooks = make(map[CycleType]map[TypeKey]MergeFunc)
+
+	// mergeHookMu 保护 mergeHooks 的并发访问
+	mergeHookMu sync.RWMutex
+)
+
+/*
+ * RegisterMergeHook 注册指定周期和类型的版本冲突合并函数
+ */
+func RegisterMergeHook(cycle CycleType, typeKey TypeKey, merge MergeFunc) {
+	mergeHookMu.Lock()
+	defer mergeHookMu.Unlock()
+
+	if _, ok := mergeHooks[cycle]; !ok {
+		mergeHooks[cycle] = make(map[TypeKey]MergeFunc)
+	}
+	mergeHooks[cycle][typeKey] = merge
+}
+
+/*
+ * getMergeHook 获取合并函数，未注册返回 nil
+ */
+func getMergeHook(cycle CycleType, typeKey TypeKey) MergeFunc {
+	mergeHookMu.RLock()
+	defer mergeHookMu.RUnlock()
+
+	if m, ok := mergeHooks[cycle]; ok {
+		return m[typeKey]
+	}
+	return nil
+}
+
+/*
+ * conflictsIn 找出 batch 中版本冲突的记录，err 不是版本冲突时返回 nil
+ */
+func conflictsIn(err error, batch []*PlayerData) map[*PlayerData]bool {
+	if !errors.Is(err, ErrVersionConflict) {
+		return nil
+	}
+
+	conflicts := make(map[*PlayerData]bool, len(batch))
+	var vce *VersionConflictError
+	if errors.As(err, &vce) && len(vce.UserIDs) > 0 {
+		ids := make(map[UserID]bool, len(vce.UserIDs))
+		for _, id := range vce.UserIDs {
+			ids[id] = true
+		}
+		for _, data := range batch {
+			if ids[data.UserID] {
+				conflicts[data] = true
+			}
+		}
+		return conflicts
+	}
+	for _, data := range batch {
+		conflicts[data] = true
+	}
+	return conflicts
+}
+
+/*
+ * mergeConflicts 重新加载冲突的记录并调用合并函数
+ * 返回合并成功、需要重新写入的记录，以及无法合并的记录
+ */
+func mergeConflicts(ctx context.Context, h *cycleHandler, cycle CycleType, typeKey TypeKey, conflicts []storeFailure) ([]*PlayerData, []storeFailure) {
+	merge := getMergeHook(cycle, typeKey)
+	loader := getLoaderCtx(cycle, typeKey)
+	if merge == nil || loader == nil {
+		return nil, conflicts
+	}
+
+	var (
+		merged []*PlayerData
+		failed []storeFailure
+	)
+	for _, f := range conflicts {
+		if err := mergeOne(ctx, h, cycle, typeKey, loader, merge, f.data); err != nil {
+			log.Printf("Failed to merge conflicting data for uid %d, cycle %v, type %v: %v", f.data.UserID, cycle, typeKey, err)
+			failed = append(failed, storeFailure{data: f.data, err: fmt.Errorf("%w: %w", f.err, err)})
+			continue
+		}
+		merged = append(merged, f.data)
+	}
+	return merged, failed
+}
+
+/*
+ * mergeOne 重新加载一条记录并合并进内存中的数据，合并后采用存储中的版本号
+ * 与字段级修改走同一流程：合并结果经 Schema 校验，写入 WAL，按差异生成的 OpMerge 事件在记录锁内入队、释放后同步投递；
+ * 合并函数 panic、返回错误或校验失败时 MiscData 恢复为合并前的内容
+ */
+func mergeOne(ctx context.Context, h *cycleHandler, cycle CycleType, typeKey TypeKey,
+	loader func(context.Context, CycleType, TypeKey, UserID) (*PlayerData, error), merge MergeFunc, local *PlayerData) (err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("merge panic: %v", r)
+		}
+	}()
+
+	remote, err := loader(ctx, cycle, typeKey, local.UserID)
+	if err != nil {
+		return fmt.Errorf("reload: %w", err)
+	}
+	if remote != nil {
+		NormalizeMiscData(cycle, typeKey, remote.MiscData)
+	}
+
+	var pending pendingEvents
+	defer func() { pending.deliver() }()
+
+	local.mu.Lock()
+	defer local.mu.Unlock()
+
+	// 合并函数 panic、返回错误或校验失败时在释放记录锁前恢复，半合并的数据不会被写入
+	before := cloneMiscData(local.MiscData)
+	merged := false
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("merge panic: %v", r)
+		}
+		if !merged {
+			local.MiscData = before
+		}
+	}()
+
+	if err := merge(cycle, typeKey, local, remote); err != nil {
+		return err
+	}
+	if local.MiscData == nil {
+		local.MiscData = make(map[string]interface{})
+	}
+	validated, err := validateMiscData(cycle, typeKey, local.MiscData)
+	if err != nil {
+		return err
+	}
+	local.MiscData = validated
+	merged = true
+
+	local.Version = 0
+	if remote != nil {
+		local.Version = remote.Version
+	}
+	local.markDirtyLocked()
+	if h != nil {
+		h.logMutationLocked(cycle, typeKey, local)
+		if h.events.watched(cycle, typeKey) {
+			pending = h.events.publishLocked(diffEvents(cycle, typeKey, local.UserID, OpMerge, before, local.MiscData))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,526 @@
+/*
+ * 预写日志（WAL）
+ *
+ * 模块用途：
+ *   两次刷新之间的修改只存在于内存中，进程崩溃会丢失。开启 WAL 后：
+ *   - 每次成功的修改（UpdateIf、Increase/Decrease 系列、切片/map 辅助函数、SetData、SetWith*、Txn）
+ *     都把修改后的整条记录（格式同 Snapshot，MiscData 带类型标签）追加到本地段文件
+ *   - OpenWAL 时先重放目录中已有的段文件：每个玩家以最后一条为准，作为脏数据放入内存，
+ *     之后的 GetData 直接命中，不再调用加载器；下次 Flush 时写入存储器
+ *   - 记录被存储器成功写入后，其日志条目失效；段文件中的条目全部失效后删除该段
+ *     （未注册存储器的类型不会被写入，对应的段会一直保留）
+ *
+ *   fsync 策略：
+ *   - WALSyncEveryWrite: 每条都 fsync，最安全
+ *   - WALSyncInterval:   按 SyncInterval 周期 fsync（默认），进程崩溃不丢数据，机器掉电最多丢一个周期
+ *   - WALSyncNone:       只写入系统缓存，由操作系统决定落盘时机
+ *
+ *   直接修改 MiscData 后调用 MarkDirty 的记录不会写入 WAL。
+ *   OpenWAL 需要在开始处理请求前调用；Stop 会在刷新全部数据后关闭 WAL。
+ *
+ * 示例：
+ *   if err := cycledata.OpenWAL("/data/cycledata-wal", cycledata.WALOptions{Sync: cycledata.WALSyncInterval}); err != nil {
+ *       log.Fatal(err)
+ *   }
+ */
+package cycledata
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * WALSyncMode WAL 的 fsync 策略
+ */
+type WALSyncMode int
+
+const (
+	// WALSyncInterval 按 SyncInterval 周期 fsync
+	WALSyncInterval WALSyncMode = iota
+
+	// WALSyncEveryWrite 每条日志都 fsync
+	WALSyncEveryWrite
+
+	// WALSyncNone 不主动 fsync
+	WALSyncNone
+)
+
+/*
+ * WALOptions WAL 配置
+ */
+type WALOptions struct {
+	Sync         WALSyncMode   // fsync 策略
+	SyncInterval time.Duration // WALSyncInterval 的周期，<= 0 时为 1 秒
+	SegmentSize  int64         // 单个段文件的大小上限（字节），<= 0 时为 64MB
+}
+
+const (
+	// walSegmentPrefix / walSegmentSuffix 段文件名为 wal-<首条序号>.log
+	walSegmentPrefix = "wal-"
+	walSegmentSuffix = ".log"
+
+	defaultWALSyncInterval = time.Second
+	defaultWALSegmentSize  = 64 << 20
+)
+
+/*
+ * walEntry 一条日志：序号 + 修改后的整条记录
+ */
+type walEntry struct {
+	Seq uint64          `json:"seq"`
+	Rec json.RawMessage `json:"rec"`
+}
+
+/*
+ * walSegment 一个段文件及其中仍未失效的条目数
+ */
+type walSegment struct {
+	path string
+	live int
+}
+
+/*
+ * walPending 记录最后一条日志的位置
+ */
+type walPending struct {
+	seq uint64
+	seg *walSegment
+}
+
+/*
+ * walLog 单个 Store 的预写日志
+ */
+type walLog struct {
+	mu       sync.Mutex
+	dir      string
+	opts     WALOptions
+	seq      uint64
+	segments []*walSegment // 按序号排列，最后一个为当前写入的段
+	file     *os.File
+	size     int64
+	pending  map[*PlayerData]walPending // 尚未被存储器写入的记录
+	closed   bool                       // 已关闭，不再写入和删除段文件
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+/*
+ * OpenWAL 为默认实例开启 WAL，并重放 dir 中已有的日志
+ */
+func OpenWAL(dir string, opts WALOptions) error {
+	return defaultStore.OpenWAL(dir, opts)
+}
+
+/*
+ * CloseWAL 关闭默认实例的 WAL，未失效的段文件保留到下次 OpenWAL 时重放
+ */
+func CloseWAL() error {
+	return defaultStore.CloseWAL()
+}
+
+/*
+ * OpenWAL 为实例开启 WAL，并将 dir 中已有的日志重放到内存
+ */
+func (s *Store) OpenWAL(dir string, opts WALOptions) error {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = defaultWALSyncInterval
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultWALSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.h.wal.Load() != nil {
+		return ErrWALOpen
+	}
+
+	w := &walLog{dir: dir, opts: opts, pending: make(map[*PlayerData]walPending)}
+	if err := w.replay(s.h); err != nil {
+		return err
+	}
+	if err := w.rotateLocked(); err != nil {
+		return err
+	}
+	if opts.Sync == WALSyncInterval {
+		w.stopCh = make(chan struct{})
+		w.doneCh = make(chan struct{})
+		go w.syncLoop()
+	}
+	s.h.wal.Store(w)
+	return nil
+}
+
+/*
+ * CloseWAL 关闭实例的 WAL，未失效的段文件保留到下次 OpenWAL 时重放
+ */
+func (s *Store) CloseWAL() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.h.closeWAL()
+}
+
+/*
+ * closeWAL 停止 WAL 并关闭当前段文件
+ */
+func (h *cycleHandler) closeWAL() error {
+	return h.closeWALOf(h.wal.Load())
+}
+
+/*
+ * closeWALOf 仅当 w 仍是当前的 WAL 时将其关闭，已被关闭或替换时不做任何事
+ */
+func (h *cycleHandler) closeWALOf(w *walLog) error {
+	if w == nil || !h.wal.CompareAndSwap(w, nil) {
+		return nil
+	}
+	if w.stopCh != nil {
+		close(w.stopCh)
+		<-w.doneCh
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	return w.closeFileLocked()
+}
+
+/*
+ * logMutationLocked 记录一次成功的修改（调用方需持有 pd.mu 写锁），未开启 WAL 时不做任何事
+ */
+func (h *cycleHandler) logMutationLocked(cycle CycleType, typeKey TypeKey, pd *PlayerData) {
+	if w := h.wal.Load(); w != nil {
+		w.append(cycle, typeKey, pd)
+	}
+}
+
+/*
+ * append 追加一条日志（调用方需持有 pd.mu 写锁），写入失败只记录日志，内存中的修改不回滚
+ */
+func (w *walLog) append(cycle CycleType, typeKey TypeKey, pd *PlayerData) {
+	// 编码在获取 w.mu 之前完成，w.mu 内只分配序号并写入文件
+	rec, err := snapshotRecordLocked(cycle, typeKey, pd)
+	var raw []byte
+	if err == nil {
+		raw, err = json.Marshal(rec)
+	}
+	if err != nil {
+		log.Printf("WAL encode uid %d, cycle %v, type %v: %v", pd.UserID, cycle, typeKey, err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return
+	}
+	if w.size >= w.opts.SegmentSize {
+		if err := w.rotateLocked(); err != nil {
+			log.Printf("WAL rotate: %v", err)
+			return
+		}
+	}
+
+	w.seq++
+	n, err := w.file.Write(walLine(w.seq, raw))
+	w.size += int64(n)
+	if err == nil && w.opts.Sync == WALSyncEveryWrite {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		log.Printf("WAL write uid %d, cycle %v, type %v: %v", pd.UserID, cycle, typeKey, err)
+		return
+	}
+
+	pd.wal = w
+	pd.walSeq = w.seq
+	w.trackLocked(pd, w.seq, w.segments[len(w.segments)-1])
+}
+
+/*
+ * walLine 按 walEntry 的 JSON 格式拼接一行日志，rec 为已编码的记录
+ */
+func walLine(seq uint64, rec []byte) []byte {
+	line := make([]byte, 0, len(rec)+32)
+	line = append(line, `{"seq":`...)
+	line = strconv.AppendUint(line, seq, 10)
+	line = append(line, `,"rec":`...)
+	line = append(line, rec...)
+	return append(line, "}\n"...)
+}
+
+/*
+ * trackLocked 记录 pd 最新一条日志的位置，之前的条目随之失效
+ */
+func (w *walLog) trackLocked(pd *PlayerData, seq uint64, seg *walSegment) {
+	seg.live++
+	old, ok := w.pending[pd]
+	w.pending[pd] = walPending{seq: seq, seg: seg}
+	if ok {
+		old.seg.live--
+		w.pruneLocked(old.seg)
+	}
+}
+
+/*
+ * ack 记录已被存储器写入（调用方需持有 pd.mu 写锁），seq 及之前的条目失效
+ */
+func (w *walLog) ack(pd *PlayerData, seq uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return
+	}
+	p, ok := w.pending[pd]
+	if !ok || p.seq > seq {
+		return
+	}
+	delete(w.pending, pd)
+	p.seg.live--
+	w.pruneLocked(p.seg)
+}
+
+/*
+ * pruneLocked 段中条目全部失效时删除该段；当前段则截断后继续写入
+ */
+func (w *walLog) pruneLocked(seg *walSegment) {
+	if seg.live > 0 {
+		return
+	}
+	last := len(w.segments) - 1
+	for i, s := range w.segments {
+		if s != seg {
+			continue
+		}
+		if i == last && w.file != nil {
+			if w.size == 0 {
+				return
+			}
+			if err := w.file.Truncate(0); err != nil {
+				log.Printf("WAL truncate %s: %v", seg.path, err)
+				return
+			}
+			if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+				log.Printf("WAL truncate %s: %v", seg.path, err)
+				return
+			}
+			w.size = 0
+			return
+		}
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("WAL remove %s: %v", seg.path, err)
+			return
+		}
+		w.segments = append(w.segments[:i], w.segments[i+1:]...)
+		return
+	}
+}
+
+/*
+ * rotateLocked 关闭当前段并创建新段
+ */
+func (w *walLog) rotateLocked() error {
+	if err := w.closeFileLocked(); err != nil {
+		return err
+	}
+	if n := len(w.segments); n > 0 {
+		// 旧的当前段已无有效条目时直接删除
+		w.pruneLocked(w.segments[n-1])
+	}
+
+	path := filepath.Join(w.dir, fmt.Sprintf("%s%020d%s", walSegmentPrefix, w.seq+1, walSegmentSuffix))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	w.file, w.size = f, 0
+	w.segments = append(w.segments, &walSegment{path: path})
+	return nil
+}
+
+/*
+ * closeFileLocked 同步并关闭当前段文件
+ */
+func (w *walLog) closeFileLocked() error {
+	if w.file == nil {
+		return nil
+	}
+	f := w.file
+	w.file = nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+/*
+ * syncLoop 按周期 fsync 当前段文件
+ */
+func (w *walLog) syncLoop() {
+	defer close(w.doneCh)
+
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.file != nil {
+				if err := w.file.Sync(); err != nil {
+					log.Printf("WAL sync: %v", err)
+				}
+			}
+			w.mu.Unlock()
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+/*
+ * replay 按序读取目录中的段文件，每个玩家以最后一条为准放入内存并标记为脏数据
+ * 段文件末尾不完整的一行（写入中途崩溃）会被忽略；已过期的记录不再放入内存，其条目随之失效。
+ * 已常驻内存的记录（如 Restore 恢复的）被日志替换并移出集合，
+ * 但它本身已包含这条日志（重新开启 WAL 前常驻的记录）时保留内存中的版本
+ */
+func (w *walLog) replay(h *cycleHandler) error {
+	paths, err := filepath.Glob(filepath.Join(w.dir, walSegmentPrefix+"*"+walSegmentSuffix))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	type latest struct {
+		seq uint64
+		seg *walSegment
+		rec snapshotRecord
+	}
+	records := make(map[RecordKey]*latest)
+
+	for _, path := range paths {
+		seg := &walSegment{path: path}
+		w.segments = append(w.segments, seg)
+		if err := readSegment(path, func(entry walEntry, rec snapshotRecord) {
+			if entry.Seq > w.seq {
+				w.seq = entry.Seq
+			}
+			key := RecordKey{Cycle: rec.Cycle, TypeKey: rec.TypeKey, UserID: rec.UserID}
+			if cur, ok := records[key]; !ok || entry.Seq > cur.seq {
+				records[key] = &latest{seq: entry.Seq, seg: seg, rec: rec}
+			}
+		}); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().Unix()
+	var replayed int
+	for _, l := range records {
+		data, err := l.rec.playerData()
+		if err != nil {
+			return fmt.Errorf("%w: wal uid %d, cycle %v, type %v: %w", ErrSnapshotFormat, l.rec.UserID, l.rec.Cycle, l.rec.TypeKey, err)
+		}
+		if isStale(l.rec.Cycle, l.rec.TypeKey, data, now) {
+			continue
+		}
+		data.wal, data.walSeq = w, l.seq
+		data.markDirtyLocked()
+		data.touch()
+
+		col := h.getService(l.rec.Cycle, DefaultExpireFor(l.rec.Cycle, l.rec.TypeKey)).getCollection(l.rec.TypeKey)
+		col.mu.Lock()
+		if cur, ok := col.data[data.UserID]; ok {
+			if w.adoptResident(cur, l.seq, l.seg) {
+				col.mu.Unlock()
+				continue
+			}
+			col.dropLocked(cur)
+		}
+		col.putLocked(data)
+		col.mu.Unlock()
+		w.trackLocked(data, l.seq, l.seg)
+		replayed++
+	}
+
+	// 没有有效条目的旧段直接删除
+	for _, seg := range append([]*walSegment(nil), w.segments...) {
+		w.pruneLocked(seg)
+	}
+	if replayed > 0 {
+		log.Printf("WAL replayed %d records from %d segments", replayed, len(paths))
+	}
+	return nil
+}
+
+/*
+ * adoptResident 常驻记录已包含序号为 seq 的日志时返回 true，此时不需要重放；
+ * 仍未写入存储器的改由 w 跟踪，其所在的段保留到写入成功
+ */
+func (w *walLog) adoptResident(pd *PlayerData, seq uint64, seg *walSegment) bool {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+
+	if pd.wal == nil || pd.walSeq < seq {
+		return false
+	}
+	if pd.dirty {
+		pd.wal, pd.walSeq = w, seq
+		w.trackLocked(pd, seq, seg)
+	}
+	return true
+}
+
+/*
+ * readSegment 逐行读取段文件
+ */
+func readSegment(path string, fn func(walEntry, snapshotRecord)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(strings.TrimSpace(string(line))) > 0 {
+				log.Printf("WAL %s: ignoring incomplete tail entry", path)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var entry walEntry
+		var rec snapshotRecord
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("%w: wal %s: %w", ErrSnapshotFormat, path, err)
+		}
+		if err := json.Unmarshal(entry.Rec, &rec); err != nil {
+			return fmt.Errorf("%w: wal %s, seq %d: %w", ErrSnapshotFormat, path, entry.Seq, err)
+		}
+		fn(entry, rec)
+	}
+}
@@ -0,0 +1,360 @@
+/*
+ * 后台写回（Write-Behind）
+ *
+ * 模块用途：
+ *   按 (CycleType, TypeKey) 配置写回策略，由受管理的后台协程定期把脏数据写入存储器，
+ *   数据仍常驻内存，避免进程崩溃时丢失长时间的进度。
+ *
+ * 触发条件（满足任一即写回，未设置的条件不生效）：
+ *   - 距上次写回超过 Interval
+ *   - 脏记录数达到 MaxDirty
+ *   - 最早变脏的记录超过 MaxDirtyAge 未写回
+ *
+ * 示例：
+ *   RegisterWriteBehind(DailyCycle, TypeKey(1), WriteBehindPolicy{
+ *       Interval:    30 * time.Second,
+ *       MaxDirty:    1000,
+ *       MaxDirtyAge: 2 * time.Minute,
+ *   })
+ *   defer StopWriteBehind()
+ */
+package cycledata
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultWriteBehindCheck 未设置 CheckInterval 时的检查周期
+const defaultWriteBehindCheck = time.Second
+
+/*
+ * WriteBehindPolicy 写回策略
+ */
+type WriteBehindPolicy struct {
+	Interval      time.Duration // 定期写回间隔
+	MaxDirty      int           // 脏记录数阈值
+	MaxDirtyAge   time.Duration // 单条记录最长未写回时长
+	CheckInterval time.Duration // 检查触发条件的周期，默认 1 秒
+	Jitter        time.Duration // 每次检查附加的随机抖动，避免多个集合同时写库
+}
+
+/*
+ * WriteBehindStats 写回运行指标
+ */
+type WriteBehindStats struct {
+	Flushes   uint64        // 写回次数
+	Records   uint64        // 写回成功的记录数
+	Failures  uint64        // 写回失败的记录数
+	LastFlush time.Time     // 上次写回时间
+	LastLag   time.Duration // 上次写回时最早脏记录已等待的时长
+}
+
+/*
+ * collectionKey 标识一个数据集合
+ */
+type collectionKey struct {
+	cycle   CycleType
+	typeKey TypeKey
+}
+
+/*
+ * writeBehindWorker 单个集合的写回协程
+ */
+type writeBehindWorker struct {
+	key    collectionKey
+	policy WriteBehindPolicy
+	h      *cycleHandler
+	stopCh chan struct{}
+	doneCh chan struct{}
+
+	flushes   atomic.Uint64
+	records   atomic.Uint64
+	failures  atomic.Uint64
+	lastFlush atomic.Int64 // UnixNano
+	lastLag   atomic.Int64 // Nanoseconds
+}
+
+/*
+ * writeBehindSet 处理器持有的全部写回协程
+ */
+type writeBehindSet struct {
+	mu       sync.Mutex
+	workers  map[collectionKey]*writeBehindWorker
+	policies map[collectionKey]WriteBehindPolicy // 已注册的策略，Stop 后保留，Start 时据此重新启动写回协程
+}
+
+/*
+ * RegisterWriteBehind 为指定周期和类型启用后台写回，重复注册会替换旧策略
+ */
+func RegisterWriteBehind(cycle CycleType, typeKey TypeKey, policy WriteBehindPolicy) {
+	defaultStore.RegisterWriteBehind(cycle, typeKey, policy)
+}
+
+/*
+ * RegisterWriteBehind 为实例中指定周期和类型启用后台写回
+ */
+func (s *Store) RegisterWriteBehind(cycle CycleType, typeKey TypeKey, policy WriteBehindPolicy) {
+	s.h.startWriteBehind(collectionKey{cycle: cycle, typeKey: typeKey}, policy)
+}
+
+/*
+ * StopWriteBehind 停止所有写回协程并注销策略，停止前各写回一次脏数据并等待完成
+ */
+func StopWriteBehind() {
+	defaultStore.StopWriteBehind()
+}
+
+/*
+ * StopWriteBehind 停止实例的所有写回协程
+ */
+func (s *Store) StopWriteBehind() {
+	s.h.stopWriteBehind()
+}
+
+/*
+ * WriteBehindStatsFor 获取指定集合的写回指标，未启用写回返回 false
+ */
+func WriteBehindStatsFor(cycle CycleType, typeKey TypeKey) (WriteBehindStats, bool) {
+	return defaultStore.WriteBehindStatsFor(cycle, typeKey)
+}
+
+/*
+ * WriteBehindStatsFor 获取实例中指定集合的写回指标
+ */
+func (s *Store) WriteBehindStatsFor(cycle CycleType, typeKey TypeKey) (WriteBehindStats, bool) {
+	h := s.h
+	h.writeBehind.mu.Lock()
+	w, ok := h.writeBehind.workers[collectionKey{cycle: cycle, typeKey: typeKey}]
+	h.writeBehind.mu.Unlock()
+	if !ok {
+		return WriteBehindStats{}, false
+	}
+	return w.stats(), true
+}
+
+/*
+ * startWriteBehind 启动（或替换）集合的写回协程
+ */
+func (h *cycleHandler) startWriteBehind(key collectionKey, policy WriteBehindPolicy) {
+	if policy.CheckInterval <= 0 {
+		policy.CheckInterval = defaultWriteBehindCheck
+	}
+	w := &writeBehindWorker{
+		key:    key,
+		policy: policy,
+		h:      h,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	w.lastFlush.Store(time.Now().UnixNano())
+
+	h.writeBehind.mu.Lock()
+	if h.writeBehind.workers == nil {
+		h.writeBehind.workers = make(map[collectionKey]*writeBehindWorker)
+		h.writeBehind.policies = make(map[collectionKey]WriteBehindPolicy)
+	}
+	h.writeBehind.policies[key] = policy
+	old := h.writeBehind.workers[key]
+	h.writeBehind.workers[key] = w
+	h.writeBehind.mu.Unlock()
+
+	if old != nil {
+		old.stop()
+	}
+	go w.run()
+}
+
+/*
+ * stopWriteBehind 停止全部写回协程并注销策略
+ */
+func (h *cycleHandler) stopWriteBehind() {
+	h.haltWriteBehind(true)
+}
+
+/*
+ * resumeWriteBehind 为已注册但没有运行中协程的策略重新启动写回协程（Start 时调用）
+ */
+func (h *cycleHandler) resumeWriteBehind() {
+	h.writeBehind.mu.Lock()
+	idle := make(map[collectionKey]WriteBehindPolicy)
+	for key, policy := range h.writeBehind.policies {
+		if _, running := h.writeBehind.workers[key]; !running {
+			idle[key] = policy
+		}
+	}
+	h.writeBehind.mu.Unlock()
+
+	for key, policy := range idle {
+		h.startWriteBehind(key, policy)
+	}
+}
+
+/*
+ * haltWriteBehind 停止全部写回协程，forget 为 false 时保留已注册的策略（Stop 时调用）
+ */
+func (h *cycleHandler) haltWriteBehind(forget bool) {
+	h.writeBehind.mu.Lock()
+	workers := h.writeBehind.workers
+	h.writeBehind.workers = make(map[collectionKey]*writeBehindWorker)
+	if forget || h.writeBehind.policies == nil {
+		h.writeBehind.policies = make(map[collectionKey]WriteBehindPolicy)
+	}
+	h.writeBehind.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *writeBehindWorker) {
+			defer wg.Done()
+			w.stop()
+		}(w)
+	}
+	wg.Wait()
+}
+
+/*
+ * run 写回主循环
+ */
+func (w *writeBehindWorker) run() {
+	defer close(w.doneCh)
+
+	timer := time.NewTimer(w.nextCheck())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			if w.shouldFlush(time.Now()) {
+				w.flush()
+			}
+			timer.Reset(w.nextCheck())
+		case <-w.stopCh:
+			w.flush()
+			return
+		}
+	}
+}
+
+/*
+ * stop 通知协程退出并等待最后一次写回完成
+ */
+func (w *writeBehindWorker) stop() {
+	close(w.stopCh)
+	<-w.doneCh
+}
+
+/*
+ * nextCheck 下一次检查的等待时长（附加随机抖动）
+ */
+func (w *writeBehindWorker) nextCheck() time.Duration {
+	d := w.policy.CheckInterval
+	if w.policy.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(w.policy.Jitter)))
+	}
+	return d
+}
+
+/*
+ * shouldFlush 判断是否满足任一写回条件
+ */
+func (w *writeBehindWorker) shouldFlush(now time.Time) bool {
+	col := w.h.findCollection(w.key.cycle, w.key.typeKey)
+	if col == nil {
+		return false
+	}
+	dirty := col.dirty.count.Load()
+	if dirty == 0 {
+		return false
+	}
+
+	p := w.policy
+	if p.Interval > 0 && now.Sub(time.Unix(0, w.lastFlush.Load())) >= p.Interval {
+		return true
+	}
+	if p.MaxDirty > 0 && dirty >= int64(p.MaxDirty) {
+		return true
+	}
+	if p.MaxDirtyAge > 0 && col.dirty.lag(now) >= p.MaxDirtyAge {
+		return true
+	}
+	return false
+}
+
+/*
+ * flush 写回集合中的全部脏数据（数据保持常驻）
+ */
+func (w *writeBehindWorker) flush() {
+	col := w.h.findCollection(w.key.cycle, w.key.typeKey)
+	if col == nil {
+		return
+	}
+	lag := col.dirty.lag(time.Now())
+	stored, failed := col.flushDirty(w.key.cycle, w.key.typeKey)
+
+	w.flushes.Add(1)
+	w.records.Add(uint64(stored))
+	w.failures.Add(uint64(failed))
+	w.lastFlush.Store(time.Now().UnixNano())
+	w.lastLag.Store(int64(lag))
+}
+
+/*
+ * stats 读取运行指标
+ */
+func (w *writeBehindWorker) stats() WriteBehindStats {
+	return WriteBehindStats{
+		Flushes:   w.flushes.Load(),
+		Records:   w.records.Load(),
+		Failures:  w.failures.Load(),
+		LastFlush: time.Unix(0, w.lastFlush.Load()),
+		LastLag:   time.Duration(w.lastLag.Load()),
+	}
+}
+
+/*
+ * flushDirty 写回集合中的脏数据但不移出内存，返回成功与失败的记录数
+ * 写入时不持有集合锁，写入后重新计算最早变脏的时间
+ */
+func (dc *dataCollection) flushDirty(cycle CycleType, typeKey TypeKey) (stored, failed int) {
+	if !hasStorer(cycle, typeKey) {
+		return 0, 0
+	}
+
+	stored, failures := persist(context.Background(), dc.h, cycle, typeKey, dc.residents())
+	dc.retry.enqueue(cycle, typeKey, failures)
+	dc.refreshDirtyAge()
+	return stored, len(failures)
+}
+
+/*
+ * refreshDirtyAge 按常驻记录重新计算最早变脏的时间
+ * 只替换扫描前读到的值：扫描期间有记录变脏并调早了该值时改为取两者中较早的；
+ * 扫描漏掉的、期间变脏的记录按扫描开始的时间计算
+ */
+func (dc *dataCollection) refreshDirtyAge() {
+	c := &dc.dirty
+	prev := c.oldest.Load()
+	start := time.Now().UnixNano()
+
+	var oldest int64
+	for _, data := range dc.residents() {
+		if since, dirty := data.dirtySince(); dirty && (oldest == 0 || since.UnixNano() < oldest) {
+			oldest = since.UnixNano()
+		}
+	}
+	if oldest == 0 && c.count.Load() > 0 {
+		oldest = start
+	}
+	if !c.oldest.CompareAndSwap(prev, oldest) {
+		c.lower(oldest)
+		return
+	}
+	// 清零后才登记的记录可能因当时的值不晚于它而没有调整
+	if oldest == 0 && c.count.Load() > 0 {
+		c.oldest.CompareAndSwap(0, start)
+	}
+}
@@ -1,52 +1,57 @@
 package cycledata
 
+import (
+	"math"
+	"reflect"
+)
 
-func toInt(v interface{}) (int, bool) {
+/*
+ * toInt64 将 int/int32/int64/float64/float32 无损转换为 int64
+ * 带小数、NaN 或超出 int64 范围的浮点数返回 false，不做截断
+ */
+func toInt64(v interface{}) (int64, bool) {
 	switch val := v.(type) {
-	case int:
+	case int64:
 		return val, true
+	case int:
+		return int64(val), true
 	case int32:
-		return int(val), true
-	case int64:
-		return int(val), true
+		return int64(val), true
 	case float64:
-		return int(val), true
+		return floatToInt64(val)
+	case float32:
+		return floatToInt64(float64(val))
 	default:
 		return 0, false
 	}
 }
 
-func toInt32(v interface{}) (int32, bool) {
-	switch val := v.(type) {
-	case int32:
-		return val, true
-	case int:
-		return int32(val), true
-	case int64:
-		return int32(val), true
-	case float64:
-		return int32(val), true
-	default:
+/*
+ * toInt 同 toInt64，结果超出 int 范围时返回 false
+ */
+func toInt(v interface{}) (int, bool) {
+	n, ok := toInt64(v)
+	if !ok || int64(int(n)) != n {
 		return 0, false
 	}
+	return int(n), true
 }
 
-func toInt64(v interface{}) (int64, bool) {
-	switch val := v.(type) {
-	case int64:
-		return val, true
-	case int:
-		return int64(val), true
-	case int32:
-		return int64(val), true
-	case float64:
-		return int64(val), true
-	default:
+/*
+ * toInt32 同 toInt64，结果超出 int32 范围时返回 false
+ */
+func toInt32(v interface{}) (int32, bool) {
+	n, ok := toInt64(v)
+	if !ok || n < math.MinInt32 || n > math.MaxInt32 {
 		return 0, false
 	}
+	return int32(n), true
 }
 
-// 工具函数：将 interface{} 转换为 float64（支持 int, int64, float32, float64）
+/*
+ * toFloat64 将 int/int32/int64/float32/float64 转换为 float64
+ * 绝对值超过 2^53 且无法精确表示的整数返回 false
+ */
 func toFloat64(v interface{}) (float64, bool) {
 	switch val := v.(type) {
 	case float64:
@@ -54,9 +59,9 @@ func toFloat64(v interface{}) (float64, bool) {
 	case float32:
 		return float64(val), true
 	case int:
-		return float64(val), true
+		return intToFloat64(int64(val))
 	case int64:
-		return float64(val), true
+		return intToFloat64(val)
 	case int32:
 		return float64(val), true
 	default:
@@ -64,36 +69,112 @@ func toFloat64(v interface{}) (float64, bool) {
 	}
 }
 
+/*
+ * floatToInt64 浮点数为整数且在 int64 范围内时返回对应值
+ */
+func floatToInt64(f float64) (int64, bool) {
+	// -2^63 可以精确表示，2^63 已超出范围
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+/*
+ * intToFloat64 整数可被 float64 精确表示时返回对应值
+ */
+func intToFloat64(n int64) (float64, bool) {
+	f := float64(n)
+	if f >= math.MaxInt64 || int64(f) != n {
+		return 0, false
+	}
+	return f, true
+}
+
+/*
+ * toInt32Slice 将 []int32 或 JSON 解码得到的 []interface{}（元素均为 int32 范围内的整数）转换为 []int32
+ * 任一元素不是整数或超出 int32 范围时返回 false，不做截断
+ */
 func toInt32Slice(v interface{}) ([]int32, bool) {
 	switch s := v.(type) {
 	case []int32:
 		return s, true
 	case []interface{}:
-		result := make([]int32, 0, len(s))
-		for _, item := range s {
-			switch n := item.(type) {
-			case int32:
-				result = append(result, n)
-			case int:
-				result = append(result, int32(n))
-			case int64:
-				result = append(result, int32(n))
-			case float64:
-				result = append(result, int32(n))
-			default:
-				return nil, false
-			}
+		rv, ok := convertValue(s, reflect.TypeOf([]int32(nil)))
+		if !ok {
+			return nil, false
 		}
-		return result, true
+		return rv.Interface().([]int32), true
 	default:
 		return nil, false
 	}
 }
 
+/*
+ * toInt32Map 将 map[int32]int32 或 JSON 解码得到的 map[string]interface{}（键为十进制整数、值为整数）
+ * 转换为 map[int32]int32
+ */
+func toInt32Map(v interface{}) (map[int32]int32, bool) {
+	if m, ok := v.(map[int32]int32); ok {
+		return m, true
+	}
+	rv, ok := convertValue(v, reflect.TypeOf(map[int32]int32(nil)))
+	if !ok || rv.IsNil() {
+		return nil, false
+	}
+	return rv.Interface().(map[int32]int32), true
+}
+
 func UtilCopyMap(src map[string]interface{}) map[string]interface{} {
-    dst := make(map[string]interface{} , len(src))
-    for k, v := range src {
-        dst[k] = v
-    }
-    return dst
-}
\ No newline at end of file
+	dst := make(map[string]interface{}, len(src))
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
+
+/*
+ * cloneValue 复制 MiscData 中的值，slice/map 会递归复制，避免多条记录共享底层数据
+ */
+func cloneValue(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice:
+		if rv.IsNil() {
+			return v
+		}
+		dst := reflect.MakeSlice(rv.Type(), rv.Len(), rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			dst.Index(i).Set(cloneReflect(rv.Index(i)))
+		}
+		return dst.Interface()
+	case reflect.Map:
+		if rv.IsNil() {
+			return v
+		}
+		dst := reflect.MakeMapWithSize(rv.Type(), rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			dst.SetMapIndex(iter.Key(), cloneReflect(iter.Value()))
+		}
+		return dst.Interface()
+	default:
+		return v
+	}
+}
+
+/*
+ * cloneReflect 复制 reflect.Value 表示的元素，保持原有静态类型
+ */
+func cloneReflect(v reflect.Value) reflect.Value {
+	if v.Kind() == reflect.Interface && v.IsNil() {
+		return v
+	}
+	cloned := reflect.ValueOf(cloneValue(v.Interface()))
+	if v.Kind() == reflect.Interface {
+		out := reflect.New(v.Type()).Elem()
+		out.Set(cloned)
+		return out
+	}
+	return cloned
+}